@@ -0,0 +1,84 @@
+package wordgraph6
+
+import (
+	"errors"
+	"hash/fnv"
+	"math"
+)
+
+// BloomFilter is an approximate membership test over the words of
+// a graph. It has no false negatives, so a negative answer lets
+// callers skip the graph entirely.
+type BloomFilter struct {
+	bits   []uint64
+	m      uint64 // Number of bits.
+	hashes int
+	key    func(string) string // The graph's normaliser.
+}
+
+// BuildBloom sizes a filter for the current word count and the
+// requested false-positive rate and adds every word to it.
+func (t *treenode) BuildBloom(falsePositiveRate float64) (*BloomFilter, error) {
+	if falsePositiveRate <= 0 || falsePositiveRate >= 1 {
+		return nil, errors.New("wordgraph6: false-positive rate must be in (0, 1)")
+	}
+	n := float64(t.WordCount())
+	if n < 1 {
+		n = 1
+	}
+	m := math.Ceil(-n * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2))
+	k := int(math.Round(m / n * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	b := &BloomFilter{
+		bits:   make([]uint64, (uint64(m)+63)/64),
+		m:      uint64(m),
+		hashes: k,
+		key:    t.key,
+	}
+	t.eachWord(func(word []rune) {
+		h1, h2 := bloomHashes(word)
+		for i := 0; i < b.hashes; i++ {
+			bit := (h1 + uint64(i)*h2) % b.m
+			b.bits[bit/64] |= 1 << (bit % 64)
+		}
+	})
+	return b, nil
+}
+
+// MayContain reports false if word is certainly not in the graph.
+// word is normalised with the normaliser the graph had when the
+// filter was built.
+func (b *BloomFilter) MayContain(word string) bool {
+	h1, h2 := bloomHashes([]rune(b.key(word)))
+	for i := 0; i < b.hashes; i++ {
+		bit := (h1 + uint64(i)*h2) % b.m
+		if b.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// bloomHashes derives the two base hashes for double hashing.
+// Runes are hashed rather than bytes so that invalid UTF-8 maps
+// to the same key as the U+FFFD stored in the graph.
+func bloomHashes(word []rune) (uint64, uint64) {
+	h := fnv.New64a()
+	var buf [4]byte
+	for _, char := range word {
+		buf[0] = byte(char)
+		buf[1] = byte(char >> 8)
+		buf[2] = byte(char >> 16)
+		buf[3] = byte(char >> 24)
+		h.Write(buf[:])
+	}
+	h1 := h.Sum64()
+	// The second hash is a splitmix64 scramble of the first.
+	h2 := h1 + 0x9e3779b97f4a7c15
+	h2 = (h2 ^ (h2 >> 30)) * 0xbf58476d1ce4e5b9
+	h2 = (h2 ^ (h2 >> 27)) * 0x94d049bb133111eb
+	h2 ^= h2 >> 31
+	return h1, h2 | 1
+}
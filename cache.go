@@ -0,0 +1,38 @@
+package wordgraph6
+
+// CachedDerivedData keeps the data that is expensive to derive from a
+// graph together with the fingerprint of the graph it was derived from,
+// so that rebuilding an unchanged dictionary does not derive it again.
+// The zero value is an empty cache.
+type CachedDerivedData struct {
+	Fingerprint [20]byte
+	WordCount   int
+	Bloom       *BloomFilter
+	Flat        outarray
+
+	falsePositiveRate float64
+	valid             bool
+}
+
+// Refresh derives the data from t unless it was last derived from
+// a graph with the same fingerprint and for the same Bloom filter
+// false-positive rate. It reports whether the cached data was reused.
+func (c *CachedDerivedData) Refresh(t *treenode, falsePositiveRate float64) (bool, error) {
+	fingerprint := t.Fingerprint()
+	if c.valid && c.Fingerprint == fingerprint && c.falsePositiveRate == falsePositiveRate {
+		return true, nil
+	}
+	bloom, err := t.BuildBloom(falsePositiveRate)
+	if err != nil {
+		return false, err
+	}
+	*c = CachedDerivedData{
+		Fingerprint:       fingerprint,
+		WordCount:         t.WordCount(),
+		Bloom:             bloom,
+		Flat:              t.FlatArray(),
+		falsePositiveRate: falsePositiveRate,
+		valid:             true,
+	}
+	return false, nil
+}
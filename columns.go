@@ -0,0 +1,68 @@
+package wordgraph6
+
+import "unicode/utf8"
+
+// columnarray holds the records of an outarray column by column:
+// the runes and the children indices in arrays of their own and the
+// two flags as bitsets. Scanning the runes of a list then touches
+// only the runes, which suits bulk lookups better than the records.
+// Payloads are not kept.
+type columnarray struct {
+	vals      []rune
+	children  []uint32
+	eol       []uint64
+	endofword []uint64
+}
+
+// ColumnArray lays the graph out like FlatArray, column by column.
+func (t *treenode) ColumnArray() *columnarray {
+	return t.FlatArray().Columns()
+}
+
+// Columns converts the records of o into columns.
+func (o outarray) Columns() *columnarray {
+	c := &columnarray{
+		vals:      make([]rune, len(o)),
+		children:  make([]uint32, len(o)),
+		eol:       make([]uint64, (len(o)+63)/64),
+		endofword: make([]uint64, (len(o)+63)/64),
+	}
+	for i, el := range o {
+		c.vals[i] = el.val
+		c.children[i] = uint32(el.children)
+		if el.eol {
+			c.eol[i/64] |= 1 << (i % 64)
+		}
+		if el.endofword {
+			c.endofword[i/64] |= 1 << (i % 64)
+		}
+	}
+	return c
+}
+
+func bit(set []uint64, i uint32) bool {
+	return set[i/64]&(1<<(i%64)) != 0
+}
+
+// ContainsSOA is ContainsFlat on the columns.
+func (c *columnarray) ContainsSOA(s string) bool {
+	if len(c.vals) == 0 {
+		return false
+	}
+	var i uint32
+	for len(s) > 0 {
+		i = c.children[i]
+		if i == 0 {
+			return false
+		}
+		fchar, size := utf8.DecodeRuneInString(s)
+		s = s[size:]
+		for c.vals[i] != fchar {
+			if bit(c.eol, i) {
+				return false
+			}
+			i++
+		}
+	}
+	return bit(c.endofword, i)
+}
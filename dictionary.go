@@ -0,0 +1,197 @@
+package wordgraph6
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"os"
+)
+
+// Dictionary wraps a DAWG and keeps track of node ids itself,
+// so that callers do not have to thread an id counter through
+// every call. The low-level *treenode API remains available.
+type Dictionary struct {
+	root    *treenode
+	id      int
+	changes []change // Since the last snapshot, for WriteLog.
+}
+
+// NewDictionary returns an empty dictionary.
+func NewDictionary() *Dictionary {
+	return &Dictionary{root: NewDAWG()}
+}
+
+// maxTokenSize bounds the tokens FromReader reads, in place of
+// bufio.MaxScanTokenSize, which at 64 KiB is too small for some keys.
+// The buffer only grows as far as the longest token needs.
+const maxTokenSize = 1 << 30
+
+// FromReader builds a dictionary from the tokens that split cuts r
+// into, one word per token. A nil split reads one word per line, as
+// bufio.ScanLines does; bufio.ScanWords takes any whitespace instead.
+// Input that starts with the gzip magic number is decompressed first.
+// A token may be up to maxTokenSize bytes long.
+func FromReader(r io.Reader, split bufio.SplitFunc) (*Dictionary, error) {
+	br := bufio.NewReader(r)
+	r = br
+	if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		r = zr
+	}
+	d := NewDictionary()
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxTokenSize)
+	if split != nil {
+		scanner.Split(split)
+	}
+	for scanner.Scan() {
+		if err := d.Add(scanner.Text()); err != nil {
+			return nil, err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Add inserts word.
+func (d *Dictionary) Add(word string) error {
+	return d.AddWithCount(word, 1)
+}
+
+// AddWithCount inserts word as if it had been added n times.
+func (d *Dictionary) AddWithCount(word string, n int) error {
+	if err := d.root.AddWithCount(word, n, &d.id); err != nil {
+		return err
+	}
+	d.changes = append(d.changes, change{op: opAdd, word: word, count: n})
+	return nil
+}
+
+// PutPayload inserts word with data attached to it.
+func (d *Dictionary) PutPayload(word string, data []byte) error {
+	if err := d.root.PutPayload(word, data, &d.id); err != nil {
+		return err
+	}
+	d.changes = append(d.changes, change{op: opPayload, word: word, payload: append([]byte{}, data...)})
+	return nil
+}
+
+// GetPayload returns the data attached to word, if any.
+func (d *Dictionary) GetPayload(word string) ([]byte, bool) {
+	return d.root.GetPayload(word)
+}
+
+// Frequency returns how many times word has been added.
+func (d *Dictionary) Frequency(word string) int {
+	return d.root.Frequency(word)
+}
+
+// SetAlphabet restricts the runes that added words may contain.
+func (d *Dictionary) SetAlphabet(allowed func(rune) bool) {
+	d.root.SetAlphabet(allowed)
+}
+
+// SetNormalizer normalises every word and query with normalize.
+func (d *Dictionary) SetNormalizer(normalize func(string) string) {
+	d.root.SetNormalizer(normalize)
+}
+
+// SetPayloadPolicy chooses how PutPayload resolves collisions.
+func (d *Dictionary) SetPayloadPolicy(policy PayloadPolicy) {
+	d.root.SetPayloadPolicy(policy)
+}
+
+// Contains reports whether word has been added.
+func (d *Dictionary) Contains(word string) bool {
+	return d.root.Contains(word)
+}
+
+// Completions returns the sorted words that start with prefix.
+func (d *Dictionary) Completions(prefix string) []string {
+	return d.root.Completions(prefix)
+}
+
+// Delete removes word and reports whether it was present.
+func (d *Dictionary) Delete(word string) (bool, error) {
+	deleted, err := d.root.Delete(word, &d.id)
+	if deleted {
+		d.changes = append(d.changes, change{op: opDelete, word: word})
+	}
+	return deleted, err
+}
+
+// Replace deletes from and adds to in its place. It fails with
+// ErrWordNotFound, and changes nothing, if from is not present.
+func (d *Dictionary) Replace(from, to string) error {
+	if err := d.root.Replace(from, to, &d.id); err != nil {
+		return err
+	}
+	d.changes = append(d.changes, change{op: opDelete, word: from}, change{op: opAdd, word: to, count: 1})
+	return nil
+}
+
+// Optimise minimises the underlying graph.
+func (d *Dictionary) Optimise() {
+	d.root.Optimise()
+}
+
+// Save writes the flattened graph to filename. A successful Save
+// is a snapshot: the update log starts again from it.
+func (d *Dictionary) Save(filename string) error {
+	outfile, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if _, err := d.root.FlatArray().WriteTo(outfile); err != nil {
+		outfile.Close()
+		return err
+	}
+	if err := outfile.Close(); err != nil {
+		return err
+	}
+	d.changes = nil
+	return nil
+}
+
+// LoadDictionary reads a file written by Save back into a dictionary
+// that can be changed again, with its payloads and frequencies.
+func LoadDictionary(filename string) (*Dictionary, error) {
+	o, err := LoadFlat(filename)
+	if err != nil {
+		return nil, err
+	}
+	d := NewDictionary()
+	err = o.eachWord(func(word []rune, node arraynode) error {
+		freq := node.freq
+		if node.payload != nil {
+			if err := d.root.PutPayload(string(word), node.payload, &d.id); err != nil {
+				return err
+			}
+			freq--
+		}
+		if freq < 1 {
+			return nil
+		}
+		return d.root.AddWithCount(string(word), freq, &d.id)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Words returns all the words in sorted order.
+func (d *Dictionary) Words() []string {
+	return d.root.Words()
+}
+
+// Stats summarises the underlying graph.
+func (d *Dictionary) Stats() Stats {
+	return d.root.Stats()
+}
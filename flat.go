@@ -0,0 +1,899 @@
+package wordgraph6
+
+import (
+	"bufio"
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"unicode/utf8"
+)
+
+// Layout of a .wg file: a header followed by one record per arraynode.
+// In the fixed-width format every record has the same size, so records
+// can be read in place. If any node has a payload, the records are
+// followed by the payloads, each a uvarint length and the bytes, in
+// record order. Frequencies are only stored for words put more than
+// once, which the flags mark, as uvarints in record order after the
+// payloads; any other word was put once. The varint format stores the
+// node count, val and children as uvarints, with the payload and then
+// the frequency, if any, right after the flags byte, and can only be
+// read sequentially.
+const (
+	flatMagic          = "WG6\x00"
+	flatFormat         = 1                      // Fixed-width records.
+	flatFormatVarint   = 2                      // Varint count and records.
+	flatFormatPayloads = 3                      // Fixed-width records, payloads and frequencies.
+	flatHeaderSize     = len(flatMagic) + 1 + 4 // Magic, format byte, node count.
+	flatRecordSize     = 4 + 4 + 1              // val, children, flags.
+)
+
+// Bits of the flags byte of a record.
+const (
+	flagEOL       = 1 << iota // Last child in its list.
+	flagEndOfWord             // A word ends at this node.
+	flagPayload               // The node has a payload.
+	flagFreq                  // The word has a frequency above 1.
+)
+
+var errBadHeader = errors.New("wordgraph6: not a flattened DAWG")
+
+// ErrOldFlatFormat is returned for a .wg file written before the
+// header was introduced. Such files are bare 9-byte records that mark
+// no word ends, so the words cannot be read back from them; the graph
+// has to be built again from its word list and flattened anew.
+var ErrOldFlatFormat = errors.New("wordgraph6: .wg file in the old format without a header")
+
+// headerError tells a file of the old format, whose first record is
+// the root with its '∅', from a file of some other kind.
+func headerError(prefix []byte) error {
+	if binary.LittleEndian.Uint32(prefix) == '∅' {
+		return ErrOldFlatFormat
+	}
+	return errBadHeader
+}
+
+// maxFlatPrealloc caps the number of records allocated up front from
+// a header, which may be corrupt. Larger arrays grow as they are read.
+const maxFlatPrealloc = 1 << 16
+
+// minVarintRecordSize is the size of a varint record with
+// one-byte val and children.
+const minVarintRecordSize = 3
+
+// WriteTo writes the header, every node record, the payloads and the
+// frequencies to w. The first versions of Flatten wrote the records
+// alone, without a header; the readers refuse such files with
+// ErrOldFlatFormat.
+func (o outarray) WriteTo(w io.Writer) (int64, error) {
+	bw := bufio.NewWriter(w)
+	header := make([]byte, flatHeaderSize)
+	copy(header, flatMagic)
+	header[len(flatMagic)] = flatFormat
+	if o.hasPayloads() || o.hasFrequencies() {
+		header[len(flatMagic)] = flatFormatPayloads
+	}
+	binary.LittleEndian.PutUint32(header[len(flatMagic)+1:], uint32(len(o)))
+	if _, err := bw.Write(header); err != nil {
+		return 0, err
+	}
+	written := int64(flatHeaderSize)
+	record := make([]byte, flatRecordSize)
+	for _, el := range o {
+		el.encode(record)
+		if _, err := bw.Write(record); err != nil {
+			return written, err
+		}
+		written += flatRecordSize
+	}
+	lenBuf := make([]byte, binary.MaxVarintLen64)
+	for _, el := range o {
+		if el.payload == nil {
+			continue
+		}
+		n := binary.PutUvarint(lenBuf, uint64(len(el.payload)))
+		if _, err := bw.Write(lenBuf[:n]); err != nil {
+			return written, err
+		}
+		if _, err := bw.Write(el.payload); err != nil {
+			return written, err
+		}
+		written += int64(n + len(el.payload))
+	}
+	for _, el := range o {
+		if el.flags()&flagFreq == 0 {
+			continue
+		}
+		n := binary.PutUvarint(lenBuf, uint64(el.freq))
+		if _, err := bw.Write(lenBuf[:n]); err != nil {
+			return written, err
+		}
+		written += int64(n)
+	}
+	return written, bw.Flush()
+}
+
+func (o outarray) hasPayloads() bool {
+	for _, el := range o {
+		if el.payload != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (o outarray) hasFrequencies() bool {
+	for _, el := range o {
+		if el.flags()&flagFreq != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteCompactTo is WriteTo in the varint format. Most child indices
+// are small, so the file is usually much smaller, but it can only be
+// read with ReadFlat and LoadFlat, not with a FlatReader.
+func (o outarray) WriteCompactTo(w io.Writer) (int64, error) {
+	bw := bufio.NewWriter(w)
+	buf := make([]byte, 2*binary.MaxVarintLen32+1+2*binary.MaxVarintLen64)
+	n := copy(buf, flatMagic)
+	buf[n] = flatFormatVarint
+	n++
+	n += binary.PutUvarint(buf[n:], uint64(len(o)))
+	if _, err := bw.Write(buf[:n]); err != nil {
+		return 0, err
+	}
+	written := int64(n)
+	for _, el := range o {
+		n := binary.PutUvarint(buf, uint64(uint32(el.val)))
+		n += binary.PutUvarint(buf[n:], uint64(uint32(el.children)))
+		buf[n] = el.flags()
+		n++
+		if el.payload != nil {
+			n += binary.PutUvarint(buf[n:], uint64(len(el.payload)))
+		}
+		if _, err := bw.Write(buf[:n]); err != nil {
+			return written, err
+		}
+		if _, err := bw.Write(el.payload); err != nil {
+			return written, err
+		}
+		written += int64(n + len(el.payload))
+		if el.flags()&flagFreq != 0 {
+			n := binary.PutUvarint(buf, uint64(el.freq))
+			if _, err := bw.Write(buf[:n]); err != nil {
+				return written, err
+			}
+			written += int64(n)
+		}
+	}
+	return written, bw.Flush()
+}
+
+// SerializedSize returns the number of bytes WriteTo writes.
+func (o outarray) SerializedSize() int64 {
+	size := int64(flatHeaderSize) + int64(len(o))*flatRecordSize
+	for _, el := range o {
+		size += el.payloadSize() + el.freqSize()
+	}
+	return size
+}
+
+// CompactSerializedSize returns the number of bytes WriteCompactTo writes.
+func (o outarray) CompactSerializedSize() int64 {
+	size := int64(len(flatMagic) + 1 + uvarintLen(uint64(len(o))))
+	for _, el := range o {
+		size += int64(uvarintLen(uint64(uint32(el.val))) + uvarintLen(uint64(uint32(el.children))) + 1)
+		size += el.payloadSize() + el.freqSize()
+	}
+	return size
+}
+
+func (a arraynode) payloadSize() int64 {
+	if a.payload == nil {
+		return 0
+	}
+	return int64(uvarintLen(uint64(len(a.payload))) + len(a.payload))
+}
+
+func (a arraynode) freqSize() int64 {
+	if a.flags()&flagFreq == 0 {
+		return 0
+	}
+	return int64(uvarintLen(uint64(a.freq)))
+}
+
+func (a arraynode) encode(record []byte) {
+	binary.LittleEndian.PutUint32(record[0:], uint32(a.val))
+	binary.LittleEndian.PutUint32(record[4:], uint32(a.children))
+	record[8] = a.flags()
+}
+
+func (a arraynode) flags() byte {
+	var flags byte
+	if a.eol {
+		flags |= flagEOL
+	}
+	if a.endofword {
+		flags |= flagEndOfWord
+	}
+	if a.payload != nil {
+		flags |= flagPayload
+	}
+	if a.endofword && a.freq > 1 {
+		flags |= flagFreq
+	}
+	return flags
+}
+
+// decodeArraynode decodes a fixed-width record. A payload is
+// marked with an empty slice and a stored frequency with 0 until they
+// have been read; a word without one was put once.
+func decodeArraynode(record []byte) arraynode {
+	return decodeFields(
+		binary.LittleEndian.Uint32(record[0:]),
+		binary.LittleEndian.Uint32(record[4:]),
+		record[8],
+	)
+}
+
+func decodeFields(val, children uint32, flags byte) arraynode {
+	a := arraynode{
+		val:       rune(val),
+		children:  rune(children),
+		eol:       flags&flagEOL != 0,
+		endofword: flags&flagEndOfWord != 0,
+	}
+	if flags&flagPayload != 0 {
+		a.payload = []byte{}
+	}
+	if a.endofword && flags&flagFreq == 0 {
+		a.freq = 1
+	}
+	return a
+}
+
+// readFreq reads a stored frequency, which must be above 1.
+func readFreq(br *bufio.Reader) (int, error) {
+	freq, err := binary.ReadUvarint(br)
+	if err != nil {
+		return 0, err
+	}
+	if freq < 2 || freq > math.MaxInt {
+		return 0, fmt.Errorf("wordgraph6: bad frequency %d", freq)
+	}
+	return int(freq), nil
+}
+
+// readPayload reads a length-prefixed payload. The length is not
+// trusted: the bytes are only allocated as they arrive.
+func readPayload(br *bufio.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := io.ReadAll(io.LimitReader(br, int64(n)))
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(payload)) != n {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return payload, nil
+}
+
+// readFlatHeader parses the header of a file with fixed-width
+// records and returns the node count and the format.
+func readFlatHeader(header []byte) (int, byte, error) {
+	if string(header[:len(flatMagic)]) != flatMagic {
+		return 0, 0, headerError(header)
+	}
+	format := header[len(flatMagic)]
+	switch format {
+	case flatFormat, flatFormatPayloads:
+	case flatFormatVarint:
+		return 0, 0, errors.New("wordgraph6: varint files can only be read sequentially, use ReadFlat")
+	default:
+		return 0, 0, fmt.Errorf("wordgraph6: unknown format %d", format)
+	}
+	return int(binary.LittleEndian.Uint32(header[len(flatMagic)+1:])), format, nil
+}
+
+// ReadFlat reads a whole flattened DAWG into memory.
+// It accepts every format WriteTo and WriteCompactTo write.
+func ReadFlat(r io.Reader) (outarray, error) {
+	return readFlat(r, -1)
+}
+
+// readFlat rejects a header that declares more records than size
+// bytes can hold. A negative size means that it is not known.
+func readFlat(r io.Reader, size int64) (outarray, error) {
+	br := bufio.NewReader(r)
+	prefix := make([]byte, len(flatMagic)+1)
+	if _, err := io.ReadFull(br, prefix); err != nil {
+		return nil, err
+	}
+	if string(prefix[:len(flatMagic)]) != flatMagic {
+		return nil, headerError(prefix)
+	}
+	switch format := prefix[len(flatMagic)]; format {
+	case flatFormat, flatFormatPayloads:
+		return readFixed(br, size, format == flatFormatPayloads)
+	case flatFormatVarint:
+		return readVarint(br, size)
+	default:
+		return nil, fmt.Errorf("wordgraph6: unknown format %d", format)
+	}
+}
+
+func readFixed(br *bufio.Reader, size int64, payloads bool) (outarray, error) {
+	countBytes := make([]byte, 4)
+	if _, err := io.ReadFull(br, countBytes); err != nil {
+		return nil, err
+	}
+	count := uint64(binary.LittleEndian.Uint32(countBytes))
+	if size >= 0 && !fixedSizeFits(count, size, payloads) {
+		return nil, fmt.Errorf("wordgraph6: header declares %d nodes but the file has %d bytes", count, size)
+	}
+	output := newFlatArray(count)
+	record := make([]byte, flatRecordSize)
+	for i := uint64(0); i < count; i++ {
+		if _, err := io.ReadFull(br, record); err != nil {
+			return nil, err
+		}
+		output = append(output, decodeArraynode(record))
+	}
+	if payloads {
+		for i := range output {
+			if output[i].payload == nil {
+				continue
+			}
+			var err error
+			if output[i].payload, err = readPayload(br); err != nil {
+				return nil, err
+			}
+		}
+		for i := range output {
+			if !output[i].endofword || output[i].freq != 0 {
+				continue
+			}
+			var err error
+			if output[i].freq, err = readFreq(br); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return output, nil
+}
+
+// fixedSizeFits reports whether a file of size bytes has room for
+// count fixed-width records and nothing else, or at least room for
+// them if payloads or frequencies follow.
+func fixedSizeFits(count uint64, size int64, payloads bool) bool {
+	records := uint64(flatHeaderSize) + count*flatRecordSize
+	if payloads {
+		return records <= uint64(size)
+	}
+	return records == uint64(size)
+}
+
+func readVarint(br *bufio.Reader, size int64) (outarray, error) {
+	count, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, err
+	}
+	if size >= 0 {
+		body := uint64(size) - uint64(len(flatMagic)+1) - uint64(uvarintLen(count))
+		if count > body/minVarintRecordSize {
+			return nil, fmt.Errorf("wordgraph6: header declares %d nodes but the file has %d bytes", count, size)
+		}
+	}
+	output := newFlatArray(count)
+	for i := uint64(0); i < count; i++ {
+		val, err := binary.ReadUvarint(br)
+		if err != nil {
+			return nil, err
+		}
+		children, err := binary.ReadUvarint(br)
+		if err != nil {
+			return nil, err
+		}
+		flags, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		node := decodeFields(uint32(val), uint32(children), flags)
+		if node.payload != nil {
+			if node.payload, err = readPayload(br); err != nil {
+				return nil, err
+			}
+		}
+		if node.endofword && node.freq == 0 {
+			if node.freq, err = readFreq(br); err != nil {
+				return nil, err
+			}
+		}
+		output = append(output, node)
+	}
+	return output, nil
+}
+
+func newFlatArray(count uint64) outarray {
+	if count > maxFlatPrealloc {
+		count = maxFlatPrealloc
+	}
+	return make(outarray, 0, count)
+}
+
+func uvarintLen(x uint64) int {
+	n := 1
+	for ; x >= 0x80; x >>= 7 {
+		n++
+	}
+	return n
+}
+
+// LoadFlat reads a .wg file written by Flatten. The node count in
+// the header is checked against the size of the file before anything
+// is allocated. Files written before the header was introduced are
+// refused with ErrOldFlatFormat.
+func LoadFlat(filename string) (outarray, error) {
+	return loadFlat(filename, false)
+}
+
+// LoadFlatVerified is LoadFlat followed by VerifyFlat, for files that
+// may be corrupt. The check walks every record.
+func LoadFlatVerified(filename string) (outarray, error) {
+	return loadFlat(filename, true)
+}
+
+func loadFlat(filename string, verify bool) (outarray, error) {
+	infile, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer infile.Close()
+	info, err := infile.Stat()
+	if err != nil {
+		return nil, err
+	}
+	o, err := readFlat(infile, info.Size())
+	if err == nil && verify {
+		err = VerifyFlat(o)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// ContainsFlat walks the array from the root at index 0.
+// A child index of 0 means that the node has no children.
+func (o outarray) ContainsFlat(s string) bool {
+	i, found := o.findFlat(s)
+	return found && o[i].endofword
+}
+
+// VerifyFlat checks that o can be searched safely: that the root is
+// a run of its own and that the children index of every record points
+// into the array at a run of siblings that ends with an end-of-list
+// record before the end of the array. An array that passes cannot make
+// ContainsFlat or PayloadFlat read out of bounds.
+func VerifyFlat(o outarray) error {
+	return o.checkLayout()
+}
+
+// checkLayout verifies that the root is a run of its own and that
+// every children index points into the array at a run of records that
+// ends with an eol record, which is what ContainsFlat relies on.
+func (o outarray) checkLayout() error {
+	if len(o) == 0 {
+		return nil
+	}
+	if !o[0].eol {
+		return errors.New("wordgraph6: the root is not marked as the end of its list")
+	}
+	checked := make(map[rune]bool) // Runs are shared, so check each once.
+	for i, el := range o {
+		if el.children == 0 || checked[el.children] {
+			continue
+		}
+		if el.children < 0 || int(el.children) >= len(o) {
+			return fmt.Errorf("wordgraph6: node %d points to %d, outside the array", i, el.children)
+		}
+		checked[el.children] = true
+		j := int(el.children)
+		for j < len(o) && !o[j].eol {
+			j++
+		}
+		if j == len(o) {
+			return fmt.Errorf("wordgraph6: the children of node %d run off the end of the array", i)
+		}
+	}
+	return nil
+}
+
+// eachWord calls fn for every word of the array with the node it ends
+// at, in array order, stopping at the first error. The slice passed to
+// fn is reused. The layout is checked first, so a corrupt array cannot
+// send the walk out of bounds, but it can still make it long.
+func (o outarray) eachWord(fn func(word []rune, node arraynode) error) error {
+	if len(o) == 0 {
+		return nil
+	}
+	if err := o.checkLayout(); err != nil {
+		return err
+	}
+	if o[0].endofword {
+		if err := fn(nil, o[0]); err != nil {
+			return err
+		}
+	}
+	var word []rune
+	return o.eachWord1(o[0].children, &word, 0, fn)
+}
+
+func (o outarray) eachWord1(start rune, word *[]rune, depth int, fn func([]rune, arraynode) error) error {
+	if start == 0 {
+		return nil
+	}
+	if depth > len(o) {
+		return errors.New("wordgraph6: the array has a cycle")
+	}
+	for i := start; ; i++ {
+		*word = append(*word, o[i].val)
+		if o[i].endofword {
+			if err := fn(*word, o[i]); err != nil {
+				return err
+			}
+		}
+		if err := o.eachWord1(o[i].children, word, depth+1, fn); err != nil {
+			return err
+		}
+		*word = (*word)[:len(*word)-1]
+		if o[i].eol {
+			return nil
+		}
+	}
+}
+
+// PayloadFlat returns the payload stored with s, if any.
+func (o outarray) PayloadFlat(s string) ([]byte, bool) {
+	i, found := o.findFlat(s)
+	if !found || !o[i].endofword || o[i].payload == nil {
+		return nil, false
+	}
+	return o[i].payload, true
+}
+
+// FrequencyFlat returns how many times s was put, or 0 if it is not
+// a word. Arrays built with BuildFlatSorted do not record it.
+func (o outarray) FrequencyFlat(s string) int {
+	i, found := o.findFlat(s)
+	if !found || !o[i].endofword {
+		return 0
+	}
+	return o[i].freq
+}
+
+// findFlat returns the index of the node that s leads to.
+func (o outarray) findFlat(s string) (rune, bool) {
+	if len(o) == 0 {
+		return 0, false
+	}
+	var i rune
+	for len(s) > 0 {
+		i = o[i].children
+		if i == 0 {
+			return 0, false
+		}
+		fchar, size := utf8.DecodeRuneInString(s)
+		s = s[size:]
+		for o[i].val != fchar {
+			if o[i].eol {
+				return 0, false
+			}
+			i++
+		}
+	}
+	return i, true
+}
+
+// FlatReader answers queries against a flattened DAWG
+// without loading it into memory. Records are read on demand
+// and the most recently used ones are kept in a small cache.
+type FlatReader struct {
+	r      io.ReaderAt
+	file   *os.File
+	count  int
+	format byte
+	cache  map[rune]*list.Element
+	lru    *list.List
+	size   int
+	record []byte
+}
+
+type cachedNode struct {
+	index rune
+	node  arraynode
+}
+
+// DefaultFlatCacheSize is the number of records a FlatReader keeps.
+const DefaultFlatCacheSize = 4096
+
+// NewFlatReader reads the header from r and keeps up to
+// cacheSize records in memory.
+func NewFlatReader(r io.ReaderAt, cacheSize int) (*FlatReader, error) {
+	header := make([]byte, flatHeaderSize)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return nil, err
+	}
+	count, format, err := readFlatHeader(header)
+	if err != nil {
+		return nil, err
+	}
+	if cacheSize < 1 {
+		cacheSize = 1
+	}
+	fr := &FlatReader{
+		r:      r,
+		count:  count,
+		format: format,
+		cache:  make(map[rune]*list.Element),
+		lru:    list.New(),
+		size:   cacheSize,
+		record: make([]byte, flatRecordSize),
+	}
+	return fr, nil
+}
+
+// OpenFlat opens a .wg file for reading with a FlatReader.
+// The reader must be closed after use.
+func OpenFlat(filename string) (*FlatReader, error) {
+	infile, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	fr, err := NewFlatReader(infile, DefaultFlatCacheSize)
+	if err == nil {
+		var info os.FileInfo
+		if info, err = infile.Stat(); err == nil {
+			if !fixedSizeFits(uint64(fr.count), info.Size(), fr.format == flatFormatPayloads) {
+				err = fmt.Errorf("wordgraph6: header declares %d nodes but the file has %d bytes", fr.count, info.Size())
+			}
+		}
+	}
+	if err != nil {
+		infile.Close()
+		return nil, err
+	}
+	fr.file = infile
+	return fr, nil
+}
+
+// Close closes the underlying file if the reader was created by OpenFlat.
+func (fr *FlatReader) Close() error {
+	if fr.file == nil {
+		return nil
+	}
+	return fr.file.Close()
+}
+
+// Len returns the number of records in the file.
+func (fr *FlatReader) Len() int {
+	return fr.count
+}
+
+// Node returns the record at index i. Payloads are not read:
+// a node with a payload has an empty, non-nil one.
+func (fr *FlatReader) Node(i rune) (arraynode, error) {
+	if i < 0 || int(i) >= fr.count {
+		return arraynode{}, fmt.Errorf("wordgraph6: node index %d out of range", i)
+	}
+	if el, found := fr.cache[i]; found {
+		fr.lru.MoveToFront(el)
+		return el.Value.(*cachedNode).node, nil
+	}
+	offset := int64(flatHeaderSize) + int64(i)*flatRecordSize
+	if _, err := fr.r.ReadAt(fr.record, offset); err != nil {
+		return arraynode{}, err
+	}
+	node := decodeArraynode(fr.record)
+	if fr.lru.Len() >= fr.size {
+		oldest := fr.lru.Back()
+		fr.lru.Remove(oldest)
+		delete(fr.cache, oldest.Value.(*cachedNode).index)
+	}
+	fr.cache[i] = fr.lru.PushFront(&cachedNode{index: i, node: node})
+	return node, nil
+}
+
+// ContainsFlat is the on-disk counterpart of outarray.ContainsFlat.
+func (fr *FlatReader) ContainsFlat(s string) (bool, error) {
+	if fr.count == 0 {
+		return false, nil
+	}
+	node, err := fr.Node(0)
+	if err != nil {
+		return false, err
+	}
+	for len(s) > 0 {
+		i := node.children
+		if i == 0 {
+			return false, nil
+		}
+		fchar, size := utf8.DecodeRuneInString(s)
+		s = s[size:]
+		if node, err = fr.Node(i); err != nil {
+			return false, err
+		}
+		for node.val != fchar {
+			if node.eol {
+				return false, nil
+			}
+			i++
+			if node, err = fr.Node(i); err != nil {
+				return false, err
+			}
+		}
+	}
+	return node.endofword, nil
+}
+
+// VerifyFlattening checks that o, produced from t, accepts every word
+// of t and agrees with t on strings close to those words: their
+// proper prefixes, the words with an extra rune and the words with
+// their last rune changed.
+func (t *treenode) VerifyFlattening(o outarray) error {
+	var err error
+	check := func(s string) bool {
+		if want := t.Contains(s); o.ContainsFlat(s) != want {
+			err = fmt.Errorf("wordgraph6: flattened graph disagrees on %q (want %t)", s, want)
+			return false
+		}
+		return true
+	}
+	if !check("") {
+		return err
+	}
+	for _, word := range t.Words() {
+		runes := []rune(word)
+		if len(runes) == 0 {
+			continue
+		}
+		if !check(word) || !check(word+"a") {
+			return err
+		}
+		for i := 1; i < len(runes); i++ {
+			if !check(string(runes[:i])) {
+				return err
+			}
+		}
+		runes[len(runes)-1]++
+		if !check(string(runes)) {
+			return err
+		}
+	}
+	return nil
+}
+
+// flatWords streams the words of a FlatReader in array order, which
+// is sorted order because children are kept sorted. Only the current
+// path is held in memory.
+type flatWords struct {
+	fr      *FlatReader
+	stack   []rune // Index of the current node at every depth.
+	word    []rune
+	started bool
+}
+
+func (it *flatWords) next() (string, bool, error) {
+	if !it.started {
+		it.started = true
+		if it.fr.Len() == 0 {
+			return "", false, nil
+		}
+		it.stack = append(it.stack, 0)
+		root, err := it.fr.Node(0)
+		if err != nil {
+			return "", false, err
+		}
+		if root.endofword {
+			return "", true, nil
+		}
+	}
+	for {
+		node, ok, err := it.advance()
+		if err != nil || !ok {
+			return "", false, err
+		}
+		if node.endofword {
+			return string(it.word), true, nil
+		}
+	}
+}
+
+// advance moves to the next node in depth-first order.
+func (it *flatWords) advance() (arraynode, bool, error) {
+	current, err := it.fr.Node(it.stack[len(it.stack)-1])
+	if err != nil {
+		return arraynode{}, false, err
+	}
+	if current.children != 0 {
+		child, err := it.fr.Node(current.children)
+		if err != nil {
+			return arraynode{}, false, err
+		}
+		it.stack = append(it.stack, current.children)
+		it.word = append(it.word, child.val)
+		return child, true, nil
+	}
+	for len(it.stack) > 1 { // The root has no siblings.
+		top := it.stack[len(it.stack)-1]
+		node, err := it.fr.Node(top)
+		if err != nil {
+			return arraynode{}, false, err
+		}
+		if !node.eol {
+			sibling, err := it.fr.Node(top + 1)
+			if err != nil {
+				return arraynode{}, false, err
+			}
+			it.stack[len(it.stack)-1] = top + 1
+			it.word[len(it.word)-1] = sibling.val
+			return sibling, true, nil
+		}
+		it.stack = it.stack[:len(it.stack)-1]
+		it.word = it.word[:len(it.word)-1]
+	}
+	return arraynode{}, false, nil
+}
+
+// DiffFiles compares two .wg files without loading either of them,
+// merging their sorted word streams. It returns the words that are
+// only in newPath and those that are only in oldPath.
+func DiffFiles(oldPath, newPath string) (added, removed []string, err error) {
+	oldReader, err := OpenFlat(oldPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer oldReader.Close()
+	newReader, err := OpenFlat(newPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer newReader.Close()
+	oldWords := &flatWords{fr: oldReader}
+	newWords := &flatWords{fr: newReader}
+	oldWord, oldOK, err := oldWords.next()
+	if err != nil {
+		return nil, nil, err
+	}
+	newWord, newOK, err := newWords.next()
+	if err != nil {
+		return nil, nil, err
+	}
+	for oldOK || newOK {
+		switch {
+		case !newOK || (oldOK && oldWord < newWord):
+			removed = append(removed, oldWord)
+			oldWord, oldOK, err = oldWords.next()
+		case !oldOK || newWord < oldWord:
+			added = append(added, newWord)
+			newWord, newOK, err = newWords.next()
+		default:
+			oldWord, oldOK, err = oldWords.next()
+			if err == nil {
+				newWord, newOK, err = newWords.next()
+			}
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return added, removed, nil
+}
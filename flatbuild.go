@@ -0,0 +1,127 @@
+package wordgraph6
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// BuildFlatSorted builds the flattened form of the words read from r,
+// one per line, without building the tree first. The words must be in
+// sorted order; duplicates are skipped. Only the states on the path of
+// the current word are kept as they are being built: every other
+// state is minimised as soon as the input moves past it and its child
+// list is written to the array, or shared with an equal list that was
+// written before. Unlike Optimise, states are merged whatever their
+// level. Frequencies and payloads are not recorded.
+func BuildFlatSorted(r io.Reader) (outarray, error) {
+	b := &flatBuilder{
+		output:   outarray{{val: '∅', eol: true}},
+		register: make(map[string]rune),
+		path:     []*openState{{}},
+	}
+	scanner := bufio.NewScanner(r)
+	var prev string
+	first := true
+	for scanner.Scan() {
+		word := scanner.Text()
+		if !first && word <= prev {
+			if word == prev {
+				continue
+			}
+			return nil, errors.New("wordgraph6: input is not sorted: " + word + " after " + prev)
+		}
+		b.add(word)
+		prev, first = word, false
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	b.close(0)
+	root := b.path[0]
+	b.output[0].endofword = root.final
+	b.output[0].children = b.listOf(root)
+	return b.output, nil
+}
+
+type flatBuilder struct {
+	output   outarray
+	register map[string]rune // Index of every child list written so far.
+	path     []*openState    // States on the path of the last word.
+	last     []rune
+}
+
+// openState is a state that may still get children.
+type openState struct {
+	final  bool
+	labels []rune
+	closed []closedState // Targets of every label but the last.
+}
+
+// closedState is a minimised state: whether it is final and
+// where its child list starts, 0 if it has none.
+type closedState struct {
+	final    bool
+	children rune
+}
+
+func (b *flatBuilder) add(word string) {
+	runes := []rune(word)
+	common := 0
+	for common < len(runes) && common < len(b.last) && runes[common] == b.last[common] {
+		common++
+	}
+	b.close(common)
+	for _, char := range runes[common:] {
+		parent := b.path[len(b.path)-1]
+		parent.labels = append(parent.labels, char)
+		b.path = append(b.path, &openState{})
+	}
+	b.path[len(b.path)-1].final = true
+	b.last = runes
+}
+
+// close minimises the states deeper than depth and records each one
+// as the target of the last label of its parent.
+func (b *flatBuilder) close(depth int) {
+	for len(b.path) > depth+1 {
+		state := b.path[len(b.path)-1]
+		b.path = b.path[:len(b.path)-1]
+		parent := b.path[len(b.path)-1]
+		parent.closed = append(parent.closed, closedState{state.final, b.listOf(state)})
+	}
+}
+
+// listOf writes the child list of a state whose children are all
+// closed, unless an equal list has been written already, and returns
+// its index.
+func (b *flatBuilder) listOf(state *openState) rune {
+	if len(state.labels) == 0 {
+		return 0
+	}
+	key := make([]byte, 0, 9*len(state.labels))
+	for i, label := range state.labels {
+		key = binary.LittleEndian.AppendUint32(key, uint32(label))
+		key = binary.LittleEndian.AppendUint32(key, uint32(state.closed[i].children))
+		if state.closed[i].final {
+			key = append(key, 1)
+		} else {
+			key = append(key, 0)
+		}
+	}
+	if index, found := b.register[string(key)]; found {
+		return index
+	}
+	index := rune(len(b.output))
+	for i, label := range state.labels {
+		b.output = append(b.output, arraynode{
+			val:       label,
+			children:  state.closed[i].children,
+			eol:       i == len(state.labels)-1,
+			endofword: state.closed[i].final,
+		})
+	}
+	b.register[string(key)] = index
+	return index
+}
@@ -0,0 +1,421 @@
+package wordgraph6
+
+import (
+	"runtime"
+	"sort"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// FuzzySearch returns the words that are at most maxDist edits
+// (insertions, deletions and substitutions) away from query, sorted.
+func (t *treenode) FuzzySearch(query string, maxDist int) []string {
+	words, _ := t.FuzzySearchLimited(query, maxDist, 0)
+	return words
+}
+
+// FuzzySearchLimited is FuzzySearch stopped after maxResults words,
+// the first ones in the order of Words; 0 or less means no limit.
+// It reports whether words were left out.
+func (t *treenode) FuzzySearchLimited(query string, maxDist, maxResults int) ([]string, bool) {
+	res := &results{max: maxResults}
+	t.fuzzy([]rune(t.key(query)), maxDist, func(word []rune, dist int) bool {
+		return res.add(string(word))
+	})
+	sort.Strings(res.words)
+	return res.words, res.truncated
+}
+
+// FuzzyWithFixedPrefix returns, sorted, the words that start with
+// prefix and whose rest is at most maxDist edits away from rest: the
+// prefix is taken as typed and only the rest may be corrected. The
+// prefix is followed exactly first, so a prefix that no word starts
+// with costs no more than a failed lookup, and the edit matrix only
+// spans rest.
+func (t *treenode) FuzzyWithFixedPrefix(prefix, rest string, maxDist int) []string {
+	words, _ := t.FuzzyWithFixedPrefixLimited(prefix, rest, maxDist, 0)
+	return words
+}
+
+// FuzzyWithFixedPrefixLimited is FuzzyWithFixedPrefix stopped after
+// maxResults words, the first ones in the order of Words; 0 or less
+// means no limit. It reports whether words were left out.
+func (t *treenode) FuzzyWithFixedPrefixLimited(prefix, rest string, maxDist, maxResults int) ([]string, bool) {
+	prefix = t.key(prefix)
+	node := t.find(prefix)
+	if node == nil {
+		return nil, false
+	}
+	res := &results{max: maxResults}
+	node.fuzzy([]rune(t.key(rest)), maxDist, func(word []rune, dist int) bool {
+		return res.add(prefix + string(word))
+	})
+	sort.Strings(res.words)
+	return res.words, res.truncated
+}
+
+// Neighbors returns, sorted, the words exactly one edit away from word:
+// FuzzySearch(word, 1) without word itself. Instead of carrying a row
+// of the edit matrix through every branch, it follows word and, at
+// every position, looks up the rest of word after deleting the rune
+// there, after each sibling that could replace it and after each
+// child that could be inserted before it. Only those lookups leave the
+// path of word.
+func (t *treenode) Neighbors(word string) []string {
+	word = t.key(word)
+	found := make(map[string]bool)
+	lookup := func(node *treenode, rest string, candidate func() string) {
+		if end := node.find(rest); end != nil && end.endofword {
+			found[candidate()] = true
+		}
+	}
+	node := t
+	for i := 0; node != nil; {
+		prefix, rest := word[:i], word[i:]
+		for child := node.children; child != nil; child = child.next {
+			lookup(child, rest, func() string { return prefix + string(child.val) + rest })
+		}
+		if rest == "" {
+			break
+		}
+		char, size := utf8.DecodeRuneInString(rest)
+		after := rest[size:]
+		lookup(node, after, func() string { return prefix + after })
+		for child := node.children; child != nil; child = child.next {
+			if child.val != char {
+				lookup(child, after, func() string { return prefix + string(child.val) + after })
+			}
+		}
+		node = node.child(char)
+		i += size
+	}
+	words := make([]string, 0, len(found))
+	for w := range found {
+		words = append(words, w)
+	}
+	sort.Strings(words)
+	return words
+}
+
+// SuggestGrouped is like FuzzySearch but buckets the matches
+// by their exact edit distance from query. Every bucket is sorted.
+func (t *treenode) SuggestGrouped(query string, maxDist int) map[int][]string {
+	groups, _ := t.SuggestGroupedLimited(query, maxDist, 0)
+	return groups
+}
+
+// SuggestGroupedLimited is SuggestGrouped stopped after maxResults
+// words in all, the first ones in the order of Words whatever their
+// distance; 0 or less means no limit. It reports whether words were
+// left out.
+func (t *treenode) SuggestGroupedLimited(query string, maxDist, maxResults int) (map[int][]string, bool) {
+	groups := make(map[int][]string)
+	found := 0
+	truncated := false
+	t.fuzzy([]rune(t.key(query)), maxDist, func(word []rune, dist int) bool {
+		if maxResults > 0 && found == maxResults {
+			truncated = true
+			return false
+		}
+		groups[dist] = append(groups[dist], string(word))
+		found++
+		return true
+	})
+	for _, group := range groups {
+		sort.Strings(group)
+	}
+	return groups, truncated
+}
+
+// HammingSearch returns, in the order of Words, the words as long as
+// query, in runes, that differ from it at no more than k positions.
+// A branch is left as soon as it has more than k mismatches.
+func (t *treenode) HammingSearch(query string, k int) []string {
+	words, _ := t.HammingSearchLimited(query, k, 0)
+	return words
+}
+
+// HammingSearchLimited is HammingSearch stopped after the first
+// maxResults words; 0 or less means no limit. It reports whether
+// words were left out.
+func (t *treenode) HammingSearchLimited(query string, k, maxResults int) ([]string, bool) {
+	if k < 0 {
+		return nil, false
+	}
+	query = t.key(query)
+	res := &results{max: maxResults}
+	word := make([]rune, 0, len(query))
+	t.hamming([]rune(query), k, &word, res)
+	return res.words, res.truncated
+}
+
+func (t *treenode) hamming(query []rune, k int, word *[]rune, res *results) {
+	i := len(*word)
+	if i == len(query) {
+		if t.endofword {
+			res.add(string(*word))
+		}
+		return
+	}
+	for child := t.children; child != nil && !res.truncated; child = child.next {
+		left := k
+		if child.val != query[i] {
+			if left == 0 {
+				continue
+			}
+			left--
+		}
+		*word = append(*word, child.val)
+		child.hamming(query, left, word, res)
+		*word = (*word)[:i]
+	}
+}
+
+// FuzzySearchParallel is FuzzySearch with the subtrees of the root's
+// children searched by up to workers goroutines; 0 or less means
+// GOMAXPROCS. Every subtree starts from the root's row of the edit
+// matrix, so edits at the first position are handled as in the serial
+// search. The graph must not be changed while it runs.
+func (t *treenode) FuzzySearchParallel(query string, maxDist, workers int) []string {
+	words, _ := t.FuzzySearchParallelLimited(query, maxDist, workers, 0)
+	return words
+}
+
+// FuzzySearchParallelLimited is FuzzySearchParallel stopped after
+// maxResults words, the same ones as FuzzySearchLimited keeps; 0 or
+// less means no limit. Every subtree stops once it has maxResults
+// words of its own, and the subtrees are then joined in order. It
+// reports whether words were left out.
+func (t *treenode) FuzzySearchParallelLimited(query string, maxDist, workers, maxResults int) ([]string, bool) {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	runes := []rune(t.key(query))
+	row := make([]int, len(runes)+1)
+	for i := range row {
+		row[i] = i
+	}
+	var subtrees []*treenode
+	for child := t.children; child != nil; child = child.next {
+		subtrees = append(subtrees, child)
+	}
+	found := make([]*results, len(subtrees))
+	shards := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var word []rune
+			for i := range shards {
+				res := &results{max: maxResults}
+				subtrees[i].fuzzyStep(runes, row, &word, maxDist, func(word []rune, dist int) bool {
+					return res.add(string(word))
+				})
+				found[i] = res
+			}
+		}()
+	}
+	for i := range subtrees {
+		shards <- i
+	}
+	close(shards)
+	wg.Wait()
+	all := &results{max: maxResults}
+	if t.endofword && row[len(runes)] <= maxDist {
+		all.add("")
+	}
+	for _, res := range found {
+		for _, word := range res.words {
+			if !all.add(word) {
+				break
+			}
+		}
+		if res.truncated {
+			all.truncated = true
+		}
+		if all.truncated {
+			break
+		}
+	}
+	sort.Strings(all.words)
+	return all.words, all.truncated
+}
+
+// fuzzy walks the graph keeping one row of the Levenshtein matrix
+// per level and calls visit for every accepting node within maxDist,
+// in sorted order, until visit returns false. Subtrees are pruned as
+// soon as no cell of the row is within reach.
+func (t *treenode) fuzzy(query []rune, maxDist int, visit func(word []rune, dist int) bool) {
+	row := make([]int, len(query)+1)
+	for i := range row {
+		row[i] = i
+	}
+	if t.endofword && row[len(query)] <= maxDist {
+		if !visit(nil, row[len(query)]) {
+			return
+		}
+	}
+	var word []rune
+	for child := t.children; child != nil; child = child.next {
+		if !child.fuzzyStep(query, row, &word, maxDist, visit) {
+			return
+		}
+	}
+}
+
+// fuzzyStep reports whether the walk should go on.
+func (t *treenode) fuzzyStep(query []rune, prev []int, word *[]rune, maxDist int, visit func(word []rune, dist int) bool) bool {
+	row := make([]int, len(prev))
+	row[0] = prev[0] + 1
+	best := row[0]
+	for i := 1; i < len(row); i++ {
+		cost := 1
+		if query[i-1] == t.val {
+			cost = 0
+		}
+		row[i] = prev[i-1] + cost
+		if row[i-1]+1 < row[i] {
+			row[i] = row[i-1] + 1
+		}
+		if prev[i]+1 < row[i] {
+			row[i] = prev[i] + 1
+		}
+		if row[i] < best {
+			best = row[i]
+		}
+	}
+	*word = append(*word, t.val)
+	defer func() { *word = (*word)[:len(*word)-1] }()
+	if t.endofword && row[len(query)] <= maxDist {
+		if !visit(*word, row[len(query)]) {
+			return false
+		}
+	}
+	if best <= maxDist {
+		for child := t.children; child != nil; child = child.next {
+			if !child.fuzzyStep(query, row, word, maxDist, visit) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Costs used by Autocorrect. Hitting a key next to the intended one
+// is a likelier slip than hitting any other key.
+const (
+	AdjacentKeyCost             = 0.5
+	DefaultAutocorrectThreshold = 2.0
+)
+
+// QWERTY maps every letter of a QWERTY keyboard to its neighbours.
+var QWERTY = keyboardAdjacency("qwertyuiop", "asdfghjkl", "zxcvbnm")
+
+// keyboardAdjacency assumes that every row is shifted half a key
+// to the right of the row above it.
+func keyboardAdjacency(rows ...string) map[rune]string {
+	grid := make([][]rune, len(rows))
+	for i, row := range rows {
+		grid[i] = []rune(row)
+	}
+	at := func(r, c int) (rune, bool) {
+		if r < 0 || r >= len(grid) || c < 0 || c >= len(grid[r]) {
+			return 0, false
+		}
+		return grid[r][c], true
+	}
+	adjacency := make(map[rune]string)
+	for r, row := range grid {
+		for c, key := range row {
+			var neighbours []rune
+			for _, pos := range [][2]int{{r, c - 1}, {r, c + 1}, {r - 1, c}, {r - 1, c + 1}, {r + 1, c - 1}, {r + 1, c}} {
+				if other, ok := at(pos[0], pos[1]); ok {
+					neighbours = append(neighbours, other)
+				}
+			}
+			adjacency[key] = string(neighbours)
+		}
+	}
+	return adjacency
+}
+
+// Autocorrect returns word itself if it is in the graph, and otherwise
+// the closest word on a QWERTY keyboard, if any is close enough.
+func (t *treenode) Autocorrect(word string) (string, bool) {
+	return t.AutocorrectWith(word, QWERTY, DefaultAutocorrectThreshold)
+}
+
+// AutocorrectWith is Autocorrect with a custom keyboard layout and
+// threshold. Insertions and deletions cost 1, substituting a key for
+// one of its neighbours costs AdjacentKeyCost and any other
+// substitution costs 1. Ties go to the lexicographically first word.
+func (t *treenode) AutocorrectWith(word string, keyboard map[rune]string, threshold float64) (string, bool) {
+	word = t.key(word)
+	if t.Contains(word) {
+		return word, true
+	}
+	query := []rune(word)
+	row := make([]float64, len(query)+1)
+	for i := range row {
+		row[i] = float64(i)
+	}
+	best := ""
+	bestCost := threshold
+	found := false
+	if t.endofword && row[len(query)] <= bestCost {
+		bestCost = row[len(query)]
+		found = true
+	}
+	var path []rune
+	for child := t.children; child != nil; child = child.next {
+		child.autocorrect(query, row, &path, keyboard, &best, &bestCost, &found)
+	}
+	return best, found
+}
+
+func (t *treenode) autocorrect(query []rune, prev []float64, path *[]rune, keyboard map[rune]string, best *string, bestCost *float64, found *bool) {
+	row := make([]float64, len(prev))
+	row[0] = prev[0] + 1
+	lowest := row[0]
+	for i := 1; i < len(row); i++ {
+		row[i] = prev[i-1] + substitutionCost(query[i-1], t.val, keyboard)
+		if row[i-1]+1 < row[i] {
+			row[i] = row[i-1] + 1
+		}
+		if prev[i]+1 < row[i] {
+			row[i] = prev[i] + 1
+		}
+		if row[i] < lowest {
+			lowest = row[i]
+		}
+	}
+	*path = append(*path, t.val)
+	if t.endofword {
+		cost := row[len(query)]
+		if cost < *bestCost || (!*found && cost <= *bestCost) {
+			*best = string(*path)
+			*bestCost = cost
+			*found = true
+		}
+	}
+	if lowest <= *bestCost {
+		for child := t.children; child != nil; child = child.next {
+			child.autocorrect(query, row, path, keyboard, best, bestCost, found)
+		}
+	}
+	*path = (*path)[:len(*path)-1]
+}
+
+func substitutionCost(typed, intended rune, keyboard map[rune]string) float64 {
+	if typed == intended {
+		return 0
+	}
+	for _, neighbour := range keyboard[unicode.ToLower(intended)] {
+		if neighbour == unicode.ToLower(typed) {
+			return AdjacentKeyCost
+		}
+	}
+	return 1
+}
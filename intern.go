@@ -0,0 +1,168 @@
+package wordgraph6
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"unicode/utf8"
+)
+
+// RuneTable numbers the distinct runes of a graph, the most frequent
+// first, so that a rune can be stored as its two-byte index.
+type RuneTable struct {
+	Runes []rune // The rune of every index.
+	index map[rune]uint16
+}
+
+// ErrAlphabetTooLarge is returned when a graph has more distinct
+// runes than a RuneTable can number.
+var ErrAlphabetTooLarge = errors.New("wordgraph6: more than 65536 distinct runes")
+
+// RuneTable numbers the runes counted by RuneFrequencies. Equally
+// frequent runes are numbered in rune order.
+func (t *treenode) RuneTable() (*RuneTable, error) {
+	counts := t.RuneFrequencies()
+	runes := make([]rune, 0, len(counts))
+	for char := range counts {
+		runes = append(runes, char)
+	}
+	sort.Slice(runes, func(i, j int) bool {
+		if counts[runes[i]] != counts[runes[j]] {
+			return counts[runes[i]] > counts[runes[j]]
+		}
+		return runes[i] < runes[j]
+	})
+	return newRuneTable(runes)
+}
+
+func newRuneTable(runes []rune) (*RuneTable, error) {
+	if len(runes) > 1<<16 {
+		return nil, ErrAlphabetTooLarge
+	}
+	rt := &RuneTable{Runes: runes, index: make(map[rune]uint16, len(runes))}
+	for i, char := range runes {
+		if _, found := rt.index[char]; found {
+			return nil, fmt.Errorf("wordgraph6: rune %q is in the table twice", char)
+		}
+		rt.index[char] = uint16(i)
+	}
+	return rt, nil
+}
+
+// Index returns the index of char, if it is in the table.
+func (rt *RuneTable) Index(char rune) (uint16, bool) {
+	i, found := rt.index[char]
+	return i, found
+}
+
+// WriteTo writes the number of runes and then the runes in index
+// order, all as uvarints.
+func (rt *RuneTable) WriteTo(w io.Writer) (int64, error) {
+	buf := binary.AppendUvarint(nil, uint64(len(rt.Runes)))
+	for _, char := range rt.Runes {
+		buf = binary.AppendUvarint(buf, uint64(char))
+	}
+	n, err := w.Write(buf)
+	return int64(n), err
+}
+
+// ReadRuneTable reads a table written by RuneTable.WriteTo.
+func ReadRuneTable(r io.Reader) (*RuneTable, error) {
+	br := bufio.NewReader(r)
+	count, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, err
+	}
+	if count > 1<<16 {
+		return nil, ErrAlphabetTooLarge
+	}
+	runes := make([]rune, count)
+	for i := range runes {
+		char, err := binary.ReadUvarint(br)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		if char > utf8.MaxRune {
+			return nil, fmt.Errorf("wordgraph6: %d is not a rune", char)
+		}
+		runes[i] = rune(char)
+	}
+	return newRuneTable(runes)
+}
+
+// internedarray is an outarray whose runes are replaced by their
+// indices in a RuneTable, which makes a record 8 bytes long. Payloads
+// are not kept.
+type internedarray struct {
+	table *RuneTable
+	nodes []internednode
+}
+
+type internednode struct {
+	children  uint32
+	symbol    uint16
+	eol       bool
+	endofword bool
+}
+
+// InternedArray lays the graph out like FlatArray with its runes
+// numbered by the graph's RuneTable.
+func (t *treenode) InternedArray() (*internedarray, error) {
+	rt, err := t.RuneTable()
+	if err != nil {
+		return nil, err
+	}
+	return t.FlatArray().Intern(rt)
+}
+
+// Intern replaces the runes of o by their indices in rt, which
+// must number every rune in o but the root's.
+func (o outarray) Intern(rt *RuneTable) (*internedarray, error) {
+	a := &internedarray{table: rt, nodes: make([]internednode, len(o))}
+	for i, el := range o {
+		a.nodes[i] = internednode{children: uint32(el.children), eol: el.eol, endofword: el.endofword}
+		if i == 0 {
+			continue // The root's rune is never read.
+		}
+		symbol, found := rt.Index(el.val)
+		if !found {
+			return nil, fmt.Errorf("wordgraph6: rune %q is not in the table", el.val)
+		}
+		a.nodes[i].symbol = symbol
+	}
+	return a, nil
+}
+
+// ContainsInterned is ContainsFlat on the interned array. A rune
+// that is not in the table cannot be on any path.
+func (a *internedarray) ContainsInterned(s string) bool {
+	if len(a.nodes) == 0 {
+		return false
+	}
+	var i uint32
+	for len(s) > 0 {
+		i = a.nodes[i].children
+		if i == 0 {
+			return false
+		}
+		fchar, size := utf8.DecodeRuneInString(s)
+		s = s[size:]
+		symbol, found := a.table.Index(fchar)
+		if !found {
+			return false
+		}
+		for a.nodes[i].symbol != symbol {
+			if a.nodes[i].eol {
+				return false
+			}
+			i++
+		}
+	}
+	return a.nodes[i].endofword
+}
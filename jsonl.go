@@ -0,0 +1,38 @@
+package wordgraph6
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+)
+
+// jsonlRecord is one line of WriteJSONL.
+type jsonlRecord struct {
+	Word    string `json:"word"`
+	Freq    int    `json:"freq"`
+	Len     int    `json:"len"`
+	Payload []byte `json:"payload,omitempty"` // Base64, as encoding/json writes bytes.
+}
+
+// WriteJSONL writes every word as a JSON object on a line of its own,
+// in the order of Words: {"word": ..., "freq": ..., "len": ...}, where
+// freq is what Frequency returns and len is the length in runes, with
+// a "payload" in base64 if the word has one. The words are written as
+// they are enumerated, so memory does not grow with their number.
+func (t *treenode) WriteJSONL(w io.Writer) error {
+	writer := bufio.NewWriter(w)
+	encoder := json.NewEncoder(writer)
+	encoder.SetEscapeHTML(false)
+	err := t.eachWordNode(func(word []rune, node *treenode) error {
+		return encoder.Encode(jsonlRecord{
+			Word:    string(word),
+			Freq:    node.freq,
+			Len:     len(word),
+			Payload: node.payload,
+		})
+	})
+	if err != nil {
+		return err
+	}
+	return writer.Flush()
+}
@@ -0,0 +1,165 @@
+package wordgraph6
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"unicode/utf8"
+)
+
+// MappedDictionary answers queries from a .wg file mapped into memory,
+// so that the records are paged in by the operating system as they
+// are needed and shared between processes that open the same file.
+// On systems without mmap the file is read into memory instead. The
+// file must have been written by WriteTo; payloads are not read.
+// A MappedDictionary must not be used after Close.
+type MappedDictionary struct {
+	data    []byte // The whole file.
+	records []byte // The records within data.
+	count   int
+	mapped  bool
+}
+
+// Open maps filename and checks that every children index stays
+// within the file, so that no query can read past its end.
+func Open(filename string) (*MappedDictionary, error) {
+	infile, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer infile.Close()
+	info, err := infile.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() < int64(flatHeaderSize) {
+		return nil, errBadHeader
+	}
+	header := make([]byte, flatHeaderSize)
+	if _, err := infile.ReadAt(header, 0); err != nil {
+		return nil, err
+	}
+	count, format, err := readFlatHeader(header)
+	if err != nil {
+		return nil, err
+	}
+	if !fixedSizeFits(uint64(count), info.Size(), format == flatFormatPayloads) {
+		return nil, fmt.Errorf("wordgraph6: header declares %d nodes but the file has %d bytes", count, info.Size())
+	}
+	data, mapped, err := mapFile(infile, info.Size())
+	if err != nil {
+		return nil, err
+	}
+	m := &MappedDictionary{
+		data:    data,
+		records: data[flatHeaderSize : flatHeaderSize+count*flatRecordSize],
+		count:   count,
+		mapped:  mapped,
+	}
+	if err := m.check(); err != nil {
+		m.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+// check verifies that the root and the last record end their runs and
+// that every children index is in range. Every run then ends within
+// the records.
+func (m *MappedDictionary) check() error {
+	if m.count == 0 {
+		return nil
+	}
+	if !m.node(0).eol || !m.node(rune(m.count-1)).eol {
+		return errors.New("wordgraph6: the records do not end a run where they must")
+	}
+	for i := 0; i < m.count; i++ {
+		if children := m.node(rune(i)).children; children < 0 || int(children) >= m.count {
+			return fmt.Errorf("wordgraph6: node %d points to %d, outside the file", i, children)
+		}
+	}
+	return nil
+}
+
+func (m *MappedDictionary) node(i rune) arraynode {
+	record := m.records[int(i)*flatRecordSize:]
+	return decodeFields(binary.LittleEndian.Uint32(record[0:]), binary.LittleEndian.Uint32(record[4:]), record[8])
+}
+
+// Close unmaps the file. Queries after Close find nothing.
+func (m *MappedDictionary) Close() error {
+	if m.data == nil {
+		return nil
+	}
+	var err error
+	if m.mapped {
+		err = unmapFile(m.data)
+	}
+	m.data, m.records, m.count = nil, nil, 0
+	return err
+}
+
+// Contains reports whether s is in the file.
+func (m *MappedDictionary) Contains(s string) bool {
+	i, found := m.find(s)
+	return found && m.node(i).endofword
+}
+
+func (m *MappedDictionary) find(s string) (rune, bool) {
+	if m.count == 0 {
+		return 0, false
+	}
+	var i rune
+	for len(s) > 0 {
+		i = m.node(i).children
+		if i == 0 {
+			return 0, false
+		}
+		fchar, size := utf8.DecodeRuneInString(s)
+		s = s[size:]
+		for m.node(i).val != fchar {
+			if m.node(i).eol {
+				return 0, false
+			}
+			i++
+		}
+	}
+	return i, true
+}
+
+// Completions returns the words in the file that start with prefix,
+// prefix itself included, in file order, which is sorted order for
+// files written from a graph.
+func (m *MappedDictionary) Completions(prefix string) []string {
+	i, found := m.find(prefix)
+	if !found {
+		return nil
+	}
+	var words []string
+	if m.node(i).endofword {
+		words = append(words, prefix)
+	}
+	word := []rune(prefix)
+	m.completions(m.node(i).children, &word, 0, &words)
+	return words
+}
+
+// completions gives up below a depth no acyclic file can reach.
+func (m *MappedDictionary) completions(start rune, word *[]rune, depth int, words *[]string) {
+	if start == 0 || depth > m.count {
+		return
+	}
+	for i := start; ; i++ {
+		node := m.node(i)
+		*word = append(*word, node.val)
+		if node.endofword {
+			*words = append(*words, string(*word))
+		}
+		m.completions(node.children, word, depth+1, words)
+		*word = (*word)[:len(*word)-1]
+		if node.eol {
+			return
+		}
+	}
+}
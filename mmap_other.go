@@ -0,0 +1,22 @@
+//go:build !unix
+
+package wordgraph6
+
+import (
+	"io"
+	"os"
+)
+
+// mapFile reads the first size bytes of f, for systems where
+// the package does not map files.
+func mapFile(f *os.File, size int64) ([]byte, bool, error) {
+	data := make([]byte, size)
+	if _, err := f.ReadAt(data, 0); err != nil && err != io.EOF {
+		return nil, false, err
+	}
+	return data, false, nil
+}
+
+func unmapFile(data []byte) error {
+	return nil
+}
@@ -0,0 +1,54 @@
+package wordgraph6
+
+// Node is a read-only view of a node of a graph, for callers that
+// walk the graph themselves. It stays valid while the graph is not
+// changed.
+type Node struct {
+	node *treenode
+}
+
+// Rune returns the rune of the node.
+func (n *Node) Rune() rune {
+	return n.node.val
+}
+
+// IsWord reports whether a word ends at the node.
+func (n *Node) IsWord() bool {
+	return n.node.endofword
+}
+
+// Child returns the child of the node with the given rune, or nil.
+func (n *Node) Child(char rune) *Node {
+	child := n.node.child(char)
+	if child == nil {
+		return nil
+	}
+	return &Node{child}
+}
+
+// Children returns the children of the node in their order.
+func (n *Node) Children() []*Node {
+	var children []*Node
+	for child := n.node.children; child != nil; child = child.next {
+		children = append(children, &Node{child})
+	}
+	return children
+}
+
+// Contains reports whether rest, spelled from the node, ends a word.
+// Unlike the graph's Contains it does not normalise rest.
+func (n *Node) Contains(rest string) bool {
+	node := n.node.find(rest)
+	return node != nil && node.endofword
+}
+
+// FirstLevelIndex returns the children of the root by rune, so that
+// queries can be sent to the subtree of their first rune without
+// going through the root again.
+func (t *treenode) FirstLevelIndex() map[rune]*Node {
+	index := make(map[rune]*Node)
+	for child := t.children; child != nil; child = child.next {
+		index[child.val] = &Node{child}
+	}
+	return index
+}
@@ -0,0 +1,160 @@
+package wordgraph6
+
+import (
+	"errors"
+	"fmt"
+	"unicode/utf8"
+)
+
+// ErrBadPattern is returned by PatternSearch for a pattern it cannot parse.
+var ErrBadPattern = errors.New("wordgraph6: bad pattern")
+
+// patternElement matches one rune: any rune, one rune, or a class.
+type patternElement struct {
+	any     bool
+	char    rune
+	class   []runeRange // Set for a class.
+	negated bool
+}
+
+type runeRange struct {
+	lo, hi rune
+}
+
+func (e patternElement) matches(char rune) bool {
+	switch {
+	case e.any:
+		return true
+	case e.class == nil:
+		return char == e.char
+	}
+	for _, r := range e.class {
+		if r.lo <= char && char <= r.hi {
+			return !e.negated
+		}
+	}
+	return e.negated
+}
+
+// PatternSearch returns, in sorted order, the words that match pattern
+// rune for rune. In the pattern "?" matches any rune, a class such as
+// "[aeiou]" or "[a-z]" any rune in it and "[^x]" any rune not in it, and
+// a backslash makes the rune after it, "?", "[" or "\" among them, stand
+// for itself, also inside a class. Every other rune matches itself. At a
+// class only the children in the class are followed. The pattern is
+// not normalised.
+func (t *treenode) PatternSearch(pattern string) ([]string, error) {
+	words, _, err := t.PatternSearchLimited(pattern, 0)
+	return words, err
+}
+
+// PatternSearchLimited is PatternSearch stopped after the first
+// maxResults words; 0 or less means no limit. It reports whether words
+// were left out.
+func (t *treenode) PatternSearchLimited(pattern string, maxResults int) ([]string, bool, error) {
+	elements, err := parsePattern(pattern)
+	if err != nil {
+		return nil, false, err
+	}
+	res := &results{max: maxResults}
+	var word []rune
+	t.patternSearch(elements, &word, res)
+	return res.words, res.truncated, nil
+}
+
+func (t *treenode) patternSearch(elements []patternElement, word *[]rune, res *results) {
+	if len(elements) == 0 {
+		if t.endofword {
+			res.add(string(*word))
+		}
+		return
+	}
+	if e := elements[0]; !e.any && e.class == nil {
+		if child := t.child(e.char); child != nil {
+			*word = append(*word, child.val)
+			child.patternSearch(elements[1:], word, res)
+			*word = (*word)[:len(*word)-1]
+		}
+		return
+	}
+	for child := t.children; child != nil && !res.truncated; child = child.next {
+		if elements[0].matches(child.val) {
+			*word = append(*word, child.val)
+			child.patternSearch(elements[1:], word, res)
+			*word = (*word)[:len(*word)-1]
+		}
+	}
+}
+
+func parsePattern(pattern string) ([]patternElement, error) {
+	if !utf8.ValidString(pattern) {
+		return nil, fmt.Errorf("%w: invalid UTF-8", ErrBadPattern)
+	}
+	runes := []rune(pattern)
+	var elements []patternElement
+	for i := 0; i < len(runes); i++ {
+		switch runes[i] {
+		case '?':
+			elements = append(elements, patternElement{any: true})
+		case '\\':
+			if i++; i == len(runes) {
+				return nil, fmt.Errorf("%w: %q ends with a backslash", ErrBadPattern, pattern)
+			}
+			elements = append(elements, patternElement{char: runes[i]})
+		case '[':
+			e, next, err := parseClass(runes, i+1)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %q: %v", ErrBadPattern, pattern, err)
+			}
+			elements = append(elements, e)
+			i = next
+		default:
+			elements = append(elements, patternElement{char: runes[i]})
+		}
+	}
+	return elements, nil
+}
+
+// parseClass parses the class that starts at runes[i], just after the
+// "[", and returns it with the index of its "]".
+func parseClass(runes []rune, i int) (patternElement, int, error) {
+	e := patternElement{class: []runeRange{}}
+	if i < len(runes) && runes[i] == '^' {
+		e.negated = true
+		i++
+	}
+	// next returns the rune at runes[i], unescaped, and the index after it.
+	next := func(i int) (rune, int, error) {
+		if runes[i] != '\\' {
+			return runes[i], i + 1, nil
+		}
+		if i+1 == len(runes) {
+			return 0, 0, errors.New("unterminated class")
+		}
+		return runes[i+1], i + 2, nil
+	}
+	for i < len(runes) && runes[i] != ']' {
+		lo, j, err := next(i)
+		if err != nil {
+			return e, 0, err
+		}
+		hi := lo
+		if j+1 < len(runes) && runes[j] == '-' && runes[j+1] != ']' {
+			if hi, j, err = next(j + 1); err != nil {
+				return e, 0, err
+			}
+			if hi < lo {
+				return e, 0, fmt.Errorf("range %c-%c is backwards", lo, hi)
+			}
+		}
+		e.class = append(e.class, runeRange{lo, hi})
+		i = j
+	}
+	if i == len(runes) {
+		return e, 0, errors.New("unterminated class")
+	}
+	if len(e.class) == 0 {
+		return e, 0, errors.New("empty class")
+	}
+	return e, i, nil
+}
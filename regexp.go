@@ -0,0 +1,80 @@
+package wordgraph6
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+// DefaultRegexpLimit is the size ToRegexp stops at if it is given none.
+const DefaultRegexpLimit = 1 << 20
+
+// ErrRegexpTooLarge is returned by ToRegexp when the expression
+// would be longer than the limit.
+var ErrRegexpTooLarge = errors.New("wordgraph6: regular expression too large")
+
+// ToRegexp returns a regular expression, in the syntax of package
+// regexp, that matches exactly the words in the graph. Every child list
+// becomes a group of alternatives with the common prefix factored out,
+// and the expression of a list is built once however many nodes share
+// it, but it is written out in full wherever it is used: an expression
+// can be far longer than the graph, the more so the more the graph
+// shares. ToRegexp gives up with ErrRegexpTooLarge once the expression
+// would exceed limit bytes; 0 or less means DefaultRegexpLimit.
+func (t *treenode) ToRegexp(limit int) (string, error) {
+	if limit <= 0 {
+		limit = DefaultRegexpLimit
+	}
+	if t.children == nil {
+		if t.endofword {
+			return "^$", nil
+		}
+		return `^[^\x00-\x{10FFFF}]$`, nil // Matches nothing.
+	}
+	done := make(map[*treenode]string)
+	body, err := regexpOfList(t.children, limit, &done)
+	if err != nil {
+		return "", err
+	}
+	if t.endofword {
+		body = "(?:" + body + ")?"
+	}
+	if len(body)+2 > limit {
+		return "", ErrRegexpTooLarge
+	}
+	return "^" + body + "$", nil
+}
+
+// regexpOfList returns a group of alternatives, one for every node
+// of the list that starts with head.
+func regexpOfList(head *treenode, limit int, done *map[*treenode]string) (string, error) {
+	if expr, found := (*done)[head]; found {
+		return expr, nil
+	}
+	var alternatives []string
+	size := 0
+	for child := head; child != nil; child = child.next {
+		alternative := regexp.QuoteMeta(string(child.val))
+		if child.children != nil {
+			rest, err := regexpOfList(child.children, limit, done)
+			if err != nil {
+				return "", err
+			}
+			if child.endofword {
+				rest = "(?:" + rest + ")?"
+			}
+			alternative += rest
+		}
+		size += len(alternative) + 1
+		if size > limit {
+			return "", ErrRegexpTooLarge
+		}
+		alternatives = append(alternatives, alternative)
+	}
+	expr := alternatives[0]
+	if len(alternatives) > 1 {
+		expr = "(?:" + strings.Join(alternatives, "|") + ")"
+	}
+	(*done)[head] = expr
+	return expr, nil
+}
@@ -0,0 +1,73 @@
+package wordgraph6
+
+import "sort"
+
+// AdaptiveReorder gives every node an order in which lookups try its
+// children: the order of how often the queries step through them, the
+// most used first, so that Contains finds them after fewer comparisons
+// when the real queries are skewed like the sample. Children the
+// queries never reach keep their order after the others, and nodes
+// whose children the queries never reach, or that have a child map,
+// keep none. The child lists themselves stay sorted, so Words,
+// Completions and the other enumerations are not affected. The graph
+// must be frozen, so that no later change can leave the order behind.
+func (t *treenode) AdaptiveReorder(queries []string) error {
+	t.info().write.Lock()
+	defer t.info().write.Unlock()
+	if !t.info().frozen {
+		return ErrNotFrozen
+	}
+	hits := make(map[*treenode]int)
+	for _, query := range queries {
+		node := t
+		for _, char := range t.key(query) {
+			if node = node.child(char); node == nil {
+				break
+			}
+			hits[node]++
+		}
+	}
+	visited := make(map[*treenode]bool)
+	// Only the lookup order changes, so what is cached about the
+	// words and the shape of the graph still holds.
+	t.orderLookups(hits, &visited)
+	return nil
+}
+
+// orderLookups sets the lookup order of t and of every node below it.
+func (t *treenode) orderLookups(hits map[*treenode]int, visited *map[*treenode]bool) {
+	(*visited)[t] = true
+	t.lookup = nil
+	if t.index == nil && t.children != nil && t.children.next != nil {
+		var nodes []*treenode
+		var weights []int
+		used := false
+		for child := t.children; child != nil; child = child.next {
+			nodes = append(nodes, child)
+			weights = append(weights, hits[child])
+			used = used || hits[child] > 0
+		}
+		if used {
+			sort.Stable(byHits{nodes, weights})
+			t.lookup = nodes
+		}
+	}
+	for child := t.children; child != nil; child = child.next {
+		if _, found := (*visited)[child]; !found {
+			child.orderLookups(hits, visited)
+		}
+	}
+}
+
+type byHits struct {
+	nodes []*treenode
+	hits  []int
+}
+
+func (b byHits) Len() int           { return len(b.nodes) }
+func (b byHits) Less(i, j int) bool { return b.hits[i] > b.hits[j] }
+
+func (b byHits) Swap(i, j int) {
+	b.nodes[i], b.nodes[j] = b.nodes[j], b.nodes[i]
+	b.hits[i], b.hits[j] = b.hits[j], b.hits[i]
+}
@@ -0,0 +1,165 @@
+package wordgraph6
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// VerifyRoundtrip writes t in every format the package can read back,
+// reads each copy and checks that it holds the words of t, with their
+// payloads and frequencies where the format keeps them. It is meant for
+// tests, of this package and of code that relies on its formats. The
+// formats are the flat array in its fixed and compact encodings and the
+// sorted word list that BuildFlatSorted reads; the word list is skipped
+// if a word has a line break in it. The flat copies must also have the
+// Stats of the array that was written, which are those of t unless
+// lists of t share a tail that FlatArray writes out again, as after
+// Optimise or Delete. BuildFlatSorted minimises the
+// word list as it reads it, so only its word count is compared.
+func (t *treenode) VerifyRoundtrip() error {
+	o := t.FlatArray()
+	written, err := o.stats()
+	if err != nil {
+		return err
+	}
+	if words := t.Stats().Words; written.Words != words {
+		return fmt.Errorf("wordgraph6: the flat array holds %d words instead of %d", written.Words, words)
+	}
+	formats := []struct {
+		name     string
+		metadata bool // Payloads and frequencies are kept.
+		write    func(io.Writer) error
+		read     func(io.Reader) (outarray, error)
+	}{
+		{"flat", true, func(w io.Writer) error {
+			_, err := o.WriteTo(w)
+			return err
+		}, ReadFlat},
+		{"compact flat", true, func(w io.Writer) error {
+			_, err := o.WriteCompactTo(w)
+			return err
+		}, ReadFlat},
+		{"word list", false, t.writeWordList, BuildFlatSorted},
+	}
+	want := t.Words()
+	for _, format := range formats {
+		if format.name == "word list" && hasLineBreak(want) {
+			continue
+		}
+		var buf bytes.Buffer
+		if err := format.write(&buf); err != nil {
+			return fmt.Errorf("wordgraph6: writing %s: %w", format.name, err)
+		}
+		read, err := format.read(&buf)
+		if err != nil {
+			return fmt.Errorf("wordgraph6: reading %s: %w", format.name, err)
+		}
+		var got []string
+		err = read.eachWord(func(word []rune, node arraynode) error {
+			got = append(got, string(word))
+			if !format.metadata {
+				return nil
+			}
+			var payload []byte
+			freq := 0
+			if original := t.find(string(word)); original != nil {
+				payload, freq = original.payload, original.freq
+			}
+			if !bytes.Equal(payload, node.payload) || (payload == nil) != (node.payload == nil) {
+				return fmt.Errorf("wordgraph6: %s changes the payload of %q", format.name, string(word))
+			}
+			if freq != node.freq {
+				return fmt.Errorf("wordgraph6: %s changes the frequency of %q from %d to %d", format.name, string(word), freq, node.freq)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if format.name == "word list" {
+			want = append([]string{}, want...)
+			sort.Strings(want)
+		}
+		if len(got) != len(want) {
+			return fmt.Errorf("wordgraph6: %s holds %d words instead of %d", format.name, len(got), len(want))
+		}
+		for i := range got {
+			if got[i] != want[i] {
+				return fmt.Errorf("wordgraph6: %s has %q where %q was", format.name, got[i], want[i])
+			}
+		}
+		stats, err := read.stats()
+		if err != nil {
+			return fmt.Errorf("wordgraph6: reading %s: %w", format.name, err)
+		}
+		if format.name == "word list" {
+			stats.Nodes, stats.Edges = written.Nodes, written.Edges
+		}
+		if stats != written {
+			return fmt.Errorf("wordgraph6: %s has Stats %+v instead of %+v", format.name, stats, written)
+		}
+	}
+	return nil
+}
+
+// stats is Stats for the array, with every record reachable from the
+// root counted as a node once and every record in the list of a node
+// counted as an edge.
+func (o outarray) stats() (Stats, error) {
+	var stats Stats
+	if len(o) == 0 {
+		return stats, nil
+	}
+	err := o.eachWord(func(word []rune, node arraynode) error {
+		stats.Words++
+		return nil
+	})
+	if err != nil {
+		return stats, err
+	}
+	visited := make(map[rune]bool)
+	o.collectStats(0, &stats, &visited)
+	return stats, nil
+}
+
+func (o outarray) collectStats(i rune, stats *Stats, visited *map[rune]bool) {
+	(*visited)[i] = true
+	stats.Nodes++
+	if o[i].children == 0 {
+		return
+	}
+	for child := o[i].children; ; child++ {
+		stats.Edges++
+		if _, found := (*visited)[child]; !found {
+			o.collectStats(child, stats, visited)
+		}
+		if o[child].eol {
+			return
+		}
+	}
+}
+
+// writeWordList writes the words one per line in byte order.
+func (t *treenode) writeWordList(w io.Writer) error {
+	words := t.Words()
+	sort.Strings(words)
+	writer := bufio.NewWriter(w)
+	for _, word := range words {
+		writer.WriteString(word)
+		writer.WriteByte('\n')
+	}
+	return writer.Flush()
+}
+
+func hasLineBreak(words []string) bool {
+	for _, word := range words {
+		if strings.ContainsAny(word, "\r\n") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,125 @@
+package wordgraph6
+
+import (
+	"errors"
+	"sort"
+)
+
+// ErrNotFrozen is returned by NewSearcher for a graph that can
+// still change.
+var ErrNotFrozen = errors.New("wordgraph6: the graph is not frozen")
+
+// Searcher answers queries on a frozen graph, keeping the buffers
+// the walks need between calls so that they are only allocated once.
+// A Searcher must not be used by two goroutines at a time, but any
+// number of them can share a graph: keep one per goroutine, or a
+// sync.Pool of them for a server.
+type Searcher struct {
+	root  *treenode
+	query []rune
+	word  []rune
+	rows  [][]int // Rows of the edit matrix, one per level.
+}
+
+// NewSearcher returns a Searcher for t, which must have been
+// finalised, so that the graph cannot change under it.
+func (t *treenode) NewSearcher() (*Searcher, error) {
+	if !t.info().frozen {
+		return nil, ErrNotFrozen
+	}
+	return &Searcher{root: t}, nil
+}
+
+// Contains is the graph's Contains. It needs no scratch space and
+// is here so that a Searcher can stand in for the graph.
+func (s *Searcher) Contains(word string) bool {
+	return s.root.Contains(word)
+}
+
+// Completions is the graph's Completions with the path buffer reused.
+func (s *Searcher) Completions(prefix string) []string {
+	prefix = s.root.key(prefix)
+	node := s.root.find(prefix)
+	if node == nil {
+		return nil
+	}
+	var words []string
+	if node.endofword {
+		words = append(words, prefix)
+	}
+	s.word = append(s.word[:0], []rune(prefix)...)
+	for child := node.children; child != nil; child = child.next {
+		child.eachWord1(&s.word, func(word []rune) {
+			words = append(words, string(word))
+		})
+	}
+	return words
+}
+
+// FuzzySearch is the graph's FuzzySearch with the rows of the edit
+// matrix and the path buffer reused.
+func (s *Searcher) FuzzySearch(query string, maxDist int) []string {
+	s.query = append(s.query[:0], []rune(s.root.key(query))...)
+	row := s.row(0)
+	for i := range row {
+		row[i] = i
+	}
+	var result []string
+	if s.root.endofword && row[len(s.query)] <= maxDist {
+		result = append(result, "")
+	}
+	s.word = s.word[:0]
+	for child := s.root.children; child != nil; child = child.next {
+		s.fuzzyStep(child, 1, maxDist, &result)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// row returns the buffer for the row of the given level,
+// sized for the current query.
+func (s *Searcher) row(level int) []int {
+	for len(s.rows) <= level {
+		s.rows = append(s.rows, nil)
+	}
+	if cap(s.rows[level]) < len(s.query)+1 {
+		s.rows[level] = make([]int, len(s.query)+1)
+	}
+	s.rows[level] = s.rows[level][:len(s.query)+1]
+	return s.rows[level]
+}
+
+// fuzzyStep is treenode.fuzzyStep with the row of each level
+// taken from the Searcher.
+func (s *Searcher) fuzzyStep(t *treenode, level, maxDist int, result *[]string) {
+	row := s.row(level)
+	prev := s.rows[level-1]
+	row[0] = prev[0] + 1
+	best := row[0]
+	for i := 1; i < len(row); i++ {
+		cost := 1
+		if s.query[i-1] == t.val {
+			cost = 0
+		}
+		row[i] = prev[i-1] + cost
+		if row[i-1]+1 < row[i] {
+			row[i] = row[i-1] + 1
+		}
+		if prev[i]+1 < row[i] {
+			row[i] = prev[i] + 1
+		}
+		if row[i] < best {
+			best = row[i]
+		}
+	}
+	s.word = append(s.word, t.val)
+	if t.endofword && row[len(s.query)] <= maxDist {
+		*result = append(*result, string(s.word))
+	}
+	if best <= maxDist {
+		for child := t.children; child != nil; child = child.next {
+			s.fuzzyStep(child, level+1, maxDist, result)
+		}
+	}
+	s.word = s.word[:len(s.word)-1]
+}
@@ -0,0 +1,79 @@
+package wordgraph6
+
+// Shard splits the words into n graphs of about the same number of
+// words. The words of a shard all start with runes from one range of
+// the root's children, so a query can be sent to a single shard by its
+// first rune; the empty word, if present, goes to the first shard. A
+// rune is never split between shards, so with few first runes some
+// shards may be empty. Every shard is a new unminimised graph with its
+// own node ids and the collation, normaliser, alphabet and payload
+// policy of t; frequencies and payloads are kept.
+func (t *treenode) Shard(n int) ([]*treenode, error) {
+	if n < 1 {
+		n = 1
+	}
+	total := t.WordCount()
+	shards := make([]*treenode, n)
+	ids := make([]int, n)
+	for i := range shards {
+		shards[i] = NewDAWG()
+		if err := shards[i].SetCollation(t.info().collate); err != nil {
+			return nil, err
+		}
+	}
+	if t.endofword {
+		if err := shards[0].addShardWord(nil, t, &ids[0]); err != nil {
+			return nil, err
+		}
+	}
+	shard := 0
+	done := 0
+	var word []rune
+	for child := t.children; child != nil; child = child.next {
+		// Move on once this shard has its share, counting the words
+		// of the children before this one.
+		for shard < n-1 && done >= total*(shard+1)/n {
+			shard++
+		}
+		var err error
+		child.eachTerminal1(&word, func(word []rune, node *treenode) {
+			if err == nil {
+				err = shards[shard].addShardWord(word, node, &ids[shard])
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+		done += child.count
+	}
+	for _, s := range shards {
+		s.info().normalize = t.info().normalize
+		s.info().allowed = t.info().allowed
+		s.info().policy = t.info().policy
+	}
+	return shards, nil
+}
+
+// addShardWord puts word with the frequency and payload of node.
+func (t *treenode) addShardWord(word []rune, node *treenode, id *int) error {
+	added, _, err := t.add(string(word), node.freq, id)
+	if err != nil {
+		return err
+	}
+	if node.payload != nil {
+		added.payload = append([]byte{}, node.payload...)
+	}
+	return nil
+}
+
+// eachTerminal1 is eachWord1 with the node that ends every word.
+func (t *treenode) eachTerminal1(word *[]rune, fn func([]rune, *treenode)) {
+	*word = append(*word, t.val)
+	if t.endofword {
+		fn(*word, t)
+	}
+	for child := t.children; child != nil; child = child.next {
+		child.eachTerminal1(word, fn)
+	}
+	*word = (*word)[:len(*word)-1]
+}
@@ -0,0 +1,247 @@
+package wordgraph6
+
+import (
+	"sort"
+	"unicode"
+)
+
+// Stats summarises the shape of a graph.
+type Stats struct {
+	Words int // Number of stored words.
+	Nodes int // Number of distinct nodes, the root included.
+	Edges int // Number of parent-child links.
+}
+
+// Stats walks the graph once, visiting shared nodes only once. The
+// result is kept until the graph changes, so calling Stats again, e.g.
+// from a monitoring loop, costs nothing.
+func (t *treenode) Stats() Stats {
+	state := t.info()
+	state.lazy.Lock()
+	defer state.lazy.Unlock()
+	if state.stats != nil {
+		return *state.stats
+	}
+	var stats Stats
+	visited := make(map[*treenode]bool)
+	t.collectStats(&stats, &visited)
+	if !state.counted {
+		t.ComputeCounts()
+	}
+	stats.Words = t.count
+	state.stats = &stats
+	return stats
+}
+
+func (t *treenode) collectStats(stats *Stats, visited *map[*treenode]bool) {
+	(*visited)[t] = true
+	stats.Nodes++
+	for child := t.children; child != nil; child = child.next {
+		stats.Edges++
+		if _, found := (*visited)[child]; !found {
+			child.collectStats(stats, visited)
+		}
+	}
+}
+
+// RuneFrequencies counts how many distinct nodes carry each rune,
+// shared nodes once, for sizing a code for the labels. The root
+// carries no rune and is not counted.
+func (t *treenode) RuneFrequencies() map[rune]int {
+	counts := make(map[rune]int)
+	visited := make(map[*treenode]bool)
+	t.countRunes(&counts, &visited)
+	return counts
+}
+
+func (t *treenode) countRunes(counts *map[rune]int, visited *map[*treenode]bool) {
+	(*visited)[t] = true
+	for child := t.children; child != nil; child = child.next {
+		if _, found := (*visited)[child]; !found {
+			(*counts)[child.val]++
+			child.countRunes(counts, visited)
+		}
+	}
+}
+
+// DominantScript returns the name of the Unicode script, as in
+// unicode.Scripts, that most of the runes counted by RuneFrequencies
+// belong to, such as "Latin", "Cyrillic" or "Han". Runes that several
+// scripts share, like digits and punctuation, count only if no rune
+// belongs to a script of its own. Ties go to the name that sorts
+// first. An empty graph has no script and returns "".
+func (t *treenode) DominantScript() string {
+	names := make([]string, 0, len(unicode.Scripts))
+	for name := range unicode.Scripts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	totals := make(map[string]int)
+	for char, n := range t.RuneFrequencies() {
+		for _, name := range names {
+			if unicode.Is(unicode.Scripts[name], char) {
+				totals[name] += n
+				break
+			}
+		}
+	}
+	dominant := ""
+	for _, name := range names {
+		if name == "Common" || name == "Inherited" {
+			continue
+		}
+		if totals[name] > totals[dominant] {
+			dominant = name
+		}
+	}
+	if dominant != "" {
+		return dominant
+	}
+	if totals["Inherited"] > totals["Common"] {
+		return "Inherited"
+	}
+	if totals["Common"] > 0 {
+		return "Common"
+	}
+	return ""
+}
+
+// ReachableAt returns the number of distinct nodes at level k, the
+// root being the only node at level 0. Optimise only merges nodes of
+// the same level, so every node has one level and the counts for all
+// k add up to the number of nodes.
+func (t *treenode) ReachableAt(k int) int {
+	state := t.info()
+	state.lazy.Lock()
+	defer state.lazy.Unlock()
+	if !state.annotated {
+		t.ComputeAnnotations()
+	}
+	n := 0
+	visited := make(map[*treenode]bool)
+	t.countAtLevel(k, &n, &visited)
+	return n
+}
+
+func (t *treenode) countAtLevel(k int, n *int, visited *map[*treenode]bool) {
+	(*visited)[t] = true
+	if t.level == k {
+		*n++
+		return
+	}
+	for child := t.children; child != nil; child = child.next {
+		if _, found := (*visited)[child]; !found {
+			child.countAtLevel(k, n, visited)
+		}
+	}
+}
+
+// SharingStats measures, in runes, what storing the words as a graph
+// saves over storing them as a list.
+type SharingStats struct {
+	ListRunes   int // Runes of all the words, as a list stores them.
+	PrefixSaved int // Saved by a trie, which shares prefixes.
+	SuffixSaved int // Saved on top of that by sharing suffixes too.
+}
+
+// Sharing computes SharingStats in one walk that visits shared nodes
+// once. A trie would have a node, and a rune, for every distinct path
+// from the root; the graph has one for every distinct node. Only
+// Optimise shares suffixes, so SuffixSaved is 0 before it has run.
+func (t *treenode) Sharing() SharingStats {
+	below := make(map[*treenode]subtreeSize)
+	root := t.subtreeSize(&below)
+	return SharingStats{
+		ListRunes:   root.runes,
+		PrefixSaved: root.runes - root.paths,
+		SuffixSaved: root.paths - (len(below) - 1),
+	}
+}
+
+// subtreeSize counts what lies below a node, its own rune excluded.
+type subtreeSize struct {
+	words int // Words that end at or below the node.
+	runes int // Runes of those words below the node.
+	paths int // Distinct paths down from the node.
+}
+
+func (t *treenode) subtreeSize(below *map[*treenode]subtreeSize) subtreeSize {
+	if size, found := (*below)[t]; found {
+		return size
+	}
+	var size subtreeSize
+	if t.endofword {
+		size.words = 1
+	}
+	for child := t.children; child != nil; child = child.next {
+		c := child.subtreeSize(below)
+		size.words += c.words
+		size.runes += c.words + c.runes
+		size.paths += 1 + c.paths
+	}
+	(*below)[t] = size
+	return size
+}
+
+// LookupStats sums up what a sample of lookups cost.
+type LookupStats struct {
+	Queries        int
+	Comparisons    int // Siblings compared with a rune of the query.
+	MaxComparisons int // Comparisons of the most expensive query.
+	IndexLookups   int // Steps through wide nodes, taken by their child map.
+}
+
+// MeanComparisons returns the comparisons per query.
+func (s LookupStats) MeanComparisons() float64 {
+	if s.Queries == 0 {
+		return 0
+	}
+	return float64(s.Comparisons) / float64(s.Queries)
+}
+
+// ProfileLookups looks every query up as Contains does and counts the
+// sibling comparisons the child lists cost, in the order set by
+// AdaptiveReorder if it has run. Steps through nodes that have a child
+// map cost none and are counted apart.
+func (t *treenode) ProfileLookups(queries []string) LookupStats {
+	var stats LookupStats
+	for _, query := range queries {
+		comparisons := 0
+		node := t
+		for _, char := range t.key(query) {
+			if node.index != nil {
+				stats.IndexLookups++
+				node = node.index[char]
+			} else if node.lookup != nil {
+				var next *treenode
+				for _, child := range node.lookup {
+					comparisons++
+					if child.val == char {
+						next = child
+						break
+					}
+				}
+				node = next
+			} else {
+				child := node.children
+				for child != nil {
+					comparisons++
+					if child.val == char {
+						break
+					}
+					child = child.next
+				}
+				node = child
+			}
+			if node == nil {
+				break
+			}
+		}
+		stats.Queries++
+		stats.Comparisons += comparisons
+		if comparisons > stats.MaxComparisons {
+			stats.MaxComparisons = comparisons
+		}
+	}
+	return stats
+}
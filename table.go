@@ -0,0 +1,82 @@
+package wordgraph6
+
+import "sort"
+
+// TransitionTable is the graph as a deterministic finite automaton,
+// for tools that expect one. Every distinct node is a state; the
+// root is state 0.
+type TransitionTable struct {
+	States    int
+	Alphabet  []rune       // Every rune on some edge, sorted.
+	Columns   map[rune]int // Index of every rune in Alphabet.
+	Delta     []map[int]int
+	Accepting []bool
+}
+
+// TransitionTable numbers the states depth-first, shared nodes once.
+// Delta[s][c] is the state reached from s over Alphabet[c]; missing
+// entries mean there is no transition. It is best taken from a
+// minimised graph, where shared suffixes are single states.
+func (t *treenode) TransitionTable() *TransitionTable {
+	states := map[*treenode]int{t: 0}
+	order := []*treenode{t}
+	t.numberStates(&states, &order)
+	table := &TransitionTable{
+		States:    len(order),
+		Columns:   make(map[rune]int),
+		Delta:     make([]map[int]int, len(order)),
+		Accepting: make([]bool, len(order)),
+	}
+	for _, node := range order {
+		for child := node.children; child != nil; child = child.next {
+			if _, found := table.Columns[child.val]; !found {
+				table.Columns[child.val] = 0
+				table.Alphabet = append(table.Alphabet, child.val)
+			}
+		}
+	}
+	sort.Slice(table.Alphabet, func(i, j int) bool { return table.Alphabet[i] < table.Alphabet[j] })
+	for i, char := range table.Alphabet {
+		table.Columns[char] = i
+	}
+	for state, node := range order {
+		table.Accepting[state] = node.endofword
+		table.Delta[state] = make(map[int]int)
+		for child := node.children; child != nil; child = child.next {
+			table.Delta[state][table.Columns[child.val]] = states[child]
+		}
+	}
+	return table
+}
+
+func (t *treenode) numberStates(states *map[*treenode]int, order *[]*treenode) {
+	for child := t.children; child != nil; child = child.next {
+		if _, found := (*states)[child]; !found {
+			(*states)[child] = len(*order)
+			*order = append(*order, child)
+			child.numberStates(states, order)
+		}
+	}
+}
+
+// Next returns the state reached from state over char.
+func (tt *TransitionTable) Next(state int, char rune) (int, bool) {
+	column, found := tt.Columns[char]
+	if !found {
+		return 0, false
+	}
+	next, found := tt.Delta[state][column]
+	return next, found
+}
+
+// Accepts runs the automaton on word.
+func (tt *TransitionTable) Accepts(word string) bool {
+	state := 0
+	for _, char := range word {
+		var found bool
+		if state, found = tt.Next(state, char); !found {
+			return false
+		}
+	}
+	return tt.Accepting[state]
+}
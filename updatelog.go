@@ -0,0 +1,148 @@
+package wordgraph6
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"unicode/utf8"
+)
+
+// An update log records the changes made to a Dictionary since its
+// last snapshot, so that clients holding the snapshot can catch up
+// without downloading the whole dictionary again. It starts with
+// logMagic and a version byte; every entry is an operation byte, the
+// word as a uvarint length and UTF-8 bytes, and then a uvarint count
+// for additions or a length-prefixed payload for payloads.
+const (
+	logMagic   = "WGL\x00"
+	logVersion = 1
+)
+
+const (
+	opAdd = 1 + iota
+	opDelete
+	opPayload
+)
+
+type change struct {
+	op      byte
+	word    string
+	count   int
+	payload []byte
+}
+
+// WriteLog writes the changes made since the last snapshot to w.
+func (d *Dictionary) WriteLog(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString(logMagic)
+	bw.WriteByte(logVersion)
+	buf := make([]byte, binary.MaxVarintLen64)
+	writeBytes := func(b []byte) {
+		bw.Write(buf[:binary.PutUvarint(buf, uint64(len(b)))])
+		bw.Write(b)
+	}
+	for _, c := range d.changes {
+		bw.WriteByte(c.op)
+		writeBytes([]byte(c.word))
+		switch c.op {
+		case opAdd:
+			bw.Write(buf[:binary.PutUvarint(buf, uint64(c.count))])
+		case opPayload:
+			writeBytes(c.payload)
+		}
+	}
+	return bw.Flush()
+}
+
+// ClearLog makes the current state the snapshot that
+// the next WriteLog starts from.
+func (d *Dictionary) ClearLog() {
+	d.changes = nil
+}
+
+// ApplyLog reads a log written by WriteLog and replays it. The whole
+// log is read and validated before anything is changed. The replayed
+// changes become part of d's own log.
+func (d *Dictionary) ApplyLog(r io.Reader) error {
+	changes, err := readLog(bufio.NewReader(r))
+	if err != nil {
+		return err
+	}
+	for _, c := range changes {
+		switch c.op {
+		case opAdd:
+			err = d.AddWithCount(c.word, c.count)
+		case opDelete:
+			_, err = d.Delete(c.word)
+		case opPayload:
+			err = d.PutPayload(c.word, c.payload)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var errBadLog = errors.New("wordgraph6: not an update log")
+
+func readLog(br *bufio.Reader) ([]change, error) {
+	changes, err := readChanges(br)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF // The log ended inside an entry.
+	}
+	return changes, err
+}
+
+func readChanges(br *bufio.Reader) ([]change, error) {
+	header := make([]byte, len(logMagic)+1)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, errBadLog
+	}
+	if string(header[:len(logMagic)]) != logMagic {
+		return nil, errBadLog
+	}
+	if header[len(logMagic)] != logVersion {
+		return nil, fmt.Errorf("wordgraph6: unknown log version %d", header[len(logMagic)])
+	}
+	var changes []change
+	for {
+		op, err := br.ReadByte()
+		if err == io.EOF {
+			return changes, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if op < opAdd || op > opPayload {
+			return nil, fmt.Errorf("wordgraph6: unknown log operation %d", op)
+		}
+		word, err := readPayload(br)
+		if err != nil {
+			return nil, err
+		}
+		if !utf8.Valid(word) {
+			return nil, fmt.Errorf("wordgraph6: log word %q is not valid UTF-8", word)
+		}
+		c := change{op: op, word: string(word)}
+		switch op {
+		case opAdd:
+			count, err := binary.ReadUvarint(br)
+			if err != nil {
+				return nil, err
+			}
+			if count < 1 || count > math.MaxInt {
+				return nil, fmt.Errorf("wordgraph6: bad count %d in log", count)
+			}
+			c.count = int(count)
+		case opPayload:
+			if c.payload, err = readPayload(br); err != nil {
+				return nil, err
+			}
+		}
+		changes = append(changes, c)
+	}
+}
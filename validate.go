@@ -0,0 +1,43 @@
+package wordgraph6
+
+import "fmt"
+
+// Validate checks the invariants the rest of the package relies on:
+// no node has two children with the same rune, and children are
+// kept in collation order. Shared nodes are checked once.
+func (t *treenode) Validate() error {
+	visited := make(map[*treenode]bool)
+	return t.validate(t.info().collate, &visited)
+}
+
+func (t *treenode) validate(cmp func(a, b rune) int, visited *map[*treenode]bool) error {
+	(*visited)[t] = true
+	if err := t.checkSiblings(cmp); err != nil {
+		return err
+	}
+	for child := t.children; child != nil; child = child.next {
+		if _, found := (*visited)[child]; !found {
+			if err := child.validate(cmp, visited); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkSiblings checks the children of t alone.
+func (t *treenode) checkSiblings(cmp func(a, b rune) int) error {
+	seen := make(map[rune]bool)
+	var prev *treenode
+	for child := t.children; child != nil; child = child.next {
+		if seen[child.val] {
+			return fmt.Errorf("wordgraph6: node %d has two children labelled %q", t.id, child.val)
+		}
+		seen[child.val] = true
+		if prev != nil && !runeLess(prev.val, child.val, cmp) {
+			return fmt.Errorf("wordgraph6: children %q and %q of node %d are out of order", prev.val, child.val, t.id)
+		}
+		prev = child
+	}
+	return nil
+}
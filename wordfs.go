@@ -0,0 +1,180 @@
+package wordgraph6
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// FS returns the words of t as a read-only file system, for tools
+// that walk one with fs.WalkDir. Every rune that can follow a prefix
+// is an entry of the prefix's directory: a directory if words go on
+// past it, an empty file if only the word that ends there does. A word
+// that other words extend is an empty file named "$" in its directory,
+// the empty word one at the root. So that every rune makes a valid name
+// of its own, "%", ".", "/" and "$" are written as "%25", "%2E", "%2F"
+// and "%24". The graph must not change while the file system is used.
+func (t *treenode) FS() fs.ReadDirFS {
+	return wordFS{t}
+}
+
+type wordFS struct {
+	root *treenode
+}
+
+// wordMarker names the file of a word that other words extend.
+const wordMarker = "$"
+
+func escapeRune(char rune) string {
+	switch char {
+	case '%', '.', '/', '$':
+		return fmt.Sprintf("%%%02X", char)
+	}
+	return string(char)
+}
+
+func unescapeRune(name string) (rune, bool) {
+	switch name {
+	case "%25":
+		return '%', true
+	case "%2E":
+		return '.', true
+	case "%2F":
+		return '/', true
+	case "%24":
+		return '$', true
+	}
+	char, size := utf8.DecodeRuneInString(name)
+	if size != len(name) || size == 0 || strings.ContainsRune("%./$", char) {
+		return 0, false
+	}
+	return char, true
+}
+
+// resolve returns the node that name leads to and whether name is
+// a directory. A file is either a childless node or a word marker.
+func (f wordFS) resolve(op, name string) (*treenode, bool, error) {
+	if !fs.ValidPath(name) {
+		return nil, false, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	node := f.root
+	if name == "." {
+		return node, true, nil
+	}
+	elements := strings.Split(name, "/")
+	for i, element := range elements {
+		if element == wordMarker && i == len(elements)-1 && node.endofword {
+			return node, false, nil
+		}
+		char, ok := unescapeRune(element)
+		if ok {
+			node = node.child(char)
+		}
+		if !ok || node == nil || (i < len(elements)-1 && node.children == nil) {
+			return nil, false, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+	}
+	return node, node.children != nil, nil
+}
+
+func (f wordFS) Open(name string) (fs.File, error) {
+	node, dir, err := f.resolve("open", name)
+	if err != nil {
+		return nil, err
+	}
+	info := wordInfo{name: baseName(name), dir: dir}
+	if dir {
+		return &wordDir{info: info, entries: dirEntries(node)}, nil
+	}
+	return &wordFile{info: info}, nil
+}
+
+func (f wordFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	node, dir, err := f.resolve("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if !dir {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fmt.Errorf("not a directory")}
+	}
+	return dirEntries(node), nil
+}
+
+func baseName(name string) string {
+	if i := strings.LastIndexByte(name, '/'); i >= 0 {
+		return name[i+1:]
+	}
+	return name
+}
+
+// dirEntries lists the entries of the directory of node by name.
+func dirEntries(node *treenode) []fs.DirEntry {
+	var entries []fs.DirEntry
+	if node.endofword {
+		entries = append(entries, fs.FileInfoToDirEntry(wordInfo{name: wordMarker}))
+	}
+	for child := node.children; child != nil; child = child.next {
+		entries = append(entries, fs.FileInfoToDirEntry(wordInfo{name: escapeRune(child.val), dir: child.children != nil}))
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries
+}
+
+type wordInfo struct {
+	name string
+	dir  bool
+}
+
+func (i wordInfo) Name() string       { return i.name }
+func (i wordInfo) Size() int64        { return 0 }
+func (i wordInfo) ModTime() time.Time { return time.Time{} }
+func (i wordInfo) IsDir() bool        { return i.dir }
+func (i wordInfo) Sys() interface{}   { return nil }
+
+func (i wordInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0555
+	}
+	return 0444
+}
+
+type wordFile struct {
+	info wordInfo
+}
+
+func (f *wordFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *wordFile) Read([]byte) (int, error)   { return 0, io.EOF }
+func (f *wordFile) Close() error               { return nil }
+
+type wordDir struct {
+	info    wordInfo
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *wordDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *wordDir) Close() error               { return nil }
+
+func (d *wordDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: fmt.Errorf("is a directory")}
+}
+
+func (d *wordDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.entries[d.offset:]
+	if n <= 0 {
+		d.offset = len(d.entries)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(rest) {
+		n = len(rest)
+	}
+	d.offset += n
+	return rest[:n], nil
+}
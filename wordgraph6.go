@@ -5,9 +5,14 @@ import (
 	"bytes"
 	"crypto/sha1"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math"
 	"os"
+	"sort"
+	"sync"
 	"unicode/utf8"
 )
 
@@ -18,10 +23,107 @@ type treenode struct {
 	next       *treenode
 	parents    []*treenode
 	endofword  bool
-	hash       [20]byte
+	freq       int       // How many times the word ending here was put.
+	payload    []byte    // Set with PutPayload.
+	hash       *[20]byte // Only set while hashes are needed.
 	level      int
 	height     int
 	firstchild bool
+	count      int                // Number of words in the subtree.
+	index      map[rune]*treenode // Only set on wide nodes.
+	lookup     []*treenode        // Children in the order lookups try them; set by AdaptiveReorder.
+	state      *dawgstate         // Only set on the root.
+}
+
+// Nodes with more children than this also keep a map from rune to
+// child, so that lookups in wide nodes (e.g. the first level of a
+// CJK dictionary) don't have to walk a long list. The list stays
+// authoritative and is what every traversal uses; the map is only
+// an index over it. In BenchmarkChildLookup on amd64 map lookups
+// overtake the list at about 25 children, with the list laid out
+// contiguously as Put leaves it; a list scattered over the heap is
+// slower still.
+const childIndexThreshold = 24
+
+// indexChildren rebuilds the child map after the list has changed.
+func (t *treenode) indexChildren() {
+	t.index = nil
+	n := 0
+	for child := t.children; child != nil; child = child.next {
+		n++
+	}
+	if n > childIndexThreshold {
+		t.index = make(map[rune]*treenode, n)
+		for child := t.children; child != nil; child = child.next {
+			t.index[child.val] = child
+		}
+	}
+}
+
+// dawgstate holds the bookkeeping that only the root needs.
+type dawgstate struct {
+	frozen    bool
+	counted   bool
+	hashed    bool
+	annotated bool                // Levels and heights are up to date.
+	minimized bool                // Optimise has run and nothing changed since.
+	shared    bool                // Some nodes may have more than one parent.
+	collate   func(a, b rune) int // Order of children; nil for rune order.
+	allowed   func(rune) bool     // Runes that words may contain; nil for any.
+	normalize func(string) string // Applied to every word and query; nil for none.
+	policy    PayloadPolicy
+	merges    map[*treenode][]*treenode // Recorded by Optimise if ReportMerges is set.
+	sizeHint  int                       // Expected number of nodes; 0 if unknown.
+	stats     *Stats                    // Cached by Stats; nil once the graph changes.
+	classes   int                       // Cached by EstimateMinimizedNodes; 0 once the graph changes.
+	lazy      sync.Mutex                // Guards the lazy computations of queries.
+	write     sync.Mutex                // Serialises the methods that change the graph.
+}
+
+// ErrFrozen is returned by mutation methods after Finalize.
+var ErrFrozen = errors.New("wordgraph6: the graph is frozen")
+
+// ErrNotInAlphabet is returned when a word has a rune that
+// the predicate set with SetAlphabet rejects.
+var ErrNotInAlphabet = errors.New("wordgraph6: rune outside the alphabet")
+
+// ErrIDOverflow is returned when the id counter runs out of ids.
+var ErrIDOverflow = errors.New("wordgraph6: node ids exhausted")
+
+// DebugChecks makes Put and Optimise check that they never create
+// a cycle, and Put that it never leaves two siblings with the same
+// rune, and panic at the point where that would happen. The checks
+// walk the graph, so they are off by default.
+var DebugChecks = false
+
+// newNode is the only place where nodes get their ids.
+func newNode(val rune, id *int) (*treenode, error) {
+	if *id == math.MaxInt {
+		return nil, ErrIDOverflow
+	}
+	node := new(treenode)
+	node.id = *id
+	*id++
+	node.val = val
+	node.level = -1
+	return node, nil
+}
+
+// changed marks everything computed from the words as out of date.
+func (state *dawgstate) changed() {
+	state.counted = false
+	state.hashed = false
+	state.annotated = false
+	state.minimized = false
+	state.stats = nil
+	state.classes = 0
+}
+
+func (t *treenode) info() *dawgstate {
+	if t.state == nil {
+		t.state = new(dawgstate)
+	}
+	return t.state
 }
 
 func (t *treenode) String() string {
@@ -29,9 +131,12 @@ func (t *treenode) String() string {
 }
 
 type arraynode struct {
-	val      rune
-	children rune
-	eol      bool // End-of-list marker.
+	val       rune
+	children  rune
+	eol       bool // End-of-list marker.
+	endofword bool
+	payload   []byte
+	freq      int // Frequency of the word ending here.
 }
 
 func NewDAWG() *treenode {
@@ -39,6 +144,7 @@ func NewDAWG() *treenode {
 	root.id = -1
 	root.level = -1
 	root.val = '∅'
+	root.state = new(dawgstate)
 	return root
 }
 
@@ -68,95 +174,538 @@ func (fq *flatteningQueue) Pop() *treenode {
 	return returnVal
 }
 
-func (t *treenode) Put(s string, id *int) {
-	// TODO: add some sanity checks.
-	if t.id == 0 {
-		t.id = 0
-		*id++
+// Put adds s to the graph. Put and every other method that changes
+// the graph or its settings take turns, so that several goroutines can
+// build one graph without corrupting it (through one id counter, which
+// is only touched in turn as well). Queries must still not run while
+// the graph is being changed.
+func (t *treenode) Put(s string, id *int) error {
+	t.info().write.Lock()
+	defer t.info().write.Unlock()
+	_, _, err := t.add(s, 1, id)
+	return err
+}
+
+// AddWithCount puts s as if it had been put n times.
+func (t *treenode) AddWithCount(s string, n int, id *int) error {
+	if n < 1 {
+		return fmt.Errorf("wordgraph6: count %d is not positive", n)
 	}
-	fchar, size := utf8.DecodeRuneInString(s)
-	s = s[size:]
-	if t.children == nil {
-		child := new(treenode)
-		child.id = *id
-		*id++
-		child.val = fchar
-		child.level = -1
-		child.firstchild = true
-		child.parents = append(child.parents, t)
-		// Only first children are eligible for replacement
-		// so don't bother initialising for others.
-		child.put(s, id)
-		t.children = child
-	} else {
+	t.info().write.Lock()
+	defer t.info().write.Unlock()
+	_, _, err := t.add(s, n, id)
+	return err
+}
+
+// FromCounts builds a graph in which every word of counts has been put
+// as many times as counts says, as AddWithCount would, taking node ids
+// from id. The words are put in sorted order, so the same counts always
+// give the same ids. Words with different counts are not merged by
+// Optimise, as the frequency is part of what makes two nodes equal.
+func FromCounts(counts map[string]int, id *int) (*treenode, error) {
+	words := make([]string, 0, len(counts))
+	for word := range counts {
+		words = append(words, word)
+	}
+	sort.Strings(words)
+	t := NewDAWG()
+	for _, word := range words {
+		if err := t.AddWithCount(word, counts[word], id); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// PayloadPolicy says what PutPayload does when the word, or another
+// word with the same normalised form, already has a payload.
+type PayloadPolicy int
+
+const (
+	PayloadKeepLast  PayloadPolicy = iota // Replace the payload; the default.
+	PayloadKeepFirst                      // Keep the payload that is there.
+	PayloadError                          // Fail with ErrPayloadCollision.
+)
+
+// ErrPayloadCollision is returned by PutPayload under PayloadError.
+var ErrPayloadCollision = errors.New("wordgraph6: word already has a payload")
+
+// SetPayloadPolicy chooses how PutPayload resolves collisions.
+func (t *treenode) SetPayloadPolicy(policy PayloadPolicy) {
+	t.info().write.Lock()
+	defer t.info().write.Unlock()
+	t.info().policy = policy
+}
+
+// PutPayload puts word, like Put, and attaches a copy of data to it.
+// If the word already has a payload, the payload policy decides which
+// one is kept. Words with different payloads are not merged by Optimise.
+func (t *treenode) PutPayload(word string, data []byte, id *int) error {
+	t.info().write.Lock()
+	defer t.info().write.Unlock()
+	word = t.key(word)
+	policy := t.info().policy
+	if policy == PayloadError {
+		if node := t.find(word); node != nil && node.endofword && node.payload != nil {
+			return fmt.Errorf("%w: %q", ErrPayloadCollision, word)
+		}
+	}
+	node, _, err := t.add(word, 1, id)
+	if err != nil {
+		return err
+	}
+	if node.payload == nil || policy != PayloadKeepFirst {
+		node.payload = append([]byte{}, data...)
+	}
+	return nil
+}
+
+// GetPayload returns the payload attached to word, if any.
+func (t *treenode) GetPayload(word string) ([]byte, bool) {
+	node := t.find(t.key(word))
+	if node == nil || !node.endofword || node.payload == nil {
+		return nil, false
+	}
+	return node.payload, true
+}
+
+// Frequency returns how many times word has been put,
+// or 0 if it is not in the graph.
+func (t *treenode) Frequency(word string) int {
+	node := t.find(t.key(word))
+	if node == nil || !node.endofword {
+		return 0
+	}
+	return node.freq
+}
+
+// AddReportingDuplicates puts every word into the graph and returns
+// those that were already present, in the order they were met.
+func (t *treenode) AddReportingDuplicates(words []string, id *int) ([]string, error) {
+	t.info().write.Lock()
+	defer t.info().write.Unlock()
+	var dups []string
+	for _, word := range words {
+		_, added, err := t.add(word, 1, id)
+		if err != nil {
+			return dups, err
+		}
+		if !added {
+			dups = append(dups, word)
+		}
+	}
+	return dups, nil
+}
+
+// add adds n to the frequency of s and returns the node that s ends
+// at, reporting whether s was not in the graph before. It walks s in a loop, so that long keys are
+// inserted in linear time and without deep recursion. Once the graph
+// has been minimised the existing nodes on the path are copied before
+// they are changed, as in Delete.
+func (t *treenode) add(s string, n int, id *int) (*treenode, bool, error) {
+	if t.info().frozen {
+		return nil, false, ErrFrozen
+	}
+	s = t.key(s)
+	if err := t.checkAlphabet(s); err != nil {
+		return nil, false, err
+	}
+	shared := t.info().shared
+	t.info().changed()
+	cmp := t.info().collate
+	node := t
+	var path map[*treenode]bool
+	if DebugChecks {
+		path = map[*treenode]bool{t: true}
+	}
+	for len(s) > 0 {
+		fchar, size := nextRune(s)
+		s = s[size:]
 		var child *treenode
-		for child = t.children; child.next != nil; child = child.next {
-			if child.val == fchar {
-				child.put(s, id)
-				return
+		var err error
+		if shared && node.children != nil {
+			child, err = node.ownChild(fchar, id)
+		}
+		if child == nil && err == nil {
+			child, err = node.childFor(fchar, id, cmp)
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		if DebugChecks {
+			if path[child] {
+				panic(fmt.Sprintf("wordgraph6: node %d is its own ancestor", child.id))
+			}
+			path[child] = true
+			if err := node.checkSiblings(cmp); err != nil {
+				panic(err)
 			}
 		}
-		if child.val == fchar { // Check the last child.
-			child.put(s, id)
-			return
-		} else {
-			newchild := new(treenode)
-			newchild.id = *id
-			*id++
-			newchild.val = fchar
-			newchild.level = -1
-			newchild.put(s, id)
-			child.next = newchild
+		node = child
+	}
+	added := !node.endofword
+	node.endofword = true
+	node.freq += n
+	return node, added, nil
+}
+
+// checkAlphabet returns ErrNotInAlphabet if s, already normalised,
+// has a rune the alphabet set with SetAlphabet does not allow.
+func (t *treenode) checkAlphabet(s string) error {
+	if allowed := t.info().allowed; allowed != nil {
+		for _, char := range s {
+			if !allowed(char) {
+				return fmt.Errorf("%w: %q in %q", ErrNotInAlphabet, char, s)
+			}
 		}
 	}
+	return nil
 }
 
-func (t *treenode) put(s string, id *int) {
-	if len(s) == 0 {
-		return
+// childFor returns the child of t labelled with val, creating it
+// if needed. Children are kept sorted by rune, or by cmp if it is set.
+func (t *treenode) childFor(val rune, id *int, cmp func(a, b rune) int) (*treenode, error) {
+	if t.index != nil {
+		if child, found := t.index[val]; found {
+			return child, nil
+		}
 	}
-	fchar, size := utf8.DecodeRuneInString(s)
-	s = s[size:]
-	if t.children == nil {
-		child := new(treenode)
-		child.id = *id
-		*id++
-		child.val = fchar
-		child.level = -1
-		child.firstchild = true
-		child.parents = append(child.parents, t)
-		child.put(s, id)
-		t.children = child
+	var prev *treenode
+	child := t.children
+	for child != nil && runeLess(child.val, val, cmp) {
+		prev = child
+		child = child.next
+	}
+	if child != nil && child.val == val {
+		return child, nil
+	}
+	newchild, err := newNode(val, id)
+	if err != nil {
+		return nil, err
+	}
+	newchild.next = child
+	if prev == nil {
+		// Only first children are eligible for replacement
+		// so don't bother initialising parents for others.
+		newchild.firstchild = true
+		newchild.parents = append(newchild.parents, t)
+		if child != nil {
+			child.dropParent(t)
+		}
+		t.children = newchild
 	} else {
-		var child *treenode
-		for child = t.children; child.next != nil; child = child.next {
-			if child.val == fchar {
-				child.put(s, id)
-				return
-			}
+		prev.next = newchild
+	}
+	if t.index != nil {
+		t.index[val] = newchild
+	} else {
+		t.indexChildren()
+	}
+	return newchild, nil
+}
+
+func runeLess(a, b rune, cmp func(a, b rune) int) bool {
+	if cmp == nil {
+		return a < b
+	}
+	return cmp(a, b) < 0
+}
+
+// SetNormalizer makes every method that takes a word or a prefix,
+// for insertion, lookup or fuzzy search, apply normalize to it first,
+// e.g. to fold case or strip diacritics; so do Searchers, and Bloom
+// filters built afterwards. The exceptions are PatternSearch, whose
+// patterns are not words, and Node.Contains. normalize must be
+// idempotent. Words already in the graph are not normalised, and
+// results such as Words and Completions return the normalised forms.
+// nil turns it off.
+func (t *treenode) SetNormalizer(normalize func(string) string) {
+	t.info().write.Lock()
+	defer t.info().write.Unlock()
+	t.info().normalize = normalize
+}
+
+// key normalises s if a normaliser has been set.
+func (t *treenode) key(s string) string {
+	if t.state == nil || t.state.normalize == nil {
+		return s
+	}
+	return t.state.normalize(s)
+}
+
+// SetSizeHint tells Optimise how many nodes to expect, so that the
+// maps it fills as it walks the graph are allocated once at their full
+// size rather than grown as it goes. The node count before Optimise is
+// the best hint; the total length of the words is an upper bound for
+// it. A wrong hint costs memory or time but never changes the result.
+func (t *treenode) SetSizeHint(nodes int) {
+	if nodes < 0 {
+		nodes = 0
+	}
+	t.info().write.Lock()
+	defer t.info().write.Unlock()
+	t.info().sizeHint = nodes
+}
+
+// SetAlphabet makes Put and the other insertion methods reject words
+// with a rune for which allowed returns false, with ErrNotInAlphabet.
+// Words already in the graph are not checked. nil allows every rune.
+func (t *treenode) SetAlphabet(allowed func(rune) bool) {
+	t.info().write.Lock()
+	defer t.info().write.Unlock()
+	t.info().allowed = allowed
+}
+
+// SetCollation changes the order in which children are kept, and
+// with it the order of Words, Completions and every other enumeration.
+// cmp must return 0 only for equal runes; nil restores rune order.
+// The children of existing nodes are re-sorted, which would unpick
+// shared lists, so a minimised graph has to be de-minimised first.
+func (t *treenode) SetCollation(cmp func(a, b rune) int) error {
+	t.info().write.Lock()
+	defer t.info().write.Unlock()
+	if t.info().frozen {
+		return ErrFrozen
+	}
+	parentCounts := make(map[*treenode]int)
+	visited := make(map[*treenode]bool)
+	t.countParents(&parentCounts, &visited)
+	for _, n := range parentCounts {
+		if n > 1 {
+			return errors.New("wordgraph6: cannot re-sort a minimised graph, call DeMinimize first")
 		}
-		if child.val == fchar { // Check the last child.
-			child.put(s, id)
-			return
+	}
+	t.info().collate = cmp
+	t.info().hashed = false
+	t.sortChildren(cmp)
+	return nil
+}
+
+func (t *treenode) sortChildren(cmp func(a, b rune) int) {
+	if t.children == nil {
+		return
+	}
+	var children []*treenode
+	for child := t.children; child != nil; child = child.next {
+		children = append(children, child)
+	}
+	sort.SliceStable(children, func(i, j int) bool {
+		return runeLess(children[i].val, children[j].val, cmp)
+	})
+	if children[0] != t.children {
+		t.children.dropParent(t)
+		children[0].firstchild = true
+		children[0].parents = append(children[0].parents, t)
+	}
+	for i, child := range children {
+		if i+1 < len(children) {
+			child.next = children[i+1]
 		} else {
-			newchild := new(treenode)
-			newchild.id = *id
-			*id++
-			newchild.val = fchar
-			newchild.level = -1
-			newchild.put(s, id)
-			child.next = newchild
+			child.next = nil
+		}
+		child.sortChildren(cmp)
+	}
+	t.children = children[0]
+}
+
+// dropParent is called when t stops being the first child of parent.
+func (t *treenode) dropParent(parent *treenode) {
+	for i, p := range t.parents {
+		if p == parent {
+			t.parents = append(t.parents[:i], t.parents[i+1:]...)
+			break
+		}
+	}
+	if len(t.parents) == 0 {
+		t.firstchild = false
+	}
+}
+
+// Delete removes s from the graph and reports whether it was there.
+// The nodes on the path of s are copied before they are changed,
+// so words that share them through minimisation are not affected.
+// Branches that no longer lead to any word are cut off.
+func (t *treenode) Delete(s string, id *int) (bool, error) {
+	t.info().write.Lock()
+	defer t.info().write.Unlock()
+	return t.delete(s, id)
+}
+
+func (t *treenode) delete(s string, id *int) (bool, error) {
+	if t.info().frozen {
+		return false, ErrFrozen
+	}
+	s = t.key(s)
+	if !t.Contains(s) {
+		return false, nil
+	}
+	t.info().changed()
+	path := []*treenode{t}
+	node := t
+	for _, char := range s {
+		var err error
+		if node, err = node.ownChild(char, id); err != nil {
+			return false, err
+		}
+		path = append(path, node)
+	}
+	node.endofword = false
+	node.freq = 0
+	node.payload = nil
+	for i := len(path) - 1; i > 0; i-- {
+		if path[i].endofword || path[i].children != nil {
+			break
+		}
+		path[i-1].removeChild(path[i])
+	}
+	return true, nil
+}
+
+// ErrWordNotFound is returned by Replace when the word
+// to be replaced is not in the graph.
+var ErrWordNotFound = errors.New("wordgraph6: word not found")
+
+// Replace deletes from and puts to, as Delete and Put would, but checks
+// first that both can be done, so that on error the graph is left as it
+// was. to is put once; the frequency and payload of from are dropped.
+// Only the nodes on the two paths are copied, so words that share
+// suffixes with from in a minimised graph keep sharing them.
+func (t *treenode) Replace(from, to string, id *int) error {
+	t.info().write.Lock()
+	defer t.info().write.Unlock()
+	if t.info().frozen {
+		return ErrFrozen
+	}
+	if !t.Contains(from) {
+		return fmt.Errorf("%w: %q", ErrWordNotFound, t.key(from))
+	}
+	if err := t.checkAlphabet(t.key(to)); err != nil {
+		return err
+	}
+	if _, err := t.delete(from, id); err != nil {
+		return err
+	}
+	_, _, err := t.add(to, 1, id)
+	return err
+}
+
+// ownChild replaces the children of t up to and including the one
+// labelled with val by private copies and returns the copy of that
+// child. The rest of the list is left shared. If there is no such
+// child, the whole list is copied and nil is returned.
+func (t *treenode) ownChild(val rune, id *int) (*treenode, error) {
+	var head, tail, found *treenode
+	for child := t.children; child != nil && found == nil; child = child.next {
+		c, err := newNode(child.val, id)
+		if err != nil {
+			return nil, err
+		}
+		c.endofword = child.endofword
+		c.freq = child.freq
+		c.payload = child.payload
+		c.hash = child.hash
+		c.level = child.level
+		c.height = child.height
+		c.count = child.count
+		c.children = child.children
+		c.index = child.index
+		if c.children != nil {
+			c.children.parents = append(c.children.parents, c)
+		}
+		if tail == nil {
+			head = c
+		} else {
+			tail.next = c
+		}
+		tail = c
+		if child.val == val {
+			c.next = child.next
+			found = c
+		}
+	}
+	t.children.dropParent(t)
+	head.firstchild = true
+	head.parents = []*treenode{t}
+	t.children = head
+	t.indexChildren()
+	return found, nil
+}
+
+func (t *treenode) removeChild(child *treenode) {
+	defer t.indexChildren()
+	if t.children == child {
+		t.children = child.next
+		if t.children != nil {
+			t.children.firstchild = true
+			t.children.parents = append(t.children.parents, t)
+		}
+		return
+	}
+	for prev := t.children; prev != nil; prev = prev.next {
+		if prev.next == child {
+			prev.next = child.next
+			return
 		}
 	}
 }
 
 func (t *treenode) Optimise() {
-	fmt.Println("Computing levels")
-	t.computeLevels(0)
-	fmt.Println("Computing heights")
-	t.computeHeights()
-	fmt.Println("Computing hashes")
-	t.computeHashes()
+	t.info().write.Lock()
+	defer t.info().write.Unlock()
+	t.minimise()
+}
+
+// minimise is Optimise for callers that hold the write lock.
+func (t *treenode) minimise() {
+	t.optimise(func(height int, merges map[*treenode][]*treenode) {
+		nodesOfHeightX := make(map[*treenode]bool) // We use map to add all nodes only once.
+		nodesOfTheSameHeight := make([]*treenode, 0, t.info().sizeHint/(t.height+1))
+		t.collectNodesOfHeightX(&nodesOfTheSameHeight, &nodesOfHeightX, height)
+		processLevel(nodesOfTheSameHeight, merges)
+	})
+}
+
+// OptimiseLowMemory minimises the graph like Optimise, to the same
+// number of nodes, but does not gather every node of a height before
+// merging them. Each height is walked twice instead: once to note the first
+// node of every equivalence class that heads no child list, and once
+// to merge the heads into those nodes, or into the first head of their
+// class, as they are met. Only one node per class is kept, so memory
+// grows with the number of distinct subtrees rather than with the width
+// of the widest height; the price is the second walk. Merging by map
+// lookup also avoids comparing every head with every candidate, which
+// makes up for much of that price on large graphs.
+func (t *treenode) OptimiseLowMemory() {
+	t.info().write.Lock()
+	defer t.info().write.Unlock()
+	t.optimise(func(height int, merges map[*treenode][]*treenode) {
+		representatives := make(map[NodeKey]*treenode, t.info().sizeHint/(t.height+1))
+		visited := make(map[*treenode]bool)
+		t.registerOthers(height, &representatives, &visited)
+		visited = make(map[*treenode]bool)
+		t.mergeFirsts(height, &representatives, &visited, merges)
+	})
+}
+
+func (t *treenode) optimise(mergeHeight func(height int, merges map[*treenode][]*treenode)) {
+	if t.info().frozen {
+		return // Already minimised.
+	}
+	t.info().merges = nil
+	if ReportMerges {
+		t.info().merges = make(map[*treenode][]*treenode)
+	}
+	if t.WordCount() <= 1 {
+		// An empty graph, or a single chain of nodes: there is
+		// nothing to merge.
+		t.info().minimized = true
+		t.info().shared = true
+		return
+	}
+	progress("Computing levels and heights")
+	t.ComputeAnnotations()
+	progress("Computing hashes")
+	t.ComputeHashes()
 	// heightlevels := make(map[int][]*treenode)
 	// t.populateHeightLevels(&heightlevels)
 	// var levels []int
@@ -169,43 +718,164 @@ func (t *treenode) Optimise() {
 	// 	processLevel(heightlevels[i])
 	// }
 
-	maxHeight := t.height // root node is the highest
-	for j := maxHeight - 1; j >= 0; j-- {
-		nodesOfHeightX := make(map[*treenode]bool) // We use map to add all nodes only once.
-		t.collectNodesOfHeightX(&nodesOfHeightX, j)
-		var nodesOfTheSameHeight []*treenode
-		for key := range nodesOfHeightX {
-			nodesOfTheSameHeight = append(nodesOfTheSameHeight, key)
+	// If no two nodes are equal, no merge is possible
+	// and the walks over every height can be skipped.
+	classes := make(map[NodeKey]bool, t.info().sizeHint)
+	visited := make(map[*treenode]bool, t.info().sizeHint)
+	t.collectClasses(&classes, &visited)
+	if len(classes) == len(visited) {
+		t.info().stats = nil
+		t.info().minimized = true
+		t.info().shared = true
+		return
+	}
+	// A graph changed after minimisation shares tails between lists,
+	// so a node can head one list and follow in another and survive
+	// a pass that redirects its parents. Repeat the passes on such a
+	// graph until no more nodes disappear.
+	mixed := t.info().shared && !t.info().minimized
+	for {
+		maxHeight := t.height // root node is the highest
+		for j := maxHeight - 1; j >= 0; j-- {
+			progress("Processing nodes of height", j)
+			mergeHeight(j, t.info().merges)
+		}
+		if !mixed {
+			break
+		}
+		before := len(visited)
+		classes = make(map[NodeKey]bool, len(classes))
+		visited = make(map[*treenode]bool, before)
+		t.collectClasses(&classes, &visited)
+		if len(visited) == before || len(classes) == len(visited) {
+			break
+		}
+	}
+	t.info().stats = nil
+	t.info().minimized = true
+	t.info().shared = true
+}
+
+// EstimateMinimizedNodes predicts the size of the graph after Optimise
+// without changing it: it counts the distinct classes of nodes that
+// Optimise considers equal, the root included. Optimise only merges
+// whole child lists, so a node that is equal to another but heads no
+// list keeps its place and the estimate is a lower bound.
+func (t *treenode) EstimateMinimizedNodes() int {
+	state := t.info()
+	state.lazy.Lock()
+	defer state.lazy.Unlock()
+	if !state.annotated {
+		t.ComputeAnnotations()
+	}
+	if state.classes > 0 {
+		return state.classes
+	}
+	if !state.hashed {
+		t.ComputeHashes()
+	}
+	classes := make(map[NodeKey]bool)
+	visited := make(map[*treenode]bool)
+	t.collectClasses(&classes, &visited)
+	state.classes = len(classes)
+	return state.classes
+}
+
+func (t *treenode) collectClasses(classes *map[NodeKey]bool, visited *map[*treenode]bool) {
+	(*visited)[t] = true
+	(*classes)[equivalenceKey(t)] = true
+	for child := t.children; child != nil; child = child.next {
+		if _, found := (*visited)[child]; !found {
+			child.collectClasses(classes, visited)
 		}
-		fmt.Println("Processing nodes of height", j)
-		processLevel(nodesOfTheSameHeight)
 	}
 }
 
-func (t *treenode) collectNodesOfHeightX(n *map[*treenode]bool, height int) {
+// Progress, if set, receives a line from Optimise for every stage it
+// starts, which helps to follow it on large graphs. It is nil, and
+// Optimise silent, by default.
+var Progress io.Writer
+
+func progress(args ...interface{}) {
+	if Progress != nil {
+		fmt.Fprintln(Progress, args...)
+	}
+}
+
+// ReportMerges makes Optimise record which nodes it merged,
+// for MergeReport. It is meant for debugging and teaching.
+var ReportMerges = false
+
+// MergeReport returns, for the last Optimise run with ReportMerges
+// set, the id of every node that others were merged into and the ids
+// of those others, in the order they were merged. It returns nil if
+// no merges were recorded.
+func (t *treenode) MergeReport() map[int][]int {
+	if t.info().merges == nil {
+		return nil
+	}
+	report := make(map[int][]int, len(t.info().merges))
+	for representative, merged := range t.info().merges {
+		for _, node := range merged {
+			report[representative.id] = append(report[representative.id], node.id)
+		}
+	}
+	return report
+}
+
+// IsMinimized reports whether the graph has been minimised by
+// Optimise and not changed since.
+func (t *treenode) IsMinimized() bool {
+	return t.info().minimized
+}
+
+// collectNodesOfHeightX appends the nodes in the order in which
+// a depth-first walk meets them, so that the merges Optimise makes,
+// and with them the minimised graph, do not depend on map order.
+func (t *treenode) collectNodesOfHeightX(nodes *[]*treenode, visited *map[*treenode]bool, height int) {
+	(*visited)[t] = true
 	if t.height == height {
-		(*n)[t] = true
+		*nodes = append(*nodes, t)
 	} else if t.height > height {
 		for child := t.children; child != nil; child = child.next {
-			child.collectNodesOfHeightX(n, height)
+			if _, found := (*visited)[child]; !found {
+				child.collectNodesOfHeightX(nodes, visited, height)
+			}
 		}
 	}
 }
 
-func (t *treenode) computeLevels(level int) {
+// ComputeAnnotations sets the level (distance from the root)
+// and the height (longest path down to a leaf) of every node.
+// Shared nodes are only visited once.
+func (t *treenode) ComputeAnnotations() {
+	levelsDone := make(map[*treenode]bool, t.info().sizeHint)
+	t.computeLevels(0, &levelsDone)
+	heightsDone := make(map[*treenode]bool, t.info().sizeHint)
+	t.computeHeights(&heightsDone)
+	t.info().annotated = true
+}
+
+func (t *treenode) computeLevels(level int, visited *map[*treenode]bool) {
 	t.level = level
+	(*visited)[t] = true
 	if t.children != nil {
 		for child := t.children; child != nil; child = child.next {
-			child.computeLevels(level + 1)
+			if _, found := (*visited)[child]; !found {
+				child.computeLevels(level+1, visited)
+			}
 		}
 	}
 }
 
-func processLevel(level []*treenode) {
+// processLevel merges nodes of the same height. Only nodes that head
+// the child list of some parent can be replaced; any node can be the
+// replacement. Merges are recorded in merges unless it is nil.
+func processLevel(level []*treenode, merges map[*treenode][]*treenode) {
 	var firsts []*treenode
 	var others []*treenode
 	for _, el := range level {
-		if el.firstchild {
+		if len(el.parents) > 0 {
 			firsts = append(firsts, el)
 		} else {
 			others = append(others, el)
@@ -214,8 +884,11 @@ func processLevel(level []*treenode) {
 	for _, first := range firsts {
 		spent := false
 		for _, le := range others {
-			if first.val == le.val && first.hash == le.hash && first.level == le.level {
+			if equivalenceKey(first) == equivalenceKey(le) {
 				first.redirect(le)
+				if merges != nil {
+					merges[le] = append(merges[le], first)
+				}
 				spent = true
 				break
 			}
@@ -226,14 +899,449 @@ func processLevel(level []*treenode) {
 	}
 }
 
+// NodeKey is what Optimise compares to decide that two nodes can be
+// merged. The hash covers the terminal flag, the frequency and the
+// payload, and everything below and after the node in its list.
+type NodeKey struct {
+	Val   rune
+	Hash  [20]byte
+	Level int
+}
+
+// EquivalenceKey returns the key of node, a node of the graph rooted
+// at t. Nodes with equal keys are interchangeable as far as Optimise is
+// concerned. The levels and the hashes are computed first if the graph
+// has changed since they were last set or the hashes were dropped.
+func (t *treenode) EquivalenceKey(node *treenode) NodeKey {
+	state := t.info()
+	state.lazy.Lock()
+	defer state.lazy.Unlock()
+	if !state.annotated {
+		t.ComputeAnnotations()
+	}
+	if !state.hashed {
+		t.ComputeHashes()
+	}
+	if node.hash == nil {
+		// Not reachable from t: only its own subtree counts.
+		visited := make(map[*treenode]bool)
+		node.computeHashes(&visited)
+	}
+	return equivalenceKey(node)
+}
+
+// equivalenceKey is EquivalenceKey for callers that have brought the
+// levels and the hashes up to date.
+func equivalenceKey(node *treenode) NodeKey {
+	return NodeKey{node.val, *node.hash, node.level}
+}
+
+// registerOthers records, for every class of nodes of the given
+// height, the first node in walk order that heads no child list.
+func (t *treenode) registerOthers(height int, representatives *map[NodeKey]*treenode, visited *map[*treenode]bool) {
+	(*visited)[t] = true
+	if t.height == height {
+		if len(t.parents) == 0 {
+			if _, found := (*representatives)[equivalenceKey(t)]; !found {
+				(*representatives)[equivalenceKey(t)] = t
+			}
+		}
+	} else if t.height > height {
+		for child := t.children; child != nil; child = child.next {
+			if _, found := (*visited)[child]; !found {
+				child.registerOthers(height, representatives, visited)
+			}
+		}
+	}
+}
+
+// mergeFirsts redirects every list head of the given height to the
+// representative of its class, or makes it the representative if its
+// class has none yet, as processLevel does. A head with several parents
+// can be met in a different order than collectNodesOfHeightX meets it,
+// so merges may be reported in a different order too.
+func (t *treenode) mergeFirsts(height int, representatives *map[NodeKey]*treenode, visited *map[*treenode]bool, merges map[*treenode][]*treenode) {
+	(*visited)[t] = true
+	if t.height == height {
+		if len(t.parents) > 0 {
+			key := equivalenceKey(t)
+			// A registered node can gain parents from the heads
+			// redirected to it before the walk reaches it.
+			if other, found := (*representatives)[key]; found && other != t {
+				t.redirect(other)
+				if merges != nil {
+					merges[other] = append(merges[other], t)
+				}
+			} else {
+				(*representatives)[key] = t
+			}
+		}
+	} else if t.height > height {
+		for child := t.children; child != nil; child = child.next {
+			if _, found := (*visited)[child]; !found {
+				child.mergeFirsts(height, representatives, visited, merges)
+			}
+		}
+	}
+}
+
 func (t *treenode) redirect(other *treenode) {
 	if t.parents == nil {
 		panic("This node should have at least one parent")
 	}
+	if DebugChecks {
+		for _, parent := range t.parents {
+			visited := make(map[*treenode]bool)
+			if other.reaches(parent, &visited) {
+				panic(fmt.Sprintf("wordgraph6: redirecting %d to %d makes a cycle through %d", t.id, other.id, parent.id))
+			}
+		}
+	}
 	for _, parent := range t.parents {
 		parent.children = other
+		parent.indexChildren()
 		other.parents = append(other.parents, parent)
 	}
+	other.firstchild = true
+	t.parents = nil
+	t.firstchild = false
+}
+
+// reaches reports whether target can be reached from t,
+// t itself included. Subtrees in visited are known not to.
+func (t *treenode) reaches(target *treenode, visited *map[*treenode]bool) bool {
+	if t == target {
+		return true
+	}
+	if _, found := (*visited)[t]; found {
+		return false
+	}
+	for child := t.children; child != nil; child = child.next {
+		if child.reaches(target, visited) {
+			return true
+		}
+	}
+	(*visited)[t] = true
+	return false
+}
+
+// Finalize is the canonical "done building" call. It minimises
+// the graph, computes the subtree counts, drops the parent links
+// and hashes that only minimisation needs and freezes the graph:
+// after it all further mutations fail with ErrFrozen.
+func (t *treenode) Finalize() {
+	t.info().write.Lock()
+	defer t.info().write.Unlock()
+	if t.info().frozen {
+		return
+	}
+	t.minimise()
+	t.ComputeCounts()
+	visited := make(map[*treenode]bool)
+	t.dropParents(&visited)
+	t.DropHashes()
+	t.info().frozen = true
+}
+
+// Frozen reports whether Finalize has been called.
+func (t *treenode) Frozen() bool {
+	return t.info().frozen
+}
+
+// Clear empties the graph so that the root can be used for a new one:
+// the root is left as NewDAWG returns it, which also drops the
+// collation, alphabet, normaliser, payload policy and size hint, and
+// the id counter goes back to 0. The old nodes are no longer reachable
+// from the root and are garbage-collected unless the caller still
+// holds some of them, e.g. through a Searcher, which will go on
+// seeing the old words.
+func (t *treenode) Clear(id *int) {
+	state := t.info()
+	state.write.Lock()
+	defer state.write.Unlock()
+	state.lazy.Lock()
+	defer state.lazy.Unlock()
+	t.children = nil
+	t.parents = nil
+	t.endofword = false
+	t.freq = 0
+	t.payload = nil
+	t.hash = nil
+	t.level = -1
+	t.height = 0
+	t.count = 0
+	t.index = nil
+	t.lookup = nil
+	state.frozen = false
+	state.changed()
+	state.shared = false
+	state.collate = nil
+	state.allowed = nil
+	state.normalize = nil
+	state.policy = PayloadKeepLast
+	state.merges = nil
+	state.sizeHint = 0
+	*id = 0
+}
+
+func (t *treenode) dropParents(visited *map[*treenode]bool) {
+	for child := t.children; child != nil; child = child.next {
+		if _, found := (*visited)[child]; !found {
+			(*visited)[child] = true
+			child.parents = nil
+			child.dropParents(visited)
+		}
+	}
+}
+
+// ComputeCounts stores in every node the number of words
+// in its subtree. A word that other words extend is counted at
+// its own node, where endofword is set, whether or not the node
+// has children, and not again by the words below it.
+func (t *treenode) ComputeCounts() {
+	visited := make(map[*treenode]bool)
+	t.computeCounts(&visited)
+	t.info().counted = true
+}
+
+func (t *treenode) computeCounts(visited *map[*treenode]bool) int {
+	if _, found := (*visited)[t]; found {
+		return t.count
+	}
+	(*visited)[t] = true
+	t.count = 0
+	if t.endofword {
+		t.count = 1
+	}
+	for child := t.children; child != nil; child = child.next {
+		t.count += child.computeCounts(visited)
+	}
+	return t.count
+}
+
+// WordCount returns the number of words in the graph. The counts
+// are computed on first use, safely even if several goroutines
+// query an unchanging graph at once.
+func (t *treenode) WordCount() int {
+	state := t.info()
+	state.lazy.Lock()
+	defer state.lazy.Unlock()
+	if !state.counted {
+		t.ComputeCounts()
+	}
+	return t.count
+}
+
+// Contains reports whether s was put into the graph.
+// It does not allocate, so it is safe to call at a high rate.
+func (t *treenode) Contains(s string) bool {
+	node := t.find(t.key(s))
+	return node != nil && node.endofword
+}
+
+// find returns the node reached by spelling s from t, or nil.
+// Runes are decoded in place, the same way Put decodes them.
+func (t *treenode) find(s string) *treenode {
+	node := t
+	for len(s) > 0 {
+		fchar, size := nextRune(s)
+		s = s[size:]
+		if node = node.child(fchar); node == nil {
+			return nil
+		}
+	}
+	return node
+}
+
+// nextRune decodes the first rune of s like utf8.DecodeRuneInString,
+// taking ASCII bytes as they are without the call. Most words in most
+// dictionaries are ASCII, so Put and Contains decode with it.
+func nextRune(s string) (rune, int) {
+	if s[0] < utf8.RuneSelf {
+		return rune(s[0]), 1
+	}
+	return utf8.DecodeRuneInString(s)
+}
+
+func (t *treenode) child(val rune) *treenode {
+	if t.index != nil {
+		return t.index[val]
+	}
+	if t.lookup != nil {
+		for _, child := range t.lookup {
+			if child.val == val {
+				return child
+			}
+		}
+		return nil
+	}
+	for child := t.children; child != nil; child = child.next {
+		if child.val == val {
+			return child
+		}
+	}
+	return nil
+}
+
+// DeMinimize undoes the suffix sharing introduced by Optimise.
+// Every node reached through more than one parent is cloned
+// so that the graph becomes a plain trie again.
+func (t *treenode) DeMinimize(id *int) error {
+	t.info().write.Lock()
+	defer t.info().write.Unlock()
+	return t.deMinimizeAll(id)
+}
+
+// deMinimizeAll is DeMinimize for callers that hold the write lock.
+func (t *treenode) deMinimizeAll(id *int) error {
+	if t.info().frozen {
+		return ErrFrozen
+	}
+	t.info().changed()
+	visited := make(map[*treenode]bool)
+	if err := t.deMinimize(&visited, id); err != nil {
+		return err
+	}
+	t.info().shared = false
+	return nil
+}
+
+func (t *treenode) deMinimize(visited *map[*treenode]bool, id *int) error {
+	if t.children == nil {
+		return nil
+	}
+	var prev *treenode
+	for child := t.children; child != nil; child = child.next {
+		if _, found := (*visited)[child]; found {
+			// The rest of the list is shared with another parent.
+			c, err := child.clone(id)
+			if err != nil {
+				return err
+			}
+			if prev == nil {
+				t.children = c
+			} else {
+				prev.next = c
+			}
+			child = c
+		}
+		if prev == nil {
+			child.firstchild = true
+			child.parents = []*treenode{t}
+		} else {
+			child.firstchild = false
+			child.parents = nil
+		}
+		(*visited)[child] = true
+		if err := child.deMinimize(visited, id); err != nil {
+			return err
+		}
+		prev = child
+	}
+	t.indexChildren()
+	return nil
+}
+
+// clone makes a deep copy of the node, its younger siblings
+// and all their descendants.
+func (t *treenode) clone(id *int) (*treenode, error) {
+	c, err := newNode(t.val, id)
+	if err != nil {
+		return nil, err
+	}
+	c.endofword = t.endofword
+	c.freq = t.freq
+	c.payload = t.payload
+	c.hash = t.hash
+	c.level = t.level
+	c.height = t.height
+	c.count = t.count
+	if t.children != nil {
+		if c.children, err = t.children.clone(id); err != nil {
+			return nil, err
+		}
+		c.children.firstchild = true
+		c.children.parents = append(c.children.parents, c)
+		c.indexChildren()
+	}
+	if t.next != nil {
+		if c.next, err = t.next.clone(id); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// RenumberIDs gives every distinct node a fresh id in depth-first
+// order, the root keeping -1 as in NewDAWG. Shared nodes are numbered
+// once. It returns the next free id, to be passed on to Put.
+func (t *treenode) RenumberIDs() int {
+	t.info().write.Lock()
+	defer t.info().write.Unlock()
+	return t.renumber()
+}
+
+// renumber is RenumberIDs for callers that hold the write lock.
+func (t *treenode) renumber() int {
+	id := 0
+	visited := make(map[*treenode]bool)
+	t.id = -1
+	visited[t] = true
+	t.renumberIDs(&id, &visited)
+	return id
+}
+
+// Canonicalize makes a build reproducible. It minimises the graph if
+// needed and renumbers the nodes, after which the ids, the DOT output
+// and the flattened array depend only on the words and the collation,
+// not on the order in which the words were put. A graph changed since
+// it was minimised is made a trie again first, as the lists it shares
+// depend on the order of the changes. It returns the next free id.
+func (t *treenode) Canonicalize() int {
+	t.info().write.Lock()
+	defer t.info().write.Unlock()
+	if !t.IsMinimized() {
+		// The copies get their ids from renumber below. A graph
+		// that is not minimised is not frozen, so this cannot fail.
+		id := 0
+		t.deMinimizeAll(&id)
+		t.minimise()
+	}
+	return t.renumber()
+}
+
+func (t *treenode) renumberIDs(id *int, visited *map[*treenode]bool) {
+	for child := t.children; child != nil; child = child.next {
+		if _, found := (*visited)[child]; !found {
+			(*visited)[child] = true
+			child.id = *id
+			*id++
+			child.renumberIDs(id, visited)
+		}
+	}
+}
+
+// EdgesBFS calls fn for every edge in breadth-first order: level by
+// level and, within a node, in child order. Nodes are numbered in the
+// order in which they are first met, the root being 0, so a shared
+// node keeps the number from its shallowest parent. final tells
+// whether a word ends at the target.
+func (t *treenode) EdgesBFS(fn func(from, to int, label rune, final bool)) {
+	ids := map[*treenode]int{t: 0}
+	queue := []*treenode{t}
+	for len(queue) > 0 {
+		node := queue[0]
+		queue = queue[1:]
+		for child := node.children; child != nil; child = child.next {
+			id, found := ids[child]
+			if !found {
+				id = len(ids)
+				ids[child] = id
+				queue = append(queue, child)
+			}
+			fn(ids[node], id, child.val, child.endofword)
+		}
+	}
 }
 
 func (t *treenode) populateHeightLevels(hl *map[int][]*treenode) {
@@ -245,26 +1353,89 @@ func (t *treenode) populateHeightLevels(hl *map[int][]*treenode) {
 	}
 }
 
-func (t *treenode) computeHashes() []byte {
-	var data []byte
-	if t.next != nil {
-		data = append(data, (t.next.computeHashes())...)
+// ComputeHashes sets the hash of every node.
+func (t *treenode) ComputeHashes() {
+	visited := make(map[*treenode]bool, t.info().sizeHint)
+	t.computeHashes(&visited)
+	t.info().hashed = true
+}
+
+// DropHashes releases the hash of every node. Queries do not need
+// them once the graph is minimised; Fingerprint recomputes them.
+func (t *treenode) DropHashes() {
+	visited := make(map[*treenode]bool)
+	t.dropHashes(&visited)
+	t.info().hashed = false
+}
+
+func (t *treenode) dropHashes(visited *map[*treenode]bool) {
+	(*visited)[t] = true
+	t.hash = nil
+	for child := t.children; child != nil; child = child.next {
+		if _, found := (*visited)[child]; !found {
+			child.dropHashes(visited)
+		}
 	}
-	if t.children != nil {
-		data = append(data, (t.children.computeHashes())...)
+}
+
+// Fingerprint returns a digest of the words in the graph. It does not
+// depend on whether the graph has been minimised, but it does depend on
+// the order of the children. The hashes are computed first if the graph
+// has changed since they were last set, so the result is never based
+// on stale or zero hashes.
+func (t *treenode) Fingerprint() [20]byte {
+	state := t.info()
+	state.lazy.Lock()
+	defer state.lazy.Unlock()
+	if !state.hashed {
+		t.ComputeHashes()
+	}
+	return *t.hash
+}
+
+// The hash covers the node's rune, its terminal flag, its children
+// and its younger siblings, so that only lists accepting the same
+// suffixes get merged.
+func (t *treenode) computeHashes(visited *map[*treenode]bool) [20]byte {
+	if _, found := (*visited)[t]; found {
+		return *t.hash
+	}
+	(*visited)[t] = true
+	data := []byte(string(t.val))
+	if t.endofword {
+		// Words put a different number of times or with different
+		// payloads must not be merged.
+		data = append(data, 1)
+		data = binary.AppendUvarint(data, uint64(t.freq))
+		data = binary.AppendUvarint(data, uint64(len(t.payload)))
+		data = append(data, t.payload...)
+	} else {
+		data = append(data, 0)
+	}
+	for _, other := range []*treenode{t.children, t.next} {
+		if other == nil {
+			data = append(data, 0)
+		} else {
+			hash := other.computeHashes(visited)
+			data = append(data, 1)
+			data = append(data, hash[:]...)
+		}
 	}
-	data = append(data, []byte(string(t.val))...)
-	t.hash = sha1.Sum(data)
-	return data
+	hash := sha1.Sum(data)
+	t.hash = &hash
+	return hash
 }
 
-func (t *treenode) computeHeights() {
+func (t *treenode) computeHeights(visited *map[*treenode]bool) {
+	(*visited)[t] = true
 	if t.children == nil {
 		t.height = 0
 	} else {
 		var childrenHeights []int
 		for child := t.children; child != nil; child = child.next {
-			child.computeHeights()
+			if _, found := (*visited)[child]; !found {
+				child.computeHeights(visited)
+			}
 			childrenHeights = append(childrenHeights, child.height)
 		}
 		t.height = 1 + max(childrenHeights)
@@ -282,7 +1453,7 @@ func max(arr []int) int {
 }
 
 func (a arraynode) String() string {
-	return fmt.Sprintf("{%s, %d, %t}", string(a.val), a.children, a.eol)
+	return fmt.Sprintf("{%s, %d, %t, %t}", string(a.val), a.children, a.eol, a.endofword)
 }
 
 type outarray []arraynode
@@ -299,56 +1470,116 @@ func (o outarray) String() string {
 	return buffer.String()
 }
 
+// VerifyFlatten makes Flatten check the array against the tree
+// before writing it out. It is meant for debugging.
+var VerifyFlatten = false
+
+// FlattenLayout is the layout Flatten writes.
+var FlattenLayout = BreadthFirst
+
 func (t *treenode) Flatten() {
-	var output outarray
-	unfilledParents := make(map[*treenode]int)
-	allocatedNodes := make(map[*treenode]bool)
-	currentLen := len(output)
-	for i := 0; ; i++ {
-		t.addNodesOfLevelX(&output, i, &unfilledParents, &allocatedNodes)
-		if len(output) == currentLen {
-			break
-		} else {
-			currentLen = len(output)
+	output := t.FlatArrayLayout(FlattenLayout)
+	if err := output.checkLayout(); err != nil {
+		log.Fatal(err)
+	}
+	if VerifyFlatten {
+		if err := t.VerifyFlattening(output); err != nil {
+			log.Fatal(err)
 		}
 	}
 	output.createDot()
 	output.writeToFile()
 }
 
+// FlatLayout is the order in which FlatArrayLayout places child lists.
+type FlatLayout int
+
+const (
+	// BreadthFirst places the lists level by level.
+	BreadthFirst FlatLayout = iota
+	// DepthFirst places the lists in preorder, so that the list of a
+	// node's first child follows the node's own list and the path of a
+	// word tends to stay within a small stretch of the array.
+	DepthFirst
+)
+
+// FlatArray lays the graph out as an outarray with the root at
+// index 0. Child lists are placed breadth-first, each as a contiguous
+// run of records whose last one has eol set. A list that is the tail
+// of a list already placed points into that run. Where two lists share
+// a tail, as after Delete, the tail is written out again for the second.
+// The layout depends only on the shape of the graph, not on node ids.
+func (t *treenode) FlatArray() outarray {
+	return t.FlatArrayLayout(BreadthFirst)
+}
+
+// FlatArrayLayout is FlatArray with the lists placed in the given order.
+// Both layouts hold the same words and are read the same way.
+func (t *treenode) FlatArrayLayout(layout FlatLayout) outarray {
+	f := &flattener{
+		output: outarray{{val: t.val, eol: true, endofword: t.endofword, payload: t.payload, freq: t.freq}},
+		nodes:  []*treenode{t},
+		placed: make(map[*treenode]rune),
+	}
+	if layout == DepthFirst {
+		f.placeDepthFirst(t)
+	} else {
+		queue := []*treenode{t}
+		for len(queue) > 0 {
+			node := queue[0]
+			queue = queue[1:]
+			queue = append(queue, f.place(node)...)
+		}
+	}
+	for i, node := range f.nodes {
+		if node.children != nil {
+			f.output[i].children = f.placed[node.children]
+		}
+	}
+	return f.output
+}
+
+type flattener struct {
+	output outarray
+	nodes  []*treenode        // The node of every record.
+	placed map[*treenode]rune // The first record of every node.
+}
+
+// place writes out the child list of node unless it has been placed
+// already and returns the children that got their first record.
+func (f *flattener) place(node *treenode) []*treenode {
+	if node.children == nil {
+		return nil
+	}
+	if _, found := f.placed[node.children]; found {
+		return nil
+	}
+	var fresh []*treenode
+	for child := node.children; child != nil; child = child.next {
+		if _, found := f.placed[child]; !found {
+			f.placed[child] = rune(len(f.output))
+			fresh = append(fresh, child)
+		}
+		f.output = append(f.output, arraynode{val: child.val, eol: child.next == nil, endofword: child.endofword, payload: child.payload, freq: child.freq})
+		f.nodes = append(f.nodes, child)
+	}
+	return fresh
+}
+
+func (f *flattener) placeDepthFirst(node *treenode) {
+	for _, child := range f.place(node) {
+		f.placeDepthFirst(child)
+	}
+}
+
 func (o outarray) writeToFile() {
 	outfile, err := os.Create("dawg_big.wg")
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer outfile.Close()
-	for _, el := range o {
-		binary.Write(outfile, binary.LittleEndian, el.val)
-		binary.Write(outfile, binary.LittleEndian, el.children)
-		binary.Write(outfile, binary.LittleEndian, el.eol)
-	}
-}
-
-func (t *treenode) addNodesOfLevelX(array *outarray, level int, up *map[*treenode]int, an *map[*treenode]bool) {
-	if t.level == level {
-		if _, found := (*an)[t]; !found {
-			*array = append(*array, arraynode{val: t.val, eol: t.next == nil})
-			(*up)[t] = len(*array) - 1
-			(*an)[t] = true
-			if t.parents != nil {
-				for _, parent := range t.parents {
-					if _, found := (*an)[parent]; found {
-						(*array)[(*up)[parent]].children = rune(len(*array) - 1)
-					}
-				}
-			}
-		}
-	} else {
-		if t.children != nil && t.children.firstchild {
-			for child := t.children; child != nil; child = child.next {
-				child.addNodesOfLevelX(array, level, up, an)
-			}
-		}
+	if _, err := o.WriteTo(outfile); err != nil {
+		log.Fatal(err)
 	}
 }
 
@@ -377,21 +1608,67 @@ func (t *treenode) populateQueue(fq *flatteningQueue, nodes *map[*treenode]bool)
 	}
 }
 
-func (t *treenode) CreateDot(filename string) {
-	nodesMap := make(map[int]string)
-	t.populateNodes(&nodesMap)
-	edgesMap := make(map[int][]int)
-	edgesInMap := make(map[string]bool)
-	t.populateEdges(&edgesMap, &edgesInMap)
+// CreateDot writes the graph to filename in the dot format, one
+// column per level with nodes shaded by height. The file is synced
+// before CreateDot returns; if anything fails it is removed, so that
+// no truncated drawing is left behind.
+func (t *treenode) CreateDot(filename string) error {
+	return createDotFile(filename, t.WriteDot)
+}
+
+// createDotFile creates filename and fills it with write, syncing it
+// and removing it again if anything fails.
+func createDotFile(filename string, write func(io.Writer) error) error {
 	outfile, err := os.Create(filename)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	defer outfile.Close()
-	writer := bufio.NewWriter(outfile)
+	err = write(outfile)
+	if err == nil {
+		err = outfile.Sync()
+	}
+	if closeErr := outfile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(filename)
+	}
+	return err
+}
+
+// WriteDot writes what CreateDot puts in its file to w.
+func (t *treenode) WriteDot(w io.Writer) error {
+	state := t.info()
+	state.lazy.Lock()
+	if !state.annotated {
+		t.ComputeAnnotations()
+	}
+	state.lazy.Unlock()
+	nodesMap := make(map[int]string)
+	nodesDone := make(map[*treenode]bool)
+	t.populateNodes(&nodesMap, &nodesDone)
+	ranksMap := make(map[int][]int)
+	heightsMap := make(map[int]int)
+	ranked := make(map[*treenode]bool)
+	t.populateRanks(&ranksMap, &heightsMap, &ranked)
+	edgesMap := make(map[int][]int)
+	edgesInMap := make(map[string]bool)
+	edgesDone := make(map[*treenode]bool)
+	t.populateEdges(&edgesMap, &edgesInMap, &edgesDone)
+	// A bufio.Writer keeps the first error and fails every later
+	// write, so checking Flush at the end catches them all.
+	writer := bufio.NewWriter(w)
 	writer.WriteString("digraph Tree {\n\trankdir=LR\n")
 	for key, value := range nodesMap {
-		writer.WriteString(fmt.Sprintf("\t%d [label=\"%s\"];\n", key, value))
+		writer.WriteString(fmt.Sprintf("\t%d [label=\"%s\", style=filled, fillcolor=\"%s\"];\n",
+			key, value, heightColour(heightsMap[key])))
+	}
+	for _, ids := range ranksMap {
+		writer.WriteString("\t{rank=same;")
+		for _, id := range ids {
+			writer.WriteString(fmt.Sprintf(" %d;", id))
+		}
+		writer.WriteString("}\n")
 	}
 	for key, value := range edgesMap {
 		for i, el := range value {
@@ -403,51 +1680,157 @@ func (t *treenode) CreateDot(filename string) {
 		}
 	}
 	writer.WriteString("}\n")
-	writer.Flush()
+	return writer.Flush()
+}
+
+// CreateDotLimited is like CreateDot but keeps at most maxNodes nodes,
+// taken breadth-first from the root. When nodes had to be left out,
+// the edges leading to them point to a single "truncated" marker.
+// Like CreateDot it leaves no file behind if it fails.
+func (t *treenode) CreateDotLimited(filename string, maxNodes int) error {
+	return createDotFile(filename, func(w io.Writer) error {
+		return t.WriteDotLimited(w, maxNodes)
+	})
 }
 
-func (t *treenode) populateNodes(nm *map[int]string) {
+// WriteDotLimited writes what CreateDotLimited puts in its file to w.
+func (t *treenode) WriteDotLimited(w io.Writer, maxNodes int) error {
+	var order []*treenode
+	included := make(map[*treenode]bool)
+	truncated := false
+	queue := []*treenode{t}
+	for len(queue) > 0 {
+		node := queue[0]
+		queue = queue[1:]
+		if _, found := included[node]; found {
+			continue
+		}
+		if len(order) == maxNodes {
+			truncated = true
+			break
+		}
+		included[node] = true
+		order = append(order, node)
+		for child := node.children; child != nil; child = child.next {
+			queue = append(queue, child)
+		}
+	}
+	writer := bufio.NewWriter(w)
+	writer.WriteString("digraph Tree {\n\trankdir=LR\n")
+	for _, node := range order {
+		writer.WriteString(fmt.Sprintf("\t%d [label=\"%s\"];\n", node.id, string(node.val)))
+	}
+	if truncated {
+		writer.WriteString(fmt.Sprintf("\ttruncated [label=\"truncated at %d nodes\", shape=box];\n", maxNodes))
+	}
+	for _, node := range order {
+		cut := false
+		for child := node.children; child != nil; child = child.next {
+			if _, found := included[child]; !found {
+				cut = true
+			} else if child == node.children {
+				writer.WriteString(fmt.Sprintf("%d -> %d;\n", node.id, child.id))
+			} else {
+				writer.WriteString(fmt.Sprintf("%d -> %d [style = \"dotted\"];\n", node.id, child.id))
+			}
+		}
+		if cut {
+			writer.WriteString(fmt.Sprintf("%d -> truncated [style = \"dashed\"];\n", node.id))
+		}
+	}
+	writer.WriteString("}\n")
+	return writer.Flush()
+}
+
+// CreateDotEdgeLabelled draws the graph as a finite-state machine:
+// nodes are unlabelled circles (double for accepting ones) and every
+// edge carries the rune of the node it leads to. Like CreateDot it
+// leaves no file behind if it fails.
+func (t *treenode) CreateDotEdgeLabelled(filename string) error {
+	return createDotFile(filename, t.WriteDotEdgeLabelled)
+}
+
+// WriteDotEdgeLabelled writes what CreateDotEdgeLabelled puts in its
+// file to w.
+func (t *treenode) WriteDotEdgeLabelled(w io.Writer) error {
+	writer := bufio.NewWriter(w)
+	writer.WriteString("digraph Automaton {\n\trankdir=LR\n")
+	visited := make(map[*treenode]bool)
+	t.writeLabelledEdges(writer, &visited)
+	writer.WriteString("}\n")
+	return writer.Flush()
+}
+
+func (t *treenode) writeLabelledEdges(writer *bufio.Writer, visited *map[*treenode]bool) {
+	(*visited)[t] = true
+	shape := "circle"
+	if t.endofword {
+		shape = "doublecircle"
+	}
+	writer.WriteString(fmt.Sprintf("\t%d [label=\"\", shape=%s];\n", t.id, shape))
+	for child := t.children; child != nil; child = child.next {
+		writer.WriteString(fmt.Sprintf("%d -> %d [label=\"%s\"];\n", t.id, child.id, string(child.val)))
+		if _, found := (*visited)[child]; !found {
+			child.writeLabelledEdges(writer, visited)
+		}
+	}
+}
+
+// populateRanks groups node ids by level, so that nodes at the same
+// distance from the root are drawn in one column, and records heights.
+func (t *treenode) populateRanks(rm *map[int][]int, hm *map[int]int, visited *map[*treenode]bool) {
+	(*visited)[t] = true
+	(*rm)[t.level] = append((*rm)[t.level], t.id)
+	(*hm)[t.id] = t.height
+	for child := t.children; child != nil; child = child.next {
+		if _, found := (*visited)[child]; !found {
+			child.populateRanks(rm, hm, visited)
+		}
+	}
+}
+
+// Leaves are the palest, and the higher a node the darker it is.
+func heightColour(height int) string {
+	if height > 8 {
+		height = 8
+	}
+	return fmt.Sprintf("/blues9/%d", height+1)
+}
+
+// populateNodes and populateEdges visit every distinct node once,
+// even when minimisation has given it several parents.
+func (t *treenode) populateNodes(nm *map[int]string, visited *map[*treenode]bool) {
+	(*visited)[t] = true
 	(*nm)[t.id] = fmt.Sprintf("%s", string(t.val))
 	if t.children != nil {
 		for child := t.children; child != nil; child = child.next {
-			child.populateNodes(nm)
+			if _, found := (*visited)[child]; !found {
+				child.populateNodes(nm, visited)
+			}
 		}
 	}
 }
 
-func (t *treenode) populateEdges(nm *map[int][]int, eim *map[string]bool) {
+func (t *treenode) populateEdges(nm *map[int][]int, eim *map[string]bool, visited *map[*treenode]bool) {
+	(*visited)[t] = true
 	if t.children != nil {
 		for child := t.children; child != nil; child = child.next {
 			edge := fmt.Sprintf("%d->%d", t.id, child.id)
-			// if _, found := (*eim)[edge]; !found {
-			(*nm)[t.id] = append((*nm)[t.id], child.id)
-			(*eim)[edge] = true
-			child.populateEdges(nm, eim)
-			// }
+			if _, found := (*eim)[edge]; !found {
+				(*nm)[t.id] = append((*nm)[t.id], child.id)
+				(*eim)[edge] = true
+			}
+			if _, found := (*visited)[child]; !found {
+				child.populateEdges(nm, eim, visited)
+			}
 		}
 	}
 }
 
+// createDot draws the array: an edge goes from every record to each
+// record of the run its children index points to. Flatten checks the
+// layout first, so every run ends with an eol record.
 func (o outarray) createDot() {
-	// fmt.Println(len(o))
-	nodes := make(map[int]string)
-	for i := range o {
-		nodes[i] = string(o[i].val)
-	}
-	edges := make(map[int][]rune)
-	for i := range o {
-		j := o[i].children
-		// edges[i] = append(edges[i], j)
-
-		// fmt.Println(j)
-		if j != 0 {
-			for !o[j].eol {
-				edges[i] = append(edges[i], j)
-				j++
-			}
-			edges[i] = append(edges[i], j)
-		}
-	}
 	filename := "array6.dot"
 	outfile, err := os.Create(filename)
 	if err != nil {
@@ -456,13 +1839,17 @@ func (o outarray) createDot() {
 	defer outfile.Close()
 	writer := bufio.NewWriter(outfile)
 	writer.WriteString("digraph Array {\n\trankdir=LR\n")
-	for key, value := range nodes {
-		writer.WriteString(fmt.Sprintf("\t%d [label=\"%s\"];\n", key, value))
+	for i, el := range o {
+		writer.WriteString(fmt.Sprintf("\t%d [label=\"%s\"];\n", i, string(el.val)))
 	}
-	for out, in := range edges {
-		for _, el := range in {
-			if el != 0 {
-				writer.WriteString(fmt.Sprintf("%d -> %d;\n", out, el))
+	for i, el := range o {
+		if el.children == 0 {
+			continue
+		}
+		for j := int(el.children); j < len(o); j++ {
+			writer.WriteString(fmt.Sprintf("%d -> %d;\n", i, j))
+			if o[j].eol {
+				break
 			}
 		}
 	}
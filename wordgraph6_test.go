@@ -0,0 +1,4615 @@
+package wordgraph6
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"unicode/utf8"
+)
+
+// build puts words into a new graph.
+func build(t testing.TB, words ...string) *treenode {
+	t.Helper()
+	root := NewDAWG()
+	id := 0
+	for _, word := range words {
+		if err := root.Put(word, &id); err != nil {
+			t.Fatalf("Put(%q): %v", word, err)
+		}
+	}
+	return root
+}
+
+// randomWords returns n words of up to maxLen runes drawn from alphabet,
+// with repeats.
+func randomWords(n, maxLen int, alphabet string, seed int64) []string {
+	rng := rand.New(rand.NewSource(seed))
+	runes := []rune(alphabet)
+	words := make([]string, n)
+	for i := range words {
+		word := make([]rune, 1+rng.Intn(maxLen))
+		for j := range word {
+			word[j] = runes[rng.Intn(len(runes))]
+		}
+		words[i] = string(word)
+	}
+	return words
+}
+
+var sampleWords = []string{
+	"car", "card", "cards", "care", "cared", "cares", "cart", "carts",
+	"star", "stars", "start", "tar", "tars", "tart", "xyz",
+}
+
+func TestPageAfterDeMinimize(t *testing.T) {
+	root := build(t, sampleWords...)
+	root.Optimise()
+	root.WordCount()
+	id := 1000
+	if err := root.DeMinimize(&id); err != nil {
+		t.Fatal(err)
+	}
+	words := root.Words()
+	for i, want := range words {
+		if got := root.Page(i, 1); !reflect.DeepEqual(got, []string{want}) {
+			t.Errorf("Page(%d, 1) = %q, want [%q]", i, got, want)
+		}
+	}
+	if got := root.Page(0, len(words)); !reflect.DeepEqual(got, words) {
+		t.Errorf("Page(0, %d) = %q, want %q", len(words), got, words)
+	}
+}
+
+func TestAdaptiveReorderKeepsListsSorted(t *testing.T) {
+	words := randomWords(2000, 6, "abcdefgh", 1)
+	root := build(t, words...)
+	want := root.Words()
+	root.Finalize()
+	stats := root.Stats()
+	// Skewed queries: words made of the last letters of the alphabet.
+	queries := randomWords(500, 6, "fgh", 2)
+	before := root.ProfileLookups(queries)
+	if err := root.AdaptiveReorder(queries); err != nil {
+		t.Fatal(err)
+	}
+	after := root.ProfileLookups(queries)
+	if after.Comparisons >= before.Comparisons {
+		t.Errorf("comparisons went from %d to %d", before.Comparisons, after.Comparisons)
+	}
+	if err := root.Validate(); err != nil {
+		t.Errorf("Validate after AdaptiveReorder: %v", err)
+	}
+	if got := root.Words(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Words changed after AdaptiveReorder")
+	}
+	for _, word := range append(words, queries...) {
+		if root.Contains(word) != containsString(want, word) {
+			t.Errorf("Contains(%q) changed after AdaptiveReorder", word)
+		}
+	}
+	if got := root.Stats(); got != stats {
+		t.Errorf("Stats after AdaptiveReorder = %+v, want %+v", got, stats)
+	}
+	if longest, _ := root.LongestWord(); longest != longestWord(want) {
+		t.Errorf("LongestWord = %q, want %q", longest, longestWord(want))
+	}
+	if !root.IsMinimized() || !root.info().counted {
+		t.Errorf("AdaptiveReorder dropped what Finalize computed")
+	}
+	if err := build(t, "a").AdaptiveReorder(nil); err != ErrNotFrozen {
+		t.Errorf("AdaptiveReorder on an unfrozen graph: %v, want ErrNotFrozen", err)
+	}
+}
+
+func containsString(words []string, s string) bool {
+	for _, word := range words {
+		if word == s {
+			return true
+		}
+	}
+	return false
+}
+
+// longestWord returns the first of the longest words, in the order given.
+func longestWord(words []string) string {
+	longest := ""
+	for _, word := range words {
+		if len([]rune(word)) > len([]rune(longest)) {
+			longest = word
+		}
+	}
+	return longest
+}
+
+func TestCachesDroppedByRewiring(t *testing.T) {
+	root := build(t, sampleWords...)
+	unminimised := root.Stats()
+	root.Optimise()
+	if got := root.Stats(); got.Nodes >= unminimised.Nodes {
+		t.Fatalf("Stats after Optimise = %+v, want fewer nodes than %+v", got, unminimised)
+	}
+	estimate := root.EstimateMinimizedNodes()
+	root.WordCount()
+	id := 1000
+	if err := root.DeMinimize(&id); err != nil {
+		t.Fatal(err)
+	}
+	if got := root.Stats(); got != unminimised {
+		t.Errorf("Stats after DeMinimize = %+v, want %+v", got, unminimised)
+	}
+	if got := root.EstimateMinimizedNodes(); got != estimate {
+		t.Errorf("EstimateMinimizedNodes after DeMinimize = %d, want %d", got, estimate)
+	}
+	if root.IsMinimized() {
+		t.Errorf("IsMinimized after DeMinimize")
+	}
+}
+
+func TestNormalizerAppliesToSearches(t *testing.T) {
+	root := NewDAWG()
+	root.SetNormalizer(strings.ToLower)
+	id := 0
+	for _, word := range sampleWords {
+		if err := root.Put(strings.ToUpper(word), &id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lower := build(t, sampleWords...)
+	for _, query := range []string{"CART", "Stra", "TAX", "xY", "carz"} {
+		folded := strings.ToLower(query)
+		if got, want := root.FuzzySearch(query, 1), lower.FuzzySearch(folded, 1); !reflect.DeepEqual(got, want) {
+			t.Errorf("FuzzySearch(%q, 1) = %q, want %q", query, got, want)
+		}
+		if got, want := root.FuzzySearchParallel(query, 1, 2), lower.FuzzySearch(folded, 1); !reflect.DeepEqual(got, want) {
+			t.Errorf("FuzzySearchParallel(%q, 1) = %q, want %q", query, got, want)
+		}
+		if got, want := root.SuggestGrouped(query, 2), lower.SuggestGrouped(folded, 2); !reflect.DeepEqual(got, want) {
+			t.Errorf("SuggestGrouped(%q, 2) = %v, want %v", query, got, want)
+		}
+		if got, want := root.HammingSearch(query, 1), lower.HammingSearch(folded, 1); !reflect.DeepEqual(got, want) {
+			t.Errorf("HammingSearch(%q, 1) = %q, want %q", query, got, want)
+		}
+		if got, want := root.Neighbors(query), lower.Neighbors(folded); !reflect.DeepEqual(got, want) {
+			t.Errorf("Neighbors(%q) = %q, want %q", query, got, want)
+		}
+		if got, want := root.FuzzyWithFixedPrefix(query[:2], query[2:], 1), lower.FuzzyWithFixedPrefix(folded[:2], folded[2:], 1); !reflect.DeepEqual(got, want) {
+			t.Errorf("FuzzyWithFixedPrefix(%q, %q, 1) = %q, want %q", query[:2], query[2:], got, want)
+		}
+		got, ok := root.Autocorrect(query)
+		want, wantOK := lower.Autocorrect(folded)
+		if got != want || ok != wantOK {
+			t.Errorf("Autocorrect(%q) = %q, %v, want %q, %v", query, got, ok, want, wantOK)
+		}
+	}
+	bloom, err := root.BuildBloom(0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root.Finalize()
+	searcher, err := root.NewSearcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, word := range sampleWords {
+		upper := strings.ToUpper(word)
+		if !bloom.MayContain(upper) {
+			t.Errorf("MayContain(%q) = false", upper)
+		}
+		if got := searcher.FuzzySearch(upper, 0); !reflect.DeepEqual(got, []string{word}) {
+			t.Errorf("Searcher.FuzzySearch(%q, 0) = %q, want [%q]", upper, got, word)
+		}
+	}
+}
+
+func TestPutContainsDelete(t *testing.T) {
+	words := randomWords(3000, 8, "abcdef", 3)
+	probes := randomWords(3000, 8, "abcdef", 4)
+	set := make(map[string]bool)
+	for _, word := range words {
+		set[word] = true
+	}
+	root := build(t, words...)
+	check := func(stage string) {
+		t.Helper()
+		for _, word := range append(words, probes...) {
+			if got := root.Contains(word); got != set[word] {
+				t.Errorf("%s: Contains(%q) = %v, want %v", stage, word, got, set[word])
+			}
+		}
+		if got := root.WordCount(); got != len(set) {
+			t.Errorf("%s: WordCount = %d, want %d", stage, got, len(set))
+		}
+		if err := root.Validate(); err != nil {
+			t.Errorf("%s: Validate: %v", stage, err)
+		}
+	}
+	check("built")
+	id := 100000
+	for _, word := range words[:500] {
+		if _, err := root.Delete(word, &id); err != nil {
+			t.Fatal(err)
+		}
+		delete(set, word)
+	}
+	check("deleted before Optimise")
+	root.Optimise()
+	check("optimised")
+	for _, word := range words[500:1000] {
+		deleted, err := root.Delete(word, &id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if deleted != set[word] {
+			t.Errorf("Delete(%q) = %v, want %v", word, deleted, set[word])
+		}
+		delete(set, word)
+	}
+	check("deleted after Optimise")
+	for _, word := range probes[:500] {
+		if err := root.Put(word, &id); err != nil {
+			t.Fatal(err)
+		}
+		set[word] = true
+	}
+	check("put after Optimise")
+}
+
+func TestContainsDoesNotAllocate(t *testing.T) {
+	root := build(t, "apple", "banana", "日本語", "naïve")
+	root.Optimise()
+	root.Finalize()
+	for _, query := range []string{"apple", "appl", "zebra", "日本語", "naïve", "na\xffve", ""} {
+		if allocs := testing.AllocsPerRun(100, func() { root.Contains(query) }); allocs != 0 {
+			t.Errorf("Contains(%q) allocates %v times", query, allocs)
+		}
+	}
+}
+
+func TestFlatRoundtrip(t *testing.T) {
+	words := randomWords(2000, 7, "abcdeé", 5)
+	probes := randomWords(2000, 7, "abcdeé", 6)
+	root := build(t, words...)
+	root.Optimise()
+	want := root.Words()
+	writers := map[string]func(outarray, *bytes.Buffer) error{
+		"fixed": func(o outarray, buf *bytes.Buffer) error {
+			_, err := o.WriteTo(buf)
+			return err
+		},
+		"compact": func(o outarray, buf *bytes.Buffer) error {
+			_, err := o.WriteCompactTo(buf)
+			return err
+		},
+	}
+	for name, write := range writers {
+		for _, layout := range []FlatLayout{BreadthFirst, DepthFirst} {
+			var buf bytes.Buffer
+			if err := write(root.FlatArrayLayout(layout), &buf); err != nil {
+				t.Fatal(err)
+			}
+			o, err := ReadFlat(&buf)
+			if err != nil {
+				t.Fatalf("%s, layout %v: %v", name, layout, err)
+			}
+			if err := VerifyFlat(o); err != nil {
+				t.Errorf("%s, layout %v: VerifyFlat: %v", name, layout, err)
+			}
+			var got []string
+			o.eachWord(func(word []rune, node arraynode) error {
+				got = append(got, string(word))
+				return nil
+			})
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%s, layout %v: words differ after the round trip", name, layout)
+			}
+			for _, word := range append(words, probes...) {
+				if o.ContainsFlat(word) != root.Contains(word) {
+					t.Errorf("%s, layout %v: ContainsFlat(%q) = %v", name, layout, word, o.ContainsFlat(word))
+				}
+			}
+		}
+	}
+}
+
+// levenshtein is the textbook edit distance between a and b, in runes.
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	row := make([]int, len(rb)+1)
+	for j := range row {
+		row[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		prev := row[0]
+		row[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur := prev + cost
+			if row[j]+1 < cur {
+				cur = row[j] + 1
+			}
+			if row[j-1]+1 < cur {
+				cur = row[j-1] + 1
+			}
+			prev, row[j] = row[j], cur
+		}
+	}
+	return row[len(rb)]
+}
+
+// within returns, sorted, the words at most maxDist edits from query.
+func within(words []string, query string, maxDist int) []string {
+	var found []string
+	seen := make(map[string]bool)
+	for _, word := range words {
+		if !seen[word] && levenshtein(word, query) <= maxDist {
+			found = append(found, word)
+		}
+		seen[word] = true
+	}
+	sort.Strings(found)
+	return found
+}
+
+func TestFuzzyAgainstBruteForce(t *testing.T) {
+	words := randomWords(1500, 6, "abcd", 7)
+	queries := randomWords(60, 6, "abcde", 8)
+	root := build(t, words...)
+	root.Optimise()
+	root.Finalize()
+	searcher, err := root.NewSearcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, query := range queries {
+		for maxDist := 0; maxDist <= 2; maxDist++ {
+			want := within(words, query, maxDist)
+			if got := root.FuzzySearch(query, maxDist); !equalWords(got, want) {
+				t.Errorf("FuzzySearch(%q, %d) = %q, want %q", query, maxDist, got, want)
+			}
+			if got := root.FuzzySearchParallel(query, maxDist, 3); !equalWords(got, want) {
+				t.Errorf("FuzzySearchParallel(%q, %d) = %q, want %q", query, maxDist, got, want)
+			}
+			if got := searcher.FuzzySearch(query, maxDist); !equalWords(got, want) {
+				t.Errorf("Searcher.FuzzySearch(%q, %d) = %q, want %q", query, maxDist, got, want)
+			}
+			groups := root.SuggestGrouped(query, maxDist)
+			for dist := 0; dist <= maxDist; dist++ {
+				var exact []string
+				for _, word := range want {
+					if levenshtein(word, query) == dist {
+						exact = append(exact, word)
+					}
+				}
+				if !equalWords(groups[dist], exact) {
+					t.Errorf("SuggestGrouped(%q, %d)[%d] = %q, want %q", query, maxDist, dist, groups[dist], exact)
+				}
+			}
+			if len(query) > 1 {
+				var fixed []string
+				for _, word := range within(words, "", 100) {
+					if strings.HasPrefix(word, query[:1]) && levenshtein(word[1:], query[1:]) <= maxDist {
+						fixed = append(fixed, word)
+					}
+				}
+				if got := root.FuzzyWithFixedPrefix(query[:1], query[1:], maxDist); !equalWords(got, fixed) {
+					t.Errorf("FuzzyWithFixedPrefix(%q, %q, %d) = %q, want %q", query[:1], query[1:], maxDist, got, fixed)
+				}
+			}
+		}
+		var neighbours []string
+		for _, word := range within(words, query, 1) {
+			if word != query {
+				neighbours = append(neighbours, word)
+			}
+		}
+		if got := root.Neighbors(query); !equalWords(got, neighbours) {
+			t.Errorf("Neighbors(%q) = %q, want %q", query, got, neighbours)
+		}
+	}
+}
+
+// equalWords is reflect.DeepEqual with nil and empty slices equal.
+func equalWords(a, b []string) bool {
+	return len(a) == 0 && len(b) == 0 || reflect.DeepEqual(a, b)
+}
+
+func TestPageAndShard(t *testing.T) {
+	root := build(t, randomWords(1000, 5, "abcdefg", 9)...)
+	root.Optimise()
+	words := root.Words()
+	for _, limit := range []int{1, 7, 100, len(words) + 1} {
+		var paged []string
+		for offset := 0; offset < len(words); offset += limit {
+			paged = append(paged, root.Page(offset, limit)...)
+		}
+		if !reflect.DeepEqual(paged, words) {
+			t.Errorf("pages of %d do not add up to Words", limit)
+		}
+	}
+	if got := root.Page(len(words), 10); len(got) != 0 {
+		t.Errorf("Page past the end = %q", got)
+	}
+	for _, n := range []int{1, 3, 10} {
+		shards, err := root.Shard(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(shards) != n {
+			t.Fatalf("Shard(%d) made %d shards", n, len(shards))
+		}
+		var joined []string
+		for _, shard := range shards {
+			joined = append(joined, shard.Words()...)
+		}
+		if !reflect.DeepEqual(joined, words) {
+			t.Errorf("Shard(%d): shards do not add up to Words", n)
+		}
+	}
+}
+
+func TestDictionarySaveLoad(t *testing.T) {
+	d := NewDictionary()
+	for _, word := range sampleWords {
+		if err := d.Add(word); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.AddWithCount("cart", 4); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.PutPayload("star", []byte{1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+	d.Optimise()
+	filename := filepath.Join(t.TempDir(), "dict.wg")
+	if err := d.Save(filename); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadDictionary(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := loaded.Words(), d.Words(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Words after LoadDictionary = %q, want %q", got, want)
+	}
+	for _, word := range sampleWords {
+		if got, want := loaded.Frequency(word), d.Frequency(word); got != want {
+			t.Errorf("Frequency(%q) after LoadDictionary = %d, want %d", word, got, want)
+		}
+	}
+	if payload, ok := loaded.GetPayload("star"); !ok || !bytes.Equal(payload, []byte{1, 2, 3}) {
+		t.Errorf("GetPayload(\"star\") after LoadDictionary = %v, %v", payload, ok)
+	}
+	if err := loaded.Add("carted"); err != nil {
+		t.Errorf("Add after LoadDictionary: %v", err)
+	}
+}
+
+func TestVerifyRoundtrip(t *testing.T) {
+	corpus := append(randomWords(3000, 9, "abcdefghijklmnopqrstuvwxyz", 10), randomWords(300, 5, "жзийк日本語é", 11)...)
+	corpus = append(corpus, sampleWords...)
+	graphs := map[string]func() *treenode{
+		"empty": func() *treenode { return NewDAWG() },
+		"empty word": func() *treenode {
+			return build(t, "", "a", "ab")
+		},
+		"unminimised": func() *treenode {
+			return build(t, corpus...)
+		},
+		"optimised": func() *treenode {
+			root := build(t, corpus...)
+			root.Optimise()
+			return root
+		},
+		"frequencies and payloads": func() *treenode {
+			root := build(t, corpus...)
+			id := 100000
+			for i, word := range corpus[:200] {
+				if err := root.AddWithCount(word, i%5+1, &id); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := root.PutPayload("payload", []byte("data"), &id); err != nil {
+				t.Fatal(err)
+			}
+			root.Optimise()
+			return root
+		},
+		"deleted after Optimise": func() *treenode {
+			root := build(t, corpus...)
+			root.Optimise()
+			id := 100000
+			for _, word := range corpus[:300] {
+				if _, err := root.Delete(word, &id); err != nil {
+					t.Fatal(err)
+				}
+			}
+			return root
+		},
+	}
+	for name, graph := range graphs {
+		root := graph()
+		if err := root.VerifyRoundtrip(); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		if name != "unminimised" {
+			continue
+		}
+		// Without shared tails the array has the nodes and edges of the graph.
+		if stats, err := root.FlatArray().stats(); err != nil || stats != root.Stats() {
+			t.Errorf("%s: flat Stats = %+v, %v, want %+v", name, stats, err, root.Stats())
+		}
+	}
+}
+
+// BenchmarkChildLookup looks up every child of a node of each width,
+// once through the list and once through the map, to find the width
+// at which childIndexThreshold should switch to the map. The runes
+// are spread over the CJK block, as in the first level of a Chinese
+// dictionary.
+func BenchmarkChildLookup(b *testing.B) {
+	for _, width := range []int{8, 16, 20, 24, 28, 32, 64} {
+		root := NewDAWG()
+		id := 0
+		runes := make([]rune, width)
+		for i := range runes {
+			runes[i] = rune(0x4e00 + 37*i)
+			if err := root.Put(string(runes[i]), &id); err != nil {
+				b.Fatal(err)
+			}
+		}
+		index := make(map[rune]*treenode, width)
+		for child := root.children; child != nil; child = child.next {
+			index[child.val] = child
+		}
+		for _, mode := range []string{"list", "map"} {
+			root.index = nil
+			if mode == "map" {
+				root.index = index
+			}
+			b.Run(fmt.Sprintf("%s/%d", mode, width), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					if root.child(runes[i%width]) == nil {
+						b.Fatal("child not found")
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestPrefixWords(t *testing.T) {
+	// Every prefix of the alphabet is a word, and some have other
+	// extensions too.
+	var words []string
+	for i := 1; i <= 12; i++ {
+		words = append(words, "abcdefghijkl"[:i])
+	}
+	words = append(words, "abx", "abcdy", "abcdyz", "b")
+	sorted := append([]string{}, words...)
+	sort.Strings(sorted)
+	completions := func(prefix string) []string {
+		var found []string
+		for _, word := range sorted {
+			if strings.HasPrefix(word, prefix) {
+				found = append(found, word)
+			}
+		}
+		return found
+	}
+	for _, optimise := range []bool{false, true} {
+		root := build(t, words...)
+		if optimise {
+			root.Optimise()
+		}
+		for _, word := range words {
+			if !root.Contains(word) {
+				t.Errorf("optimised %v: Contains(%q) = false", optimise, word)
+			}
+		}
+		for _, word := range []string{"", "ac", "abcdefghijklm", "abcdz", "abxy", "bb"} {
+			if root.Contains(word) {
+				t.Errorf("optimised %v: Contains(%q) = true", optimise, word)
+			}
+		}
+		if got := root.Words(); !reflect.DeepEqual(got, sorted) {
+			t.Errorf("optimised %v: Words = %q, want %q", optimise, got, sorted)
+		}
+		if got := root.WordCount(); got != len(words) {
+			t.Errorf("optimised %v: WordCount = %d, want %d", optimise, got, len(words))
+		}
+		for _, prefix := range []string{"a", "ab", "abc", "abcd", "abcdy", "abcdefghijkl", "b", "abz"} {
+			if got, want := root.Completions(prefix), completions(prefix); !equalWords(got, want) {
+				t.Errorf("optimised %v: Completions(%q) = %q, want %q", optimise, prefix, got, want)
+			}
+		}
+		if got, want := root.LeafWords(), []string{"abcdefghijkl", "abcdyz", "abx", "b"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("optimised %v: LeafWords = %q, want %q", optimise, got, want)
+		}
+		for prefix, want := range map[string]string{"": "a", "a": "a", "abcd": "abcd", "abcdy": "abcdy", "abcdyz": "abcdyz", "abcdefghijk": "abcdefghijk", "abcdefghijkl": "abcdefghijkl"} {
+			if got, ok := root.ShortestCompletion(prefix); !ok || got != want {
+				t.Errorf("optimised %v: ShortestCompletion(%q) = %q, %v, want %q", optimise, prefix, got, ok, want)
+			}
+		}
+		if got, ok := root.ShortestCompletion("abz"); ok {
+			t.Errorf("optimised %v: ShortestCompletion(\"abz\") = %q, true", optimise, got)
+		}
+		id := 1000
+		for _, word := range []string{"abc", "abcdefghijkl"} {
+			if deleted, err := root.Delete(word, &id); err != nil || !deleted {
+				t.Fatalf("optimised %v: Delete(%q) = %v, %v", optimise, word, deleted, err)
+			}
+		}
+		for _, word := range []string{"ab", "abcd", "abcdefghijk", "abcdyz"} {
+			if !root.Contains(word) {
+				t.Errorf("optimised %v: Contains(%q) = false after deleting its neighbours", optimise, word)
+			}
+		}
+		if got := root.WordCount(); got != len(words)-2 {
+			t.Errorf("optimised %v: WordCount after Delete = %d, want %d", optimise, got, len(words)-2)
+		}
+		if got, ok := root.ShortestCompletion("abc"); !ok || got != "abcd" {
+			t.Errorf("optimised %v: ShortestCompletion(\"abc\") after Delete = %q, %v", optimise, got, ok)
+		}
+	}
+}
+
+// failingWriter fails every write once n bytes have been written.
+// The bytes written before that go to w, if it is set.
+type failingWriter struct {
+	n int
+	w io.Writer
+}
+
+var errWriteFailed = errors.New("write failed")
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.n {
+		written := w.n
+		w.n = 0
+		if w.w != nil {
+			w.w.Write(p[:written])
+		}
+		return written, errWriteFailed
+	}
+	w.n -= len(p)
+	if w.w != nil {
+		w.w.Write(p)
+	}
+	return len(p), nil
+}
+
+func TestWriteDotLimited(t *testing.T) {
+	root := build(t, randomWords(500, 6, "abcdef", 12)...)
+	nodeLine := regexp.MustCompile(`(?m)^\t-?\d+ \[label=`)
+	for _, maxNodes := range []int{1, 10, 100, 1 << 20} {
+		var buf bytes.Buffer
+		if err := root.WriteDotLimited(&buf, maxNodes); err != nil {
+			t.Fatal(err)
+		}
+		nodes := len(nodeLine.FindAllString(buf.String(), -1))
+		want := maxNodes
+		if total := root.Stats().Nodes; want > total {
+			want = total
+		}
+		if nodes != want {
+			t.Errorf("WriteDotLimited(%d) drew %d nodes, want %d", maxNodes, nodes, want)
+		}
+		if truncated := strings.Contains(buf.String(), "truncated"); truncated != (maxNodes < root.Stats().Nodes) {
+			t.Errorf("WriteDotLimited(%d): truncation marker %v", maxNodes, truncated)
+		}
+	}
+	if err := root.WriteDotLimited(&failingWriter{n: 100}, 1000); err != errWriteFailed {
+		t.Errorf("WriteDotLimited to a failing writer: %v, want %v", err, errWriteFailed)
+	}
+	filename := filepath.Join(t.TempDir(), "missing", "graph.dot")
+	if err := root.CreateDotLimited(filename, 10); err == nil {
+		t.Errorf("CreateDotLimited in a missing directory succeeded")
+	}
+}
+
+func TestWriteDotEdgeLabelled(t *testing.T) {
+	root := build(t, sampleWords...)
+	root.Optimise()
+	var buf bytes.Buffer
+	if err := root.WriteDotEdgeLabelled(&buf); err != nil {
+		t.Fatal(err)
+	}
+	edges := regexp.MustCompile(`(?m)^-?\d+ -> -?\d+ \[label="(.)"\];$`).FindAllStringSubmatch(buf.String(), -1)
+	if len(edges) != root.Stats().Edges {
+		t.Errorf("WriteDotEdgeLabelled drew %d labelled edges, want %d", len(edges), root.Stats().Edges)
+	}
+	for _, edge := range edges {
+		if !strings.Contains("cardestxyz", edge[1]) {
+			t.Errorf("edge labelled %q", edge[1])
+		}
+	}
+	if strings.Count(buf.String(), "doublecircle") == 0 {
+		t.Errorf("no accepting node drawn")
+	}
+	if err := root.WriteDotEdgeLabelled(&failingWriter{n: 100}); err != errWriteFailed {
+		t.Errorf("WriteDotEdgeLabelled to a failing writer: %v, want %v", err, errWriteFailed)
+	}
+	filename := filepath.Join(t.TempDir(), "missing", "graph.dot")
+	if err := root.CreateDotEdgeLabelled(filename); err == nil {
+		t.Errorf("CreateDotEdgeLabelled in a missing directory succeeded")
+	}
+}
+
+func TestOptimiseProgress(t *testing.T) {
+	stdout := os.Stdout
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout = w
+	build(t, sampleWords...).Optimise()
+	os.Stdout = stdout
+	w.Close()
+	printed, _ := io.ReadAll(r)
+	if len(printed) != 0 {
+		t.Errorf("Optimise printed %q", printed)
+	}
+	var buf bytes.Buffer
+	Progress = &buf
+	defer func() { Progress = nil }()
+	build(t, sampleWords...).Optimise()
+	for _, stage := range []string{"Computing levels and heights", "Computing hashes", "Processing nodes of height 0"} {
+		if !strings.Contains(buf.String(), stage+"\n") {
+			t.Errorf("Progress = %q, want a line %q", buf.String(), stage)
+		}
+	}
+}
+
+func TestFromReaderLongWords(t *testing.T) {
+	long := strings.Repeat("ab", 100000)
+	d, err := FromReader(strings.NewReader("short\n"+long+"\nword\n"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := d.Words(); !reflect.DeepEqual(got, []string{long, "short", "word"}) {
+		t.Errorf("FromReader kept %d words", len(got))
+	}
+	if !d.Contains(long) {
+		t.Errorf("Contains of a 200k-rune word = false")
+	}
+}
+
+func TestOldFlatFormat(t *testing.T) {
+	// The first Flatten wrote val, children and eol of every record,
+	// with no header, starting with the root.
+	var old bytes.Buffer
+	for _, record := range []struct {
+		val, children int32
+		eol           bool
+	}{{'∅', 1, true}, {'a', 0, true}} {
+		binary.Write(&old, binary.LittleEndian, record.val)
+		binary.Write(&old, binary.LittleEndian, record.children)
+		binary.Write(&old, binary.LittleEndian, record.eol)
+	}
+	if _, err := ReadFlat(bytes.NewReader(old.Bytes())); err != ErrOldFlatFormat {
+		t.Errorf("ReadFlat of the old format: %v, want ErrOldFlatFormat", err)
+	}
+	if _, err := NewFlatReader(bytes.NewReader(old.Bytes()), 1); err != ErrOldFlatFormat {
+		t.Errorf("NewFlatReader of the old format: %v, want ErrOldFlatFormat", err)
+	}
+	filename := filepath.Join(t.TempDir(), "old.wg")
+	if err := os.WriteFile(filename, old.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadFlat(filename); err != ErrOldFlatFormat {
+		t.Errorf("LoadFlat of the old format: %v, want ErrOldFlatFormat", err)
+	}
+	if _, err := ReadFlat(strings.NewReader("not a graph at all")); err == nil || err == ErrOldFlatFormat {
+		t.Errorf("ReadFlat of text: %v", err)
+	}
+}
+
+func TestDeMinimizeThenOptimise(t *testing.T) {
+	for seed := int64(0); seed < 20; seed++ {
+		words := randomWords(300, 7, "abcde", seed)
+		trie := build(t, words...).Stats()
+		root := build(t, words...)
+		root.Optimise()
+		minimised := root.Stats()
+		id := 100000
+		if err := root.DeMinimize(&id); err != nil {
+			t.Fatal(err)
+		}
+		if got := root.Stats(); got != trie {
+			t.Errorf("seed %d: Stats after DeMinimize = %+v, want the trie's %+v", seed, got, trie)
+		}
+		if err := root.Validate(); err != nil {
+			t.Errorf("seed %d: Validate after DeMinimize: %v", seed, err)
+		}
+		root.Optimise()
+		if got := root.Stats(); got != minimised {
+			t.Errorf("seed %d: Stats after DeMinimize and Optimise = %+v, want %+v", seed, got, minimised)
+		}
+	}
+}
+
+func TestFlatReaderMatchesLoadFlat(t *testing.T) {
+	words := randomWords(2000, 8, "abcdefé", 13)
+	probes := randomWords(2000, 8, "abcdefé", 14)
+	root := build(t, words...)
+	root.Optimise()
+	filename := filepath.Join(t.TempDir(), "dict.wg")
+	writeFlatFile(t, root.FlatArray(), filename)
+	loaded, err := LoadFlat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cacheSize := range []int{1, 16, DefaultFlatCacheSize} {
+		infile, err := os.Open(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fr, err := NewFlatReader(infile, cacheSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fr.Len() != len(loaded) {
+			t.Errorf("Len = %d, want %d", fr.Len(), len(loaded))
+		}
+		for _, word := range append(words, probes...) {
+			got, err := fr.ContainsFlat(word)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != loaded.ContainsFlat(word) {
+				t.Errorf("cache %d: ContainsFlat(%q) = %v, LoadFlat says %v", cacheSize, word, got, !got)
+			}
+		}
+		infile.Close()
+	}
+	fr, err := OpenFlat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found, err := fr.ContainsFlat(words[0]); err != nil || !found {
+		t.Errorf("OpenFlat: ContainsFlat(%q) = %v, %v", words[0], found, err)
+	}
+	if err := fr.Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+}
+
+// writeFlatFile writes o to filename in the fixed-width format.
+func writeFlatFile(t testing.TB, o outarray, filename string) {
+	t.Helper()
+	var buf bytes.Buffer
+	if _, err := o.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filename, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// BenchmarkFlatLookups compares the memory that LoadFlat takes for a
+// whole file with what a FlatReader keeps, for the same lookups.
+func BenchmarkFlatLookups(b *testing.B) {
+	words := randomWords(50000, 10, "abcdefghijklmnopqrstuvwxyz", 15)
+	root := build(b, words...)
+	root.Optimise()
+	filename := filepath.Join(b.TempDir(), "dict.wg")
+	writeFlatFile(b, root.FlatArray(), filename)
+	queries := words[:1000]
+	b.Run("LoadFlat", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			o, err := LoadFlat(filename)
+			if err != nil {
+				b.Fatal(err)
+			}
+			for _, query := range queries {
+				o.ContainsFlat(query)
+			}
+		}
+	})
+	b.Run("FlatReader", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			fr, err := OpenFlat(filename)
+			if err != nil {
+				b.Fatal(err)
+			}
+			for _, query := range queries {
+				if _, err := fr.ContainsFlat(query); err != nil {
+					b.Fatal(err)
+				}
+			}
+			fr.Close()
+		}
+	})
+}
+
+func TestFinalizeFreezes(t *testing.T) {
+	root := build(t, sampleWords...)
+	words := root.Words()
+	root.Finalize()
+	if !root.Frozen() {
+		t.Fatal("Frozen after Finalize = false")
+	}
+	id := 1000
+	guards := map[string]func() error{
+		"Put":          func() error { return root.Put("new", &id) },
+		"AddWithCount": func() error { return root.AddWithCount("car", 2, &id) },
+		"PutPayload":   func() error { return root.PutPayload("car", []byte{1}, &id) },
+		"Delete": func() error {
+			_, err := root.Delete("car", &id)
+			return err
+		},
+		"Replace": func() error { return root.Replace("car", "bar", &id) },
+		"AddReportingDuplicates": func() error {
+			_, err := root.AddReportingDuplicates([]string{"new"}, &id)
+			return err
+		},
+		"SetCollation": func() error { return root.SetCollation(func(a, b rune) int { return int(b - a) }) },
+		"DeMinimize":   func() error { return root.DeMinimize(&id) },
+	}
+	for name, mutate := range guards {
+		if err := mutate(); err != ErrFrozen {
+			t.Errorf("%s after Finalize: %v, want ErrFrozen", name, err)
+		}
+	}
+	root.Optimise()
+	root.Finalize()
+	if got := root.Words(); !reflect.DeepEqual(got, words) {
+		t.Errorf("Words after Finalize = %q, want %q", got, words)
+	}
+	if got := root.WordCount(); got != len(words) {
+		t.Errorf("WordCount after Finalize = %d, want %d", got, len(words))
+	}
+	if got := root.Page(3, 2); !reflect.DeepEqual(got, words[3:5]) {
+		t.Errorf("Page(3, 2) after Finalize = %q, want %q", got, words[3:5])
+	}
+	if !root.IsMinimized() {
+		t.Errorf("IsMinimized after Finalize = false")
+	}
+}
+
+func TestAddReportingDuplicates(t *testing.T) {
+	root := build(t, "car")
+	id := 100
+	dups, err := root.AddReportingDuplicates([]string{"cart", "car", "ca", "cart", "cart", "cars", "ca"}, &id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"car", "cart", "cart", "ca"}; !reflect.DeepEqual(dups, want) {
+		t.Errorf("AddReportingDuplicates = %q, want %q", dups, want)
+	}
+	if got, want := root.Words(), []string{"ca", "car", "cars", "cart"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Words = %q, want %q", got, want)
+	}
+}
+
+func TestComputeAnnotations(t *testing.T) {
+	root := build(t, "car", "cat", "at")
+	root.ComputeAnnotations()
+	for prefix, want := range map[string][2]int{
+		"": {0, 3}, "c": {1, 2}, "ca": {2, 1}, "car": {3, 0}, "cat": {3, 0}, "a": {1, 1}, "at": {2, 0},
+	} {
+		node := root.find(prefix)
+		if got := [2]int{node.level, node.height}; got != want {
+			t.Errorf("level and height of %q = %v, want %v", prefix, got, want)
+		}
+	}
+	// Optimise merges "ca" and "ba", which are on the same level.
+	root = build(t, "car", "bar", "at")
+	root.Optimise()
+	root.ComputeAnnotations()
+	if root.find("ca") != root.find("ba") {
+		t.Fatal("\"ca\" and \"ba\" are not shared")
+	}
+	if node := root.find("ba"); node.level != 2 || node.height != 1 {
+		t.Errorf("level and height of \"ba\" after Optimise = %d, %d, want 2, 1", node.level, node.height)
+	}
+	if got := root.MaxWordLength(); got != 3 {
+		t.Errorf("MaxWordLength = %d, want 3", got)
+	}
+}
+
+func TestWordsWithSharing(t *testing.T) {
+	root := build(t, "walked", "talked", "walk", "talk", "zoo")
+	got := make(map[string][2]int)
+	root.WordsWithSharing(func(word string, shared, unique int) {
+		got[word] = [2]int{shared, unique}
+	})
+	want := map[string][2]int{
+		"walked": {5, 1}, "talked": {5, 1}, "walk": {3, 1}, "talk": {3, 1}, "zoo": {0, 3},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("WordsWithSharing = %v, want %v", got, want)
+	}
+}
+
+func TestHashesComputedOnDemand(t *testing.T) {
+	a := build(t, "ab", "cd")
+	b := build(t, "ab", "ce")
+	// Neither graph has been hashed: zero hashes would make them equal.
+	if a.Fingerprint() == b.Fingerprint() {
+		t.Errorf("Fingerprint is the same for different words before Optimise")
+	}
+	root := build(t, sampleWords...)
+	before := root.Fingerprint()
+	estimate := build(t, sampleWords...).EstimateMinimizedNodes()
+	root.Optimise()
+	if got := root.Fingerprint(); got != before {
+		t.Errorf("Fingerprint changed with Optimise")
+	}
+	if got := root.Stats().Nodes; got != estimate {
+		t.Errorf("EstimateMinimizedNodes before Optimise = %d, want %d", estimate, got)
+	}
+	root.Finalize()
+	if got := root.Fingerprint(); got != before {
+		t.Errorf("Fingerprint changed once Finalize dropped the hashes")
+	}
+	id := 1000
+	c := build(t, sampleWords...)
+	c.Fingerprint()
+	if err := c.Put("zzz", &id); err != nil {
+		t.Fatal(err)
+	}
+	if c.Fingerprint() == before {
+		t.Errorf("Fingerprint did not change after Put")
+	}
+}
+
+func TestBloomFilter(t *testing.T) {
+	words := randomWords(5000, 8, "abcdefghijklmnopqrstuvwxyz", 16)
+	root := build(t, words...)
+	const rate = 0.02
+	bloom, err := root.BuildBloom(rate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, word := range words {
+		if !bloom.MayContain(word) {
+			t.Fatalf("MayContain(%q) = false for a stored word", word)
+		}
+	}
+	absent, positives := 0, 0
+	for _, word := range randomWords(20000, 8, "abcdefghijklmnopqrstuvwxyz", 17) {
+		if root.Contains(word) {
+			continue
+		}
+		absent++
+		if bloom.MayContain(word) {
+			positives++
+		}
+	}
+	if got := float64(positives) / float64(absent); got > 2*rate {
+		t.Errorf("false-positive rate = %.3f, want about %.3f", got, rate)
+	}
+	for _, bad := range []float64{0, 1, -0.5} {
+		if _, err := root.BuildBloom(bad); err == nil {
+			t.Errorf("BuildBloom(%v) succeeded", bad)
+		}
+	}
+}
+
+// ids returns the id of every distinct node of the graph.
+func ids(root *treenode) []int {
+	var found []int
+	visited := make(map[*treenode]bool)
+	var walk func(t *treenode)
+	walk = func(t *treenode) {
+		visited[t] = true
+		found = append(found, t.id)
+		for child := t.children; child != nil; child = child.next {
+			if !visited[child] {
+				walk(child)
+			}
+		}
+	}
+	walk(root)
+	return found
+}
+
+func TestRenumberIDs(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "dict.wg")
+	d := NewDictionary()
+	for _, word := range sampleWords {
+		if err := d.Add(word); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d.Optimise()
+	if err := d.Save(filename); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadDictionary(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := loaded.root
+	root.Optimise()
+	// Make every id collide, as in a graph put together by hand.
+	visited := make(map[*treenode]bool)
+	var reset func(t *treenode)
+	reset = func(t *treenode) {
+		visited[t] = true
+		t.id = 0
+		for child := t.children; child != nil; child = child.next {
+			if !visited[child] {
+				reset(child)
+			}
+		}
+	}
+	reset(root)
+	next := root.RenumberIDs()
+	got := ids(root)
+	if root.id != -1 {
+		t.Errorf("root id = %d, want -1", root.id)
+	}
+	sort.Ints(got)
+	for i, id := range got[1:] {
+		if id != i {
+			t.Fatalf("ids after RenumberIDs = %v, want -1 and 0 to %d", got, len(got)-2)
+		}
+	}
+	if next != len(got)-1 {
+		t.Errorf("RenumberIDs = %d, want %d", next, len(got)-1)
+	}
+	var buf bytes.Buffer
+	if err := root.WriteDot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if nodes := len(regexp.MustCompile(`(?m)^\t-?\d+ \[label=`).FindAllString(buf.String(), -1)); nodes != len(got) {
+		t.Errorf("DOT after RenumberIDs has %d nodes, want %d", nodes, len(got))
+	}
+}
+
+func TestOptimiseAfterChangesMatchesFreshBuild(t *testing.T) {
+	optimisers := map[string]func(*treenode){
+		"Optimise":          (*treenode).Optimise,
+		"OptimiseLowMemory": (*treenode).OptimiseLowMemory,
+	}
+	for name, optimise := range optimisers {
+		for seed := int64(0); seed < 200; seed++ {
+			// Distinct words, so that every word has a count of one in
+			// both graphs.
+			var words []string
+			for _, word := range randomWords(60, 6, "abcd", seed) {
+				if !containsString(words, word) {
+					words = append(words, word)
+				}
+			}
+			split := len(words) * 3 / 4
+			root := build(t, words[:split]...)
+			optimise(root)
+			id := 100000
+			for _, word := range words[split:] {
+				if err := root.Put(word, &id); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for i := 0; i < len(words); i += 7 {
+				if _, err := root.Delete(words[i], &id); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var kept []string
+			for _, word := range words {
+				if root.Contains(word) {
+					kept = append(kept, word)
+				}
+			}
+			optimise(root)
+			fresh := build(t, kept...)
+			optimise(fresh)
+			if got, want := root.Stats(), fresh.Stats(); got != want {
+				t.Errorf("%s, seed %d: Stats after changes and %s = %+v, want a fresh build's %+v", name, seed, name, got, want)
+			}
+			if err := root.Validate(); err != nil {
+				t.Errorf("%s, seed %d: Validate: %v", name, seed, err)
+			}
+		}
+	}
+}
+
+func TestDictionaryEndToEnd(t *testing.T) {
+	d := NewDictionary()
+	for _, word := range sampleWords {
+		if err := d.Add(word); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d.Optimise()
+	for _, word := range []string{"cars", "stare", "tarts"} {
+		if err := d.Add(word); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ok, err := d.Delete("xyz"); err != nil || !ok {
+		t.Fatalf("Delete(%q) = %v, %v, want true, nil", "xyz", ok, err)
+	}
+	if ok, err := d.Delete("xyz"); err != nil || ok {
+		t.Errorf("second Delete(%q) = %v, %v, want false, nil", "xyz", ok, err)
+	}
+	d.Optimise()
+	if !d.Contains("stare") || d.Contains("xyz") || d.Contains("sta") {
+		t.Errorf("Contains after Add, Delete and Optimise gives the wrong words: %q", d.Words())
+	}
+	if got, want := d.Completions("star"), []string{"star", "stare", "stars", "start"}; !equalWords(got, want) {
+		t.Errorf("Completions(%q) = %q, want %q", "star", got, want)
+	}
+	fresh := NewDictionary()
+	for _, word := range d.Words() {
+		if err := fresh.Add(word); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fresh.Optimise()
+	if got, want := d.Stats(), fresh.Stats(); got != want {
+		t.Errorf("Stats = %+v, want a fresh build's %+v", got, want)
+	}
+	filename := filepath.Join(t.TempDir(), "dict.wg")
+	if err := d.Save(filename); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadDictionary(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := loaded.Words(), d.Words(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Words after LoadDictionary = %q, want %q", got, want)
+	}
+}
+
+func TestWriteDotMinimisedNoDuplicates(t *testing.T) {
+	root := build(t, randomWords(500, 6, "abcdef", 15)...)
+	root.Optimise()
+	var buf bytes.Buffer
+	if err := root.WriteDot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	nodes := regexp.MustCompile(`(?m)^\t(-?\d+) \[label=`).FindAllStringSubmatch(buf.String(), -1)
+	drawn := make(map[string]bool)
+	for _, node := range nodes {
+		if drawn[node[1]] {
+			t.Errorf("node %s drawn twice", node[1])
+		}
+		drawn[node[1]] = true
+	}
+	if want := len(ids(root)); len(drawn) != want {
+		t.Errorf("WriteDot drew %d nodes, want %d", len(drawn), want)
+	}
+	edges := regexp.MustCompile(`(?m)^-?\d+ -> -?\d+`).FindAllString(buf.String(), -1)
+	seen := make(map[string]bool)
+	for _, edge := range edges {
+		if seen[edge] {
+			t.Errorf("edge %s drawn twice", edge)
+		}
+		seen[edge] = true
+	}
+	if want := root.Stats().Edges; len(edges) != want {
+		t.Errorf("WriteDot drew %d edges, want %d", len(edges), want)
+	}
+}
+
+func TestAutocorrect(t *testing.T) {
+	root := build(t, "bat", "car", "cat", "hello", "help")
+	root.Optimise()
+	for _, tc := range []struct {
+		typed, want string
+		ok          bool
+	}{
+		{"cat", "cat", true},
+		{"cst", "cat", true},     // s is next to a.
+		{"hrllo", "hello", true}, // r is next to e.
+		{"hepl", "help", true},
+		{"vat", "bat", true}, // v is next to both b and c; ties go to the first word.
+		{"zzzzzz", "", false},
+	} {
+		if got, ok := root.Autocorrect(tc.typed); got != tc.want || ok != tc.ok {
+			t.Errorf("Autocorrect(%q) = %q, %v, want %q, %v", tc.typed, got, ok, tc.want, tc.ok)
+		}
+	}
+	if got, ok := root.AutocorrectWith("cst", QWERTY, 0.25); ok {
+		t.Errorf("AutocorrectWith(%q) under a threshold of 0.25 = %q, want no word", "cst", got)
+	}
+	// On a keyboard where s and a are not neighbours the typo costs as
+	// much as any other substitution.
+	if got, ok := root.AutocorrectWith("cst", map[rune]string{}, 0.5); ok {
+		t.Errorf("AutocorrectWith(%q) without neighbours = %q, want no word", "cst", got)
+	}
+}
+
+func TestIDsDenseAndUnique(t *testing.T) {
+	root := NewDAWG()
+	id := 0
+	for _, word := range randomWords(20000, 10, "abcdefghijklmnopqrstuvwxyz", 16) {
+		if err := root.Put(word, &id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := ids(root)
+	sort.Ints(got)
+	if len(got) != id+1 {
+		t.Fatalf("%d nodes for %d ids handed out", len(got), id)
+	}
+	for i, n := range got {
+		if n != i-1 {
+			t.Fatalf("ids = %v..., want -1 for the root and 0 to %d", got[:i+1], id-1)
+		}
+	}
+	id = math.MaxInt
+	if err := root.Put("zzzzzzzzzzzz", &id); !errors.Is(err, ErrIDOverflow) {
+		t.Errorf("Put with the counter at MaxInt: %v, want %v", err, ErrIDOverflow)
+	}
+	if id != math.MaxInt {
+		t.Errorf("counter moved to %d after overflow", id)
+	}
+}
+
+func TestFlatRejectsPrefixes(t *testing.T) {
+	root := build(t, sampleWords...)
+	root.Optimise()
+	filename := filepath.Join(t.TempDir(), "dict.wg")
+	writeFlatFile(t, root.FlatArray(), filename)
+	o, err := LoadFlat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, word := range sampleWords {
+		if !o.ContainsFlat(word) {
+			t.Errorf("ContainsFlat(%q) = false after the round trip", word)
+		}
+	}
+	for _, prefix := range []string{"c", "ca", "s", "st", "sta", "ta", "x", "xy"} {
+		if o.ContainsFlat(prefix) {
+			t.Errorf("ContainsFlat(%q) = true for a prefix that is not a word", prefix)
+		}
+	}
+}
+
+func TestWideNodes(t *testing.T) {
+	var alphabet []rune
+	for r := rune(0x4e00); r < 0x4e00+200; r++ {
+		alphabet = append(alphabet, r)
+	}
+	words := randomWords(5000, 3, string(alphabet), 17)
+	probes := randomWords(5000, 3, string(alphabet), 18)
+	set := make(map[string]bool)
+	for _, word := range words {
+		set[word] = true
+	}
+	root := build(t, words...)
+	// The index must hold exactly the children in the list.
+	checkIndex := func(stage string) {
+		t.Helper()
+		if root.index == nil {
+			t.Fatalf("%s: no child index on a root with %d children", stage, len(alphabet))
+		}
+		n := 0
+		for child := root.children; child != nil; child = child.next {
+			if root.index[child.val] != child {
+				t.Errorf("%s: index entry for %q is not the child in the list", stage, child.val)
+			}
+			n++
+		}
+		if len(root.index) != n {
+			t.Errorf("%s: index has %d entries for %d children", stage, len(root.index), n)
+		}
+		for _, word := range append(words, probes...) {
+			if got := root.Contains(word); got != set[word] {
+				t.Errorf("%s: Contains(%q) = %v, want %v", stage, word, got, set[word])
+			}
+		}
+	}
+	checkIndex("built")
+	root.Optimise()
+	checkIndex("optimised")
+	id := 100000
+	for _, word := range words[:1000] {
+		if _, err := root.Delete(word, &id); err != nil {
+			t.Fatal(err)
+		}
+		delete(set, word)
+	}
+	checkIndex("deleted after Optimise")
+	for _, word := range probes[:1000] {
+		if err := root.Put(word, &id); err != nil {
+			t.Fatal(err)
+		}
+		set[word] = true
+	}
+	checkIndex("put after Optimise")
+}
+
+func TestConstrainedSearch(t *testing.T) {
+	root := build(t, append([]string{"pre", "prefix", "preparing", "pretending", "preying", "ping"}, sampleWords...)...)
+	root.Optimise()
+	for _, tc := range []struct {
+		prefix, suffix string
+		maxLen         int
+		want           []string
+	}{
+		{"pre", "ing", 0, []string{"preparing", "pretending", "preying"}},
+		{"pre", "ing", 7, []string{"preying"}},
+		{"car", "s", 0, []string{"cards", "cares", "carts"}},
+		{"star", "star", 0, []string{"star"}}, // The prefix and the suffix overlap.
+		{"car", "", 3, []string{"car"}},
+		{"", "ing", 4, []string{"ping"}},
+		{"car", "", 2, nil},
+		{"zz", "", 0, nil},
+	} {
+		if got := root.ConstrainedSearch(tc.prefix, tc.suffix, tc.maxLen); !equalWords(got, tc.want) {
+			t.Errorf("ConstrainedSearch(%q, %q, %d) = %q, want %q", tc.prefix, tc.suffix, tc.maxLen, got, tc.want)
+		}
+	}
+	if got, truncated := root.ConstrainedSearchLimited("car", "", 0, 2); !truncated || !equalWords(got, []string{"car", "card"}) {
+		t.Errorf("ConstrainedSearchLimited(%q, %q, 0, 2) = %q, %v, want [car card], true", "car", "", got, truncated)
+	}
+}
+
+func TestFinalizeDropsHashes(t *testing.T) {
+	root := build(t, randomWords(2000, 7, "abcdef", 19)...)
+	root.Optimise()
+	before := root.Fingerprint()
+	root.Finalize()
+	visited := make(map[*treenode]bool)
+	var walk func(node *treenode)
+	walk = func(node *treenode) {
+		visited[node] = true
+		if node.hash != nil {
+			t.Errorf("node %d keeps its hash after Finalize", node.id)
+		}
+		if node.parents != nil {
+			t.Errorf("node %d keeps its parents after Finalize", node.id)
+		}
+		for child := node.children; child != nil; child = child.next {
+			if !visited[child] {
+				walk(child)
+			}
+		}
+	}
+	walk(root)
+	if root.Fingerprint() != before {
+		t.Errorf("Fingerprint recomputed after Finalize differs")
+	}
+}
+
+// BenchmarkFinalizeHeap reports how much of the heap of a minimised
+// graph Finalize gives back by dropping the hashes and parent links.
+func BenchmarkFinalizeHeap(b *testing.B) {
+	words := randomWords(20000, 10, "abcdefghijklmnopqrstuvwxyz", 20)
+	heap := func() uint64 {
+		var stats runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&stats)
+		return stats.HeapAlloc
+	}
+	var saved, total float64
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		start := heap()
+		root := build(b, words...)
+		root.Optimise()
+		optimised := heap()
+		b.StartTimer()
+		root.Finalize()
+		b.StopTimer()
+		finalized := heap()
+		runtime.KeepAlive(root)
+		saved += float64(optimised) - float64(finalized)
+		total += float64(optimised) - float64(start)
+		b.StartTimer()
+	}
+	b.ReportMetric(saved/float64(b.N), "heap-B-saved/op")
+	b.ReportMetric(100*saved/total, "%-saved")
+}
+
+func TestWordsOfLength(t *testing.T) {
+	words := randomWords(1000, 8, "abcdé", 21)
+	root := build(t, words...)
+	root.Optimise()
+	for n := 0; n <= 9; n++ {
+		var want []string
+		for _, word := range root.Words() {
+			if len([]rune(word)) == n {
+				want = append(want, word)
+			}
+		}
+		if got := root.WordsOfLength(n); !equalWords(got, want) {
+			t.Errorf("WordsOfLength(%d) = %q, want %q", n, got, want)
+		}
+	}
+	if got, truncated := root.WordsOfLengthLimited(3, 5); !truncated || len(got) != 5 {
+		t.Errorf("WordsOfLengthLimited(3, 5) = %q, %v, want 5 words, true", got, truncated)
+	}
+}
+
+func TestVerifyFlattening(t *testing.T) {
+	root := build(t, sampleWords...)
+	root.Optimise()
+	if err := root.VerifyFlattening(root.FlatArray()); err != nil {
+		t.Fatalf("VerifyFlattening on an intact array: %v", err)
+	}
+	corruptions := map[string]func(o outarray){
+		"terminal flag cleared": func(o outarray) {
+			for i := range o {
+				if o[i].endofword {
+					o[i].endofword = false
+					return
+				}
+			}
+		},
+		"terminal flag set": func(o outarray) {
+			for i := range o {
+				if !o[i].endofword && i > 0 {
+					o[i].endofword = true
+					return
+				}
+			}
+		},
+		"rune changed": func(o outarray) {
+			o[len(o)-1].val = 'q'
+		},
+		"children moved": func(o outarray) {
+			for i := range o {
+				if o[i].children > 1 {
+					o[i].children--
+					return
+				}
+			}
+		},
+	}
+	for name, corrupt := range corruptions {
+		o := root.FlatArray()
+		corrupt(o)
+		if err := root.VerifyFlattening(o); err == nil {
+			t.Errorf("%s: VerifyFlattening found nothing wrong", name)
+		}
+	}
+}
+
+func TestDiffFiles(t *testing.T) {
+	dir := t.TempDir()
+	oldWords := append([]string{"apple", "banana", "cherry"}, sampleWords...)
+	newWords := append([]string{"banana", "cherries", "damson", "é"}, sampleWords[1:]...)
+	oldRoot := build(t, oldWords...)
+	oldRoot.Optimise()
+	newRoot := build(t, newWords...)
+	newRoot.Optimise()
+	oldPath := filepath.Join(dir, "old.wg")
+	newPath := filepath.Join(dir, "new.wg")
+	writeFlatFile(t, oldRoot.FlatArray(), oldPath)
+	writeFlatFile(t, newRoot.FlatArray(), newPath)
+	added, removed, err := DiffFiles(oldPath, newPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"cherries", "damson", "é"}; !equalWords(added, want) {
+		t.Errorf("added = %q, want %q", added, want)
+	}
+	if want := []string{"apple", "car", "cherry"}; !equalWords(removed, want) {
+		t.Errorf("removed = %q, want %q", removed, want)
+	}
+	if added, removed, err := DiffFiles(oldPath, oldPath); err != nil || added != nil || removed != nil {
+		t.Errorf("DiffFiles of a file with itself = %q, %q, %v", added, removed, err)
+	}
+	if _, _, err := DiffFiles(oldPath, filepath.Join(dir, "missing.wg")); err == nil {
+		t.Errorf("DiffFiles with a missing file succeeded")
+	}
+}
+
+func TestReversedCollation(t *testing.T) {
+	reversed := func(a, b rune) int { return int(b - a) }
+	// A word comes before its extensions; otherwise the runes decide,
+	// in reverse.
+	less := func(a, b string) bool {
+		ra, rb := []rune(a), []rune(b)
+		for i := 0; i < len(ra) && i < len(rb); i++ {
+			if ra[i] != rb[i] {
+				return ra[i] > rb[i]
+			}
+		}
+		return len(ra) < len(rb)
+	}
+	root := build(t, sampleWords...)
+	if err := root.SetCollation(reversed); err != nil {
+		t.Fatal(err)
+	}
+	id := 1000
+	if err := root.Put("bar", &id); err != nil {
+		t.Fatal(err)
+	}
+	want := append([]string{"bar"}, sampleWords...)
+	sort.Slice(want, func(i, j int) bool { return less(want[i], want[j]) })
+	if got := root.Words(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Words under a reversed collation = %q, want %q", got, want)
+	}
+	if got, want := root.Completions("car"), []string{"car", "cart", "carts", "care", "cares", "cared", "card", "cards"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Completions(%q) = %q, want %q", "car", got, want)
+	}
+	root.Optimise()
+	if got := root.Words(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Words after Optimise = %q, want %q", got, want)
+	}
+	if err := root.SetCollation(nil); err == nil {
+		t.Errorf("SetCollation on a minimised graph succeeded")
+	}
+	if err := root.DeMinimize(&id); err != nil {
+		t.Fatal(err)
+	}
+	if err := root.SetCollation(nil); err != nil {
+		t.Fatalf("SetCollation after DeMinimize: %v", err)
+	}
+	sort.Strings(want)
+	if got := root.Words(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Words back in rune order = %q, want %q", got, want)
+	}
+}
+
+func TestWordsWithTerminals(t *testing.T) {
+	words := []string{"cats", "hats", "rats", "cat"}
+	terminals := func(root *treenode) map[string]int {
+		found := make(map[string]int)
+		root.WordsWithTerminals(func(word string, terminalID int) {
+			found[word] = terminalID
+		})
+		return found
+	}
+	root := build(t, words...)
+	before := terminals(root)
+	if before["cats"] == before["hats"] || before["hats"] == before["rats"] {
+		t.Errorf("words share terminal ids before Optimise: %v", before)
+	}
+	root.Optimise()
+	after := terminals(root)
+	if len(after) != len(words) {
+		t.Fatalf("WordsWithTerminals reported %v, want the words %q", after, words)
+	}
+	if after["cats"] != after["hats"] || after["hats"] != after["rats"] {
+		t.Errorf("shared suffixes report different terminal ids: %v", after)
+	}
+	if after["cat"] == after["cats"] {
+		t.Errorf("cat and cats report the same terminal id %d", after["cat"])
+	}
+	if got, want := root.WordsForTerminal(after["hats"]), []string{"cats", "hats", "rats"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("WordsForTerminal(%d) = %q, want %q", after["hats"], got, want)
+	}
+}
+
+func TestPutLongKey(t *testing.T) {
+	long := strings.Repeat("é", 100000)
+	root := build(t, long, long[:len(long)/2], "e")
+	for _, word := range []string{long, long[:len(long)/2], "e"} {
+		if !root.Contains(word) {
+			t.Errorf("Contains of a %d-rune word = false", len([]rune(word)))
+		}
+	}
+	if root.Contains(long[:len(long)/2-2]) {
+		t.Errorf("Contains of a prefix of the long word = true")
+	}
+	id := 1 << 20
+	if ok, err := root.Delete(long, &id); err != nil || !ok {
+		t.Fatalf("Delete of the long word = %v, %v", ok, err)
+	}
+	root.Optimise()
+	if got := root.WordCount(); got != 2 {
+		t.Errorf("WordCount after Delete = %d, want 2", got)
+	}
+}
+
+func TestPutSetsFlagsAtEveryLevel(t *testing.T) {
+	words := randomWords(2000, 8, "abcdef", 22)
+	root := build(t, words...)
+	visited := make(map[*treenode]bool)
+	var walk func(node *treenode)
+	walk = func(node *treenode) {
+		visited[node] = true
+		for child := node.children; child != nil; child = child.next {
+			if first := child == node.children; child.firstchild != first {
+				t.Errorf("node %d: firstchild = %v, want %v", child.id, child.firstchild, first)
+			} else if first && (len(child.parents) != 1 || child.parents[0] != node) {
+				t.Errorf("node %d heads the list of %d but has parents %v", child.id, node.id, child.parents)
+			} else if !first && len(child.parents) != 0 {
+				t.Errorf("node %d follows in a list but has parents %v", child.id, child.parents)
+			}
+			if !visited[child] {
+				walk(child)
+			}
+		}
+	}
+	walk(root)
+	set := make(map[string]bool)
+	for _, word := range words {
+		set[word] = true
+	}
+	root.Optimise()
+	for _, word := range append(words, randomWords(2000, 8, "abcdef", 23)...) {
+		if got := root.Contains(word); got != set[word] {
+			t.Errorf("Contains(%q) after Optimise = %v, want %v", word, got, set[word])
+		}
+	}
+	// The order of insertion must not matter.
+	shuffled := append([]string(nil), words...)
+	rand.New(rand.NewSource(24)).Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+	other := build(t, shuffled...)
+	other.Optimise()
+	if got, want := other.Stats(), root.Stats(); got != want {
+		t.Errorf("Stats of a shuffled build = %+v, want %+v", got, want)
+	}
+}
+
+func TestIsMinimizedTransitions(t *testing.T) {
+	root := NewDAWG()
+	id := 0
+	step := func(name string, do func() error, want bool) {
+		t.Helper()
+		if err := do(); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if got := root.IsMinimized(); got != want {
+			t.Errorf("IsMinimized after %s = %v, want %v", name, got, want)
+		}
+	}
+	optimise := func() error {
+		root.Optimise()
+		return nil
+	}
+	step("NewDAWG", func() error { return nil }, false)
+	step("Put", func() error {
+		for _, word := range sampleWords {
+			if err := root.Put(word, &id); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, false)
+	step("Optimise", optimise, true)
+	step("Put after Optimise", func() error { return root.Put("bar", &id) }, false)
+	step("Optimise again", optimise, true)
+	step("Delete of a missing word", func() error {
+		_, err := root.Delete("missing", &id)
+		return err
+	}, true)
+	step("Delete", func() error {
+		_, err := root.Delete("bar", &id)
+		return err
+	}, false)
+	step("WordsWithSharing", func() error {
+		root.WordsWithSharing(func(string, int, int) {})
+		return nil
+	}, true)
+	step("PutPayload", func() error { return root.PutPayload("car", []byte{1}, &id) }, false)
+	step("Canonicalize", func() error {
+		root.Canonicalize()
+		return nil
+	}, true)
+	step("DeMinimize", func() error { return root.DeMinimize(&id) }, false)
+	step("Finalize", func() error {
+		root.Finalize()
+		return nil
+	}, true)
+	step("Clear", func() error {
+		root.Clear(&id)
+		return nil
+	}, false)
+}
+
+func TestCompactFormatSize(t *testing.T) {
+	root := build(t, randomWords(5000, 9, "abcdefghijklmnopqrstuvwxyz", 25)...)
+	root.Optimise()
+	o := root.FlatArray()
+	var fixed, compact bytes.Buffer
+	fixedSize, err := o.WriteTo(&fixed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compactSize, err := o.WriteCompactTo(&compact)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fixedSize != int64(fixed.Len()) || compactSize != int64(compact.Len()) {
+		t.Errorf("WriteTo and WriteCompactTo reported %d and %d bytes, wrote %d and %d", fixedSize, compactSize, fixed.Len(), compact.Len())
+	}
+	t.Logf("fixed: %d bytes, compact: %d bytes", fixedSize, compactSize)
+	if compactSize*2 > fixedSize {
+		t.Errorf("compact file is %d bytes, want at most half of the fixed file's %d", compactSize, fixedSize)
+	}
+	loaded, err := ReadFlat(&compact)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded, o) {
+		t.Errorf("array read back from the compact format differs")
+	}
+}
+
+func TestNextRunes(t *testing.T) {
+	root := build(t, sampleWords...)
+	root.Optimise()
+	for _, tc := range []struct {
+		prefix string
+		runes  string
+		word   bool
+	}{
+		{"", "cstx", false},
+		{"car", "det", true},
+		{"card", "s", true},
+		{"cards", "", true},
+		{"sta", "r", false},
+		{"star", "st", true},
+		{"q", "", false},
+		{"cardz", "", false},
+	} {
+		runes, word := root.NextRunes(tc.prefix)
+		if string(runes) != tc.runes || word != tc.word {
+			t.Errorf("NextRunes(%q) = %q, %v, want %q, %v", tc.prefix, string(runes), word, tc.runes, tc.word)
+		}
+	}
+	if runes, _ := root.NextRunes("q"); runes != nil {
+		t.Errorf("NextRunes of a missing prefix = %q, want nil", runes)
+	}
+}
+
+func TestLoadFlatRejectsBadCounts(t *testing.T) {
+	root := build(t, sampleWords...)
+	root.Optimise()
+	o := root.FlatArray()
+	var fixed, compact bytes.Buffer
+	if _, err := o.WriteTo(&fixed); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := o.WriteCompactTo(&compact); err != nil {
+		t.Fatal(err)
+	}
+	countAt := len(flatMagic) + 1
+	inflatedFixed := append([]byte(nil), fixed.Bytes()...)
+	binary.LittleEndian.PutUint32(inflatedFixed[countAt:], math.MaxUint32)
+	inflatedCompact := append([]byte(nil), compact.Bytes()[:countAt]...)
+	inflatedCompact = binary.AppendUvarint(inflatedCompact, 1<<40)
+	_, n := binary.Uvarint(compact.Bytes()[countAt:])
+	inflatedCompact = append(inflatedCompact, compact.Bytes()[countAt+n:]...)
+	files := map[string][]byte{
+		"fixed, inflated count":   inflatedFixed,
+		"fixed, extra bytes":      append(append([]byte(nil), fixed.Bytes()...), 0, 0, 0),
+		"fixed, truncated":        fixed.Bytes()[:fixed.Len()-1],
+		"compact, inflated count": inflatedCompact,
+		"compact, truncated":      compact.Bytes()[:compact.Len()-1],
+	}
+	dir := t.TempDir()
+	for name, data := range files {
+		filename := filepath.Join(dir, "dict.wg")
+		if err := os.WriteFile(filename, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		if _, err := LoadFlat(filename); err == nil {
+			t.Errorf("%s: LoadFlat succeeded", name)
+		}
+		// Without the size of the file ReadFlat cannot see bytes
+		// after the records, but it must not trust the count either.
+		if _, err := ReadFlat(bytes.NewReader(data)); err == nil && name != "fixed, extra bytes" {
+			t.Errorf("%s: ReadFlat succeeded", name)
+		}
+		runtime.ReadMemStats(&after)
+		if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<22 {
+			t.Errorf("%s: %d bytes allocated for a file of %d bytes", name, allocated, len(data))
+		}
+	}
+}
+
+// BenchmarkFuzzySearchParallel compares the serial search with the
+// parallel one, which fans out over the children of the root.
+func BenchmarkFuzzySearchParallel(b *testing.B) {
+	root := build(b, randomWords(200000, 9, "abcdefghijklmnopqrstuvwxyz", 26)...)
+	queries := randomWords(50, 9, "abcdefghijklmnopqrstuvwxyz", 27)
+	b.Run("serial", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			root.FuzzySearch(queries[i%len(queries)], 2)
+		}
+	})
+	b.Run("parallel", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			root.FuzzySearchParallel(queries[i%len(queries)], 2, 0)
+		}
+	})
+}
+
+func TestCanonicalizeIsReproducible(t *testing.T) {
+	var words []string
+	for _, word := range randomWords(3000, 8, "abcdef", 28) {
+		if !containsString(words, word) {
+			words = append(words, word)
+		}
+	}
+	flat := func(root *treenode) []byte {
+		t.Helper()
+		var buf bytes.Buffer
+		if _, err := root.FlatArray().WriteTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	sorted := build(t, words...)
+	sorted.Canonicalize()
+	want := flat(sorted)
+	shuffled := append([]string(nil), words...)
+	rand.New(rand.NewSource(29)).Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+	other := build(t, shuffled...)
+	other.Canonicalize()
+	if !bytes.Equal(flat(other), want) {
+		t.Errorf("a shuffled build canonicalizes to different bytes")
+	}
+	if !reflect.DeepEqual(ids(other), ids(sorted)) {
+		t.Errorf("a shuffled build canonicalizes to different ids")
+	}
+	// Changes after Optimise leave lists shared in an order that
+	// depends on the changes; Canonicalize must not.
+	changed := build(t, shuffled[:len(shuffled)/2]...)
+	changed.Optimise()
+	id := 1 << 20
+	for _, word := range append(shuffled[len(shuffled)/2:], "zzz") {
+		if err := changed.Put(word, &id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := changed.Delete("zzz", &id); err != nil {
+		t.Fatal(err)
+	}
+	changed.Canonicalize()
+	if !bytes.Equal(flat(changed), want) {
+		t.Errorf("a graph changed after Optimise canonicalizes to different bytes")
+	}
+}
+
+func TestFromReaderSplit(t *testing.T) {
+	commas := func(data []byte, atEOF bool) (int, []byte, error) {
+		if i := bytes.IndexByte(data, ','); i >= 0 {
+			return i + 1, data[:i], nil
+		}
+		if atEOF && len(data) > 0 {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
+	}
+	d, err := FromReader(strings.NewReader("pear,apple,fig tree,apple"), commas)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := d.Words(), []string{"apple", "fig tree", "pear"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Words split on commas = %q, want %q", got, want)
+	}
+	if got := d.Frequency("apple"); got != 2 {
+		t.Errorf("Frequency(%q) = %d, want 2", "apple", got)
+	}
+	d, err = FromReader(strings.NewReader("pear apple\tfig\n tree"), bufio.ScanWords)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := d.Words(), []string{"apple", "fig", "pear", "tree"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Words split with ScanWords = %q, want %q", got, want)
+	}
+}
+
+func TestDepthAndHeight(t *testing.T) {
+	root := build(t, sampleWords...)
+	root.Optimise()
+	for _, tc := range []struct {
+		word          string
+		depth, height int
+		ok            bool
+	}{
+		{"car", 3, 2, true}, // cards, cared, cares, carts
+		{"card", 4, 1, true},
+		{"cards", 5, 0, true},
+		{"star", 4, 1, true},
+		{"tar", 3, 1, true},
+		{"xyz", 3, 0, true},
+		{"ca", 0, 0, false},
+		{"dog", 0, 0, false},
+	} {
+		depth, ok := root.Depth(tc.word)
+		if depth != tc.depth || ok != tc.ok {
+			t.Errorf("Depth(%q) = %d, %v, want %d, %v", tc.word, depth, ok, tc.depth, tc.ok)
+		}
+		height, ok := root.Height(tc.word)
+		if height != tc.height || ok != tc.ok {
+			t.Errorf("Height(%q) = %d, %v, want %d, %v", tc.word, height, ok, tc.height, tc.ok)
+		}
+	}
+	id := 1000
+	if err := root.Put("carpeted", &id); err != nil {
+		t.Fatal(err)
+	}
+	if height, _ := root.Height("car"); height != 5 {
+		t.Errorf("Height(%q) after putting carpeted = %d, want 5", "car", height)
+	}
+}
+
+func TestFrequencies(t *testing.T) {
+	root := build(t, "bats", "hats", "cats", "cats", "rats", "rats", "rats", "mats")
+	id := 1000
+	if err := root.AddWithCount("mats", 2, &id); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int{"bats": 1, "hats": 1, "cats": 2, "rats": 3, "mats": 3, "bat": 0, "dogs": 0}
+	check := func(stage string) {
+		t.Helper()
+		for word, n := range want {
+			if got := root.Frequency(word); got != n {
+				t.Errorf("%s: Frequency(%q) = %d, want %d", stage, word, got, n)
+			}
+		}
+	}
+	check("built")
+	root.Optimise()
+	check("optimised")
+	terminals := make(map[string]int)
+	root.WordsWithTerminals(func(word string, terminalID int) {
+		terminals[word] = terminalID
+	})
+	// Words put as often share their tails; the others must not.
+	if terminals["bats"] != terminals["hats"] {
+		t.Errorf("bats and hats, both put once, do not share their terminal")
+	}
+	if terminals["rats"] != terminals["mats"] {
+		t.Errorf("rats and mats, both put three times, do not share their terminal")
+	}
+	if terminals["cats"] == terminals["bats"] || terminals["cats"] == terminals["rats"] {
+		t.Errorf("cats shares its terminal with a word of another frequency")
+	}
+	if err := root.AddWithCount("cats", 0, &id); err == nil {
+		t.Errorf("AddWithCount with a count of 0 succeeded")
+	}
+}
+
+func TestCompletionsRanked(t *testing.T) {
+	root := NewDAWG()
+	id := 0
+	counts := map[string]int{"car": 5, "card": 9, "care": 5, "cart": 1, "cat": 9, "dog": 20}
+	for word, n := range counts {
+		if err := root.AddWithCount(word, n, &id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := root.CompletionsRanked("ca", 0), []string{"card", "cat", "car", "care", "cart"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("CompletionsRanked(%q, 0) = %q, want %q", "ca", got, want)
+	}
+	if got, want := root.CompletionsRanked("ca", 3), []string{"card", "cat", "car"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("CompletionsRanked(%q, 3) = %q, want %q", "ca", got, want)
+	}
+	if got := root.CompletionsRanked("x", 3); got != nil {
+		t.Errorf("CompletionsRanked of a missing prefix = %q, want nil", got)
+	}
+	// Against sorting every completion, on random frequencies.
+	rng := rand.New(rand.NewSource(30))
+	root = NewDAWG()
+	counts = make(map[string]int)
+	for _, word := range randomWords(2000, 6, "abcd", 31) {
+		n := 1 + rng.Intn(10)
+		if err := root.AddWithCount(word, n, &id); err != nil {
+			t.Fatal(err)
+		}
+		counts[word] += n
+	}
+	root.Optimise()
+	for _, prefix := range []string{"", "a", "bc", "dda"} {
+		all := root.Completions(prefix)
+		sort.SliceStable(all, func(i, j int) bool { return counts[all[i]] > counts[all[j]] })
+		for _, limit := range []int{1, 5, 50, 0} {
+			want := all
+			if limit > 0 && limit < len(all) {
+				want = all[:limit]
+			}
+			if got := root.CompletionsRanked(prefix, limit); !equalWords(got, want) {
+				t.Errorf("CompletionsRanked(%q, %d) = %q, want %q", prefix, limit, got, want)
+			}
+		}
+	}
+}
+
+func TestSetAlphabet(t *testing.T) {
+	root := NewDAWG()
+	root.SetAlphabet(func(r rune) bool { return r >= 'a' && r <= 'z' })
+	id := 0
+	var rejected []string
+	for _, word := range []string{"apple", "Apple", "pear", "café", "fig1", "plum", "fig"} {
+		if err := root.Put(word, &id); errors.Is(err, ErrNotInAlphabet) {
+			rejected = append(rejected, word)
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want := []string{"Apple", "café", "fig1"}; !reflect.DeepEqual(rejected, want) {
+		t.Errorf("rejected %q, want %q", rejected, want)
+	}
+	if got, want := root.Words(), []string{"apple", "fig", "pear", "plum"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Words = %q, want %q", got, want)
+	}
+	// A rejected word leaves no nodes behind.
+	if got, want := root.Stats().Nodes, build(t, "apple", "fig", "pear", "plum").Stats().Nodes; got != want {
+		t.Errorf("%d nodes after the rejections, want %d", got, want)
+	}
+	if err := root.Replace("fig", "Fig", &id); !errors.Is(err, ErrNotInAlphabet) || !root.Contains("fig") {
+		t.Errorf("Replace to an invalid word: %v, fig kept: %v", err, root.Contains("fig"))
+	}
+	root.SetAlphabet(nil)
+	if err := root.Put("Fig", &id); err != nil {
+		t.Errorf("Put after SetAlphabet(nil): %v", err)
+	}
+}
+
+func TestWordsForTerminal(t *testing.T) {
+	root := build(t, randomWords(2000, 6, "abcd", 32)...)
+	root.Optimise()
+	byTerminal := make(map[int][]string)
+	root.WordsWithTerminals(func(word string, terminalID int) {
+		byTerminal[terminalID] = append(byTerminal[terminalID], word)
+	})
+	shared := 0
+	for id, want := range byTerminal {
+		if len(want) > 1 {
+			shared++
+		}
+		if got := root.WordsForTerminal(id); !reflect.DeepEqual(got, want) {
+			t.Errorf("WordsForTerminal(%d) = %q, want %q", id, got, want)
+		}
+	}
+	if shared == 0 {
+		t.Errorf("no terminal is shared by several words")
+	}
+	if got := root.WordsForTerminal(-2); got != nil {
+		t.Errorf("WordsForTerminal of a missing id = %q, want nil", got)
+	}
+}
+
+func TestDebugChecksCatchCycles(t *testing.T) {
+	defer func(old bool) { DebugChecks = old }(DebugChecks)
+	DebugChecks = true
+	root := build(t, "ab", "abc", "b")
+	root.Optimise() // Nothing goes wrong on a sound graph.
+	a := root.find("a")
+	b := root.find("ab")
+	defer func() {
+		if r := recover(); r == nil || !strings.Contains(fmt.Sprint(r), "cycle") {
+			t.Errorf("redirecting a node to its ancestor: panic %v, want one about a cycle", r)
+		}
+	}()
+	// b heads the list of a; pointing a at a list that reaches a
+	// would make a cycle.
+	b.redirect(a)
+}
+
+func TestSerializedSize(t *testing.T) {
+	withPayloads := build(t, sampleWords...)
+	id := 1000
+	if err := withPayloads.PutPayload("star", bytes.Repeat([]byte{7}, 300), &id); err != nil {
+		t.Fatal(err)
+	}
+	if err := withPayloads.AddWithCount("cart", 200, &id); err != nil {
+		t.Fatal(err)
+	}
+	graphs := map[string]*treenode{
+		"empty":         NewDAWG(),
+		"plain":         build(t, randomWords(3000, 8, "abcdefé日", 33)...),
+		"with payloads": withPayloads,
+	}
+	for name, root := range graphs {
+		root.Optimise()
+		o := root.FlatArray()
+		var fixed, compact bytes.Buffer
+		if _, err := o.WriteTo(&fixed); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := o.WriteCompactTo(&compact); err != nil {
+			t.Fatal(err)
+		}
+		if got := o.SerializedSize(); got != int64(fixed.Len()) {
+			t.Errorf("%s: SerializedSize = %d, WriteTo wrote %d bytes", name, got, fixed.Len())
+		}
+		if got := o.CompactSerializedSize(); got != int64(compact.Len()) {
+			t.Errorf("%s: CompactSerializedSize = %d, WriteCompactTo wrote %d bytes", name, got, compact.Len())
+		}
+	}
+}
+
+// BenchmarkDeepEnumeration enumerates a dictionary of long words with
+// multi-byte runes, where building every word from scratch would cost
+// an allocation per rune.
+func BenchmarkDeepEnumeration(b *testing.B) {
+	words := randomWords(2000, 60, "aбвг日本", 34)
+	for i := range words {
+		words[i] = strings.Repeat("ж", 40) + words[i]
+	}
+	root := build(b, words...)
+	root.Optimise()
+	b.Run("Words", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			root.Words()
+		}
+	})
+	b.Run("Completions", func(b *testing.B) {
+		b.ReportAllocs()
+		prefix := strings.Repeat("ж", 40) + "б"
+		for i := 0; i < b.N; i++ {
+			root.Completions(prefix)
+		}
+	})
+}
+
+func TestPayloadsRoundtrip(t *testing.T) {
+	payloads := map[string][]byte{
+		"bats": []byte("same"),
+		"hats": []byte("same"),
+		"cats": []byte("other"),
+		"rats": bytes.Repeat([]byte{0, 255}, 200),
+		"mats": {},
+	}
+	d := NewDictionary()
+	for word, data := range payloads {
+		if err := d.PutPayload(word, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d.Optimise()
+	terminals := make(map[string]int)
+	d.root.WordsWithTerminals(func(word string, terminalID int) {
+		terminals[word] = terminalID
+	})
+	if terminals["bats"] != terminals["hats"] {
+		t.Errorf("bats and hats, with equal payloads, do not share their terminal")
+	}
+	if terminals["cats"] == terminals["bats"] || terminals["rats"] == terminals["bats"] {
+		t.Errorf("words with different payloads share their terminal")
+	}
+	filename := filepath.Join(t.TempDir(), "dict.wg")
+	if err := d.Save(filename); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadDictionary(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for word, want := range payloads {
+		if got, ok := loaded.GetPayload(word); !ok || !bytes.Equal(got, want) {
+			t.Errorf("GetPayload(%q) after LoadDictionary = %q, %v, want %q", word, got, ok, want)
+		}
+	}
+	if _, ok := loaded.GetPayload("bat"); ok {
+		t.Errorf("GetPayload of a prefix found a payload")
+	}
+}
+
+func TestValidateFlagsDuplicateSiblings(t *testing.T) {
+	root := build(t, "ab", "ac", "b")
+	if err := root.Validate(); err != nil {
+		t.Fatalf("Validate on a sound graph: %v", err)
+	}
+	a := root.find("a")
+	id := 1000
+	duplicate, err := newNode('b', &id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	duplicate.endofword = true
+	duplicate.next = a.children.next
+	a.children.next = duplicate
+	if err := root.Validate(); err == nil || !strings.Contains(err.Error(), "two children") {
+		t.Errorf("Validate with two children labelled b: %v", err)
+	}
+	defer func(old bool) { DebugChecks = old }(DebugChecks)
+	DebugChecks = true
+	defer func() {
+		if r := recover(); r == nil {
+			t.Errorf("Put through the broken node did not panic under DebugChecks")
+		}
+	}()
+	root.Put("abd", &id)
+}
+
+func TestEdgesBFS(t *testing.T) {
+	type edge struct {
+		from, to int
+		label    rune
+		final    bool
+	}
+	edges := func(root *treenode) []edge {
+		var found []edge
+		root.EdgesBFS(func(from, to int, label rune, final bool) {
+			found = append(found, edge{from, to, label, final})
+		})
+		return found
+	}
+	trie := build(t, "ab", "ac", "b", "bad")
+	want := []edge{
+		{0, 1, 'a', false}, {0, 2, 'b', true},
+		{1, 3, 'b', true}, {1, 4, 'c', true}, {2, 5, 'a', false},
+		{5, 6, 'd', true},
+	}
+	if got := edges(trie); !reflect.DeepEqual(got, want) {
+		t.Errorf("EdgesBFS on a trie = %v, want %v", got, want)
+	}
+	// The shared c keeps the number it got under a.
+	dawg := build(t, "ac", "bc")
+	dawg.Optimise()
+	want = []edge{{0, 1, 'a', false}, {0, 2, 'b', false}, {1, 3, 'c', true}, {2, 3, 'c', true}}
+	if got := edges(dawg); !reflect.DeepEqual(got, want) {
+		t.Errorf("EdgesBFS on a minimised graph = %v, want %v", got, want)
+	}
+}
+
+func TestBuildFlatSorted(t *testing.T) {
+	words := randomWords(5000, 8, "abcdefé", 35)
+	sorted := append([]string(nil), words...)
+	sort.Strings(sorted)
+	o, err := BuildFlatSorted(strings.NewReader(strings.Join(sorted, "\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyFlat(o); err != nil {
+		t.Fatalf("VerifyFlat: %v", err)
+	}
+	root := build(t, words...)
+	var got []string
+	o.eachWord(func(word []rune, node arraynode) error {
+		got = append(got, string(word))
+		return nil
+	})
+	if want := root.Words(); !reflect.DeepEqual(got, want) {
+		t.Errorf("BuildFlatSorted holds %d words, want the %d distinct input words", len(got), len(want))
+	}
+	for _, word := range append(words, randomWords(5000, 9, "abcdefé", 36)...) {
+		if o.ContainsFlat(word) != root.Contains(word) {
+			t.Errorf("ContainsFlat(%q) = %v", word, o.ContainsFlat(word))
+		}
+	}
+	if _, err := BuildFlatSorted(strings.NewReader("b\na\n")); err == nil {
+		t.Errorf("BuildFlatSorted accepted unsorted input")
+	}
+}
+
+// BenchmarkBuildFlat compares the memory that BuildFlatSorted holds at
+// the end of a build with what the tree holds before FlatArray, in the
+// build, Optimise and flatten pipeline.
+func BenchmarkBuildFlat(b *testing.B) {
+	words := randomWords(20000, 10, "abcdefghijklmnopqrstuvwxyz", 37)
+	sort.Strings(words)
+	input := strings.Join(words, "\n")
+	live := func() float64 {
+		var stats runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&stats)
+		return float64(stats.HeapAlloc)
+	}
+	b.Run("BuildFlatSorted", func(b *testing.B) {
+		b.ReportAllocs()
+		var held float64
+		for i := 0; i < b.N; i++ {
+			start := live()
+			o, err := BuildFlatSorted(strings.NewReader(input))
+			if err != nil {
+				b.Fatal(err)
+			}
+			held += live() - start
+			runtime.KeepAlive(o)
+		}
+		b.ReportMetric(held/float64(b.N), "live-B/op")
+	})
+	b.Run("Optimise", func(b *testing.B) {
+		b.ReportAllocs()
+		var held float64
+		for i := 0; i < b.N; i++ {
+			start := live()
+			root := build(b, words...)
+			root.Optimise()
+			held += live() - start
+			o := root.FlatArray()
+			runtime.KeepAlive(o)
+		}
+		b.ReportMetric(held/float64(b.N), "live-B/op")
+	})
+}
+
+func TestCachedDerivedData(t *testing.T) {
+	var cache CachedDerivedData
+	root := build(t, sampleWords...)
+	root.Optimise()
+	if hit, err := cache.Refresh(root, 0.01); err != nil || hit {
+		t.Fatalf("first Refresh = %v, %v, want a miss", hit, err)
+	}
+	flat := cache.Flat
+	// The same words put in another order make the same graph.
+	reversed := make([]string, len(sampleWords))
+	for i, word := range sampleWords {
+		reversed[len(reversed)-1-i] = word
+	}
+	rebuilt := build(t, reversed...)
+	rebuilt.Optimise()
+	if hit, err := cache.Refresh(rebuilt, 0.01); err != nil || !hit {
+		t.Errorf("Refresh after an unchanged rebuild = %v, %v, want a hit", hit, err)
+	}
+	if !reflect.DeepEqual(cache.Flat, flat) || cache.WordCount != len(sampleWords) {
+		t.Errorf("a cache hit changed the cached data")
+	}
+	if hit, _ := cache.Refresh(rebuilt, 0.001); hit {
+		t.Errorf("Refresh with another false-positive rate hit the cache")
+	}
+	id := 1000
+	if err := rebuilt.Put("zebra", &id); err != nil {
+		t.Fatal(err)
+	}
+	if hit, _ := cache.Refresh(rebuilt, 0.001); hit {
+		t.Errorf("Refresh after Put hit the cache")
+	}
+	if cache.WordCount != len(sampleWords)+1 || !cache.Flat.ContainsFlat("zebra") || !cache.Bloom.MayContain("zebra") {
+		t.Errorf("data refreshed after Put does not hold the new word")
+	}
+}
+
+func TestPayloadPolicyUnderNormalization(t *testing.T) {
+	stripAccents := strings.NewReplacer("é", "e", "É", "E").Replace
+	for _, tc := range []struct {
+		policy PayloadPolicy
+		want   string
+		err    error
+	}{
+		{PayloadKeepLast, "plain", nil},
+		{PayloadKeepFirst, "accented", nil},
+		{PayloadError, "accented", ErrPayloadCollision},
+	} {
+		root := NewDAWG()
+		root.SetNormalizer(stripAccents)
+		root.SetPayloadPolicy(tc.policy)
+		id := 0
+		if err := root.PutPayload("résumé", []byte("accented"), &id); err != nil {
+			t.Fatal(err)
+		}
+		if err := root.PutPayload("resume", []byte("plain"), &id); !errors.Is(err, tc.err) {
+			t.Errorf("policy %d: second PutPayload: %v, want %v", tc.policy, err, tc.err)
+		}
+		for _, word := range []string{"résumé", "resume"} {
+			if got, ok := root.GetPayload(word); !ok || string(got) != tc.want {
+				t.Errorf("policy %d: GetPayload(%q) = %q, %v, want %q", tc.policy, word, got, ok, tc.want)
+			}
+		}
+		if got, want := root.Words(), []string{"resume"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("policy %d: Words = %q, want %q", tc.policy, got, want)
+		}
+	}
+}
+
+func TestMergeReport(t *testing.T) {
+	defer func(old bool) { ReportMerges = old }(ReportMerges)
+	ReportMerges = true
+	for name, optimise := range map[string]func(*treenode){
+		"Optimise":          (*treenode).Optimise,
+		"OptimiseLowMemory": (*treenode).OptimiseLowMemory,
+	} {
+		// Ids in order of creation: a 0, c 1, b 2, c 3, d 4, c 5.
+		root := build(t, "ac", "bc", "dc")
+		optimise(root)
+		if got, want := root.MergeReport(), map[int][]int{1: {3, 5}}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: MergeReport = %v, want %v", name, got, want)
+		}
+	}
+	ReportMerges = false
+	root := build(t, "ac", "bc", "dc")
+	root.Optimise()
+	if got := root.MergeReport(); got != nil {
+		t.Errorf("MergeReport without ReportMerges = %v, want nil", got)
+	}
+}
+
+// TestConcurrentLazyQueries is meant for the race detector: the
+// queries that compute levels and heights on first use must not race
+// with each other, on an optimised graph or once it has changed.
+func TestConcurrentLazyQueries(t *testing.T) {
+	root := build(t, append(randomWords(2000, 7, "abcdef", 38), "card")...)
+	root.Optimise()
+	queries := func(stage string, maxLen int) {
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(3)
+			go func() {
+				defer wg.Done()
+				if err := root.WriteDot(io.Discard); err != nil {
+					t.Error(err)
+				}
+			}()
+			go func() {
+				defer wg.Done()
+				if got := root.MaxWordLength(); got != maxLen {
+					t.Errorf("%s: MaxWordLength = %d, want %d", stage, got, maxLen)
+				}
+			}()
+			go func() {
+				defer wg.Done()
+				if _, ok := root.Height("card"); !ok {
+					t.Errorf("%s: Height(%q) found no word", stage, "card")
+				}
+			}()
+		}
+		wg.Wait()
+	}
+	queries("optimised", 7)
+	id := 1 << 20
+	if err := root.Put("cardigans", &id); err != nil { // Drops the annotations.
+		t.Fatal(err)
+	}
+	queries("after Put", 9)
+}
+
+func TestTransitionTable(t *testing.T) {
+	words := randomWords(2000, 7, "abcdeé", 39)
+	root := build(t, words...)
+	root.Optimise()
+	table := root.TransitionTable()
+	if got, want := table.States, root.Stats().Nodes; got != want {
+		t.Errorf("%d states, want one per node, %d", got, want)
+	}
+	// A plain interpreter of the table, independent of Accepts.
+	run := func(word string) bool {
+		state := 0
+		for _, char := range word {
+			column, ok := table.Columns[char]
+			if !ok {
+				return false
+			}
+			if state, ok = table.Delta[state][column]; !ok {
+				return false
+			}
+		}
+		return table.Accepting[state]
+	}
+	for _, word := range append(words, randomWords(2000, 8, "abcdeéz", 40)...) {
+		want := root.Contains(word)
+		if got := run(word); got != want {
+			t.Errorf("the table run on %q gives %v, want %v", word, got, want)
+		}
+		if got := table.Accepts(word); got != want {
+			t.Errorf("Accepts(%q) = %v, want %v", word, got, want)
+		}
+	}
+	if got, want := string(table.Alphabet), "abcdeé"; got != want {
+		t.Errorf("Alphabet = %q, want %q", got, want)
+	}
+}
+
+func TestArrayDotEdges(t *testing.T) {
+	words := randomWords(500, 6, "abcdé", 41)
+	root := build(t, words...)
+	root.Optimise()
+	prefixes := make(map[string]bool)
+	for _, word := range root.Words() {
+		runes := []rune(word)
+		for i := 1; i <= len(runes); i++ {
+			prefixes[string(runes[:i])] = true
+		}
+	}
+	dir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(dir)
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	nodeLine := regexp.MustCompile(`(?m)^\t(\d+) \[label="(.)"\];$`)
+	edgeLine := regexp.MustCompile(`(?m)^(\d+) -> (\d+);$`)
+	for _, layout := range []FlatLayout{BreadthFirst, DepthFirst} {
+		root.FlatArrayLayout(layout).createDot()
+		data, err := os.ReadFile("array6.dot")
+		if err != nil {
+			t.Fatal(err)
+		}
+		labels := make(map[string]string)
+		for _, node := range nodeLine.FindAllStringSubmatch(string(data), -1) {
+			labels[node[1]] = node[2]
+		}
+		edges := make(map[string][]string)
+		seen := make(map[string]bool)
+		for _, edge := range edgeLine.FindAllStringSubmatch(string(data), -1) {
+			if seen[edge[0]] {
+				t.Errorf("layout %v: edge %s drawn twice", layout, edge[0])
+			}
+			seen[edge[0]] = true
+			edges[edge[1]] = append(edges[edge[1]], edge[2])
+		}
+		// Every path from the root must spell a prefix of a word, and
+		// every prefix must be spelled by a path.
+		got := make(map[string]bool)
+		var walk func(node, path string)
+		walk = func(node, path string) {
+			for _, child := range edges[node] {
+				p := path + labels[child]
+				got[p] = true
+				walk(child, p)
+			}
+		}
+		walk("0", "")
+		if !reflect.DeepEqual(got, prefixes) {
+			t.Errorf("layout %v: the edges spell %d prefixes, want %d", layout, len(got), len(prefixes))
+		}
+	}
+}
+
+func TestUpdateLog(t *testing.T) {
+	dir := t.TempDir()
+	server := NewDictionary()
+	for _, word := range sampleWords {
+		if err := server.Add(word); err != nil {
+			t.Fatal(err)
+		}
+	}
+	server.Optimise()
+	snapshot := filepath.Join(dir, "base.wg")
+	if err := server.Save(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	// Changes after the snapshot.
+	for _, word := range []string{"bar", "bars", "car"} {
+		if err := server.Add(word); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := server.Delete("xyz"); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Replace("tart", "tarot"); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.PutPayload("star", []byte("★")); err != nil {
+		t.Fatal(err)
+	}
+	var log bytes.Buffer
+	if err := server.WriteLog(&log); err != nil {
+		t.Fatal(err)
+	}
+	client, err := LoadDictionary(snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.ApplyLog(bytes.NewReader(log.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := client.Words(), server.Words(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Words after ApplyLog = %q, want %q", got, want)
+	}
+	for _, word := range server.Words() {
+		if got, want := client.Frequency(word), server.Frequency(word); got != want {
+			t.Errorf("Frequency(%q) after ApplyLog = %d, want %d", word, got, want)
+		}
+	}
+	if payload, ok := client.GetPayload("star"); !ok || string(payload) != "★" {
+		t.Errorf("GetPayload(%q) after ApplyLog = %q, %v", "star", payload, ok)
+	}
+	client.Optimise()
+	server.Optimise()
+	if got, want := client.Stats(), server.Stats(); got != want {
+		t.Errorf("Stats after ApplyLog and Optimise = %+v, want %+v", got, want)
+	}
+	// A broken log changes nothing.
+	before := client.Words()
+	for name, data := range map[string][]byte{
+		"truncated":   log.Bytes()[:log.Len()-1],
+		"bad magic":   append([]byte("XXXX"), log.Bytes()[4:]...),
+		"bad version": append(append([]byte(logMagic), 99), log.Bytes()[len(logMagic)+1:]...),
+	} {
+		if err := client.ApplyLog(bytes.NewReader(data)); err == nil {
+			t.Errorf("%s: ApplyLog succeeded", name)
+		}
+		if got := client.Words(); !reflect.DeepEqual(got, before) {
+			t.Errorf("%s: a failed ApplyLog changed the words", name)
+		}
+	}
+}
+
+func TestCommonPrefix(t *testing.T) {
+	root := build(t, append([]string{"résumé", "résister"}, sampleWords...)...)
+	root.Optimise()
+	for _, tc := range []struct{ a, b, want string }{
+		{"cards", "cared", "car"},
+		{"cards", "cards", "cards"}, // The same word.
+		{"card", "cards", "card"},
+		{"star", "tar", ""}, // No common prefix.
+		{"résumé", "résister", "rés"},
+		{"carpet", "carpool", "car"}, // Both leave the graph after car.
+		{"", "car", ""},
+	} {
+		if got := root.CommonPrefix(tc.a, tc.b); got != tc.want {
+			t.Errorf("CommonPrefix(%q, %q) = %q, want %q", tc.a, tc.b, got, tc.want)
+		}
+	}
+}
+
+// BenchmarkContainsFlatLayout compares lookups in the breadth-first
+// and the depth-first array layouts.
+func BenchmarkContainsFlatLayout(b *testing.B) {
+	words := randomWords(100000, 12, "abcdefghijklmnopqrstuvwxyz", 42)
+	root := build(b, words...)
+	probes := append(words[:5000], randomWords(5000, 12, "abcdefghijklmnopqrstuvwxyz", 43)...)
+	for _, layout := range []FlatLayout{BreadthFirst, DepthFirst} {
+		o := root.FlatArrayLayout(layout)
+		name := "BreadthFirst"
+		if layout == DepthFirst {
+			name = "DepthFirst"
+		}
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				o.ContainsFlat(probes[i%len(probes)])
+			}
+		})
+	}
+}
+
+func TestAllPrefixesOf(t *testing.T) {
+	root := build(t, "new", "news", "newspaper", "newspapers", "paper", "n")
+	root.Optimise()
+	for _, tc := range []struct {
+		s    string
+		want []string
+	}{
+		{"newspapers", []string{"n", "new", "news", "newspaper", "newspapers"}},
+		{"newspaperman", []string{"n", "new", "news", "newspaper"}},
+		{"newt", []string{"n", "new"}},
+		{"paper", []string{"paper"}},
+		{"ne", []string{"n"}},
+		{"xyz", nil},
+		{"", nil},
+	} {
+		if got := root.AllPrefixesOf(tc.s); !equalWords(got, tc.want) {
+			t.Errorf("AllPrefixesOf(%q) = %q, want %q", tc.s, got, tc.want)
+		}
+	}
+	id := 1000
+	if err := root.Put("", &id); err != nil {
+		t.Fatal(err)
+	}
+	if got := root.AllPrefixesOf("ne"); !equalWords(got, []string{"", "n"}) {
+		t.Errorf("AllPrefixesOf(%q) with the empty word = %q, want [\"\" \"n\"]", "ne", got)
+	}
+}
+
+func TestOptimiseLowMemoryMatchesOptimise(t *testing.T) {
+	for seed := int64(0); seed < 20; seed++ {
+		words := randomWords(1000, 8, "abcdé", 100+seed)
+		root := build(t, words...)
+		root.Optimise()
+		low := build(t, words...)
+		low.OptimiseLowMemory()
+		if got, want := low.Stats(), root.Stats(); got != want {
+			t.Errorf("seed %d: Stats after OptimiseLowMemory = %+v, after Optimise %+v", seed, got, want)
+		}
+		if !reflect.DeepEqual(low.Words(), root.Words()) {
+			t.Errorf("seed %d: OptimiseLowMemory changed the words", seed)
+		}
+		if err := low.Validate(); err != nil {
+			t.Errorf("seed %d: Validate after OptimiseLowMemory: %v", seed, err)
+		}
+	}
+}
+
+// BenchmarkSearcher compares the allocations of a Searcher's queries
+// with those of the same queries on the graph.
+func BenchmarkSearcher(b *testing.B) {
+	words := randomWords(50000, 9, "abcdefghijklmnopqrstuvwxyz", 44)
+	root := build(b, words...)
+	root.Finalize()
+	searcher, err := root.NewSearcher()
+	if err != nil {
+		b.Fatal(err)
+	}
+	queries := randomWords(100, 9, "abcdefghijklmnopqrstuvwxyz", 45)
+	b.Run("graph/FuzzySearch", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			root.FuzzySearch(queries[i%len(queries)], 1)
+		}
+	})
+	b.Run("searcher/FuzzySearch", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			searcher.FuzzySearch(queries[i%len(queries)], 1)
+		}
+	})
+	b.Run("graph/Completions", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			root.Completions(queries[i%len(queries)][:1])
+		}
+	})
+	b.Run("searcher/Completions", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			searcher.Completions(queries[i%len(queries)][:1])
+		}
+	})
+}
+
+func TestMaxWordLength(t *testing.T) {
+	if got := NewDAWG().MaxWordLength(); got != 0 {
+		t.Errorf("MaxWordLength of an empty graph = %d, want 0", got)
+	}
+	if got := build(t, "").MaxWordLength(); got != 0 {
+		t.Errorf("MaxWordLength with only the empty word = %d, want 0", got)
+	}
+	root := build(t, append([]string{"日本語テキスト"}, sampleWords...)...)
+	if got := root.MaxWordLength(); got != 7 {
+		t.Errorf("MaxWordLength = %d, want 7", got)
+	}
+	root.Optimise()
+	if got := root.MaxWordLength(); got != 7 {
+		t.Errorf("MaxWordLength after Optimise = %d, want 7", got)
+	}
+	id := 1000
+	if _, err := root.Delete("日本語テキスト", &id); err != nil {
+		t.Fatal(err)
+	}
+	if got := root.MaxWordLength(); got != 5 {
+		t.Errorf("MaxWordLength after deleting the longest word = %d, want 5", got)
+	}
+	if got, ok := root.LongestWord(); !ok || got != "cards" {
+		t.Errorf("LongestWord = %q, %v, want %q, true", got, ok, "cards")
+	}
+}
+
+func TestColumnArray(t *testing.T) {
+	words := randomWords(3000, 8, "abcdeé日", 46)
+	root := build(t, words...)
+	root.Optimise()
+	o := root.FlatArray()
+	c := root.ColumnArray()
+	for _, word := range append(append(words, randomWords(3000, 9, "abcdeé日x", 47)...), "") {
+		want := root.Contains(word)
+		if got := c.ContainsSOA(word); got != want {
+			t.Errorf("ContainsSOA(%q) = %v, want %v", word, got, want)
+		}
+		if got := o.ContainsFlat(word); got != want {
+			t.Errorf("ContainsFlat(%q) = %v, want %v", word, got, want)
+		}
+	}
+}
+
+// BenchmarkColumnArray compares bulk lookups in the records
+// with lookups in the columns.
+func BenchmarkColumnArray(b *testing.B) {
+	words := randomWords(100000, 10, "abcdefghijklmnopqrstuvwxyz", 48)
+	root := build(b, words...)
+	probes := append(words[:5000], randomWords(5000, 10, "abcdefghijklmnopqrstuvwxyz", 49)...)
+	o := root.FlatArray()
+	c := o.Columns()
+	b.Run("records", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, word := range probes {
+				o.ContainsFlat(word)
+			}
+		}
+	})
+	b.Run("columns", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, word := range probes {
+				c.ContainsSOA(word)
+			}
+		}
+	})
+}
+
+func TestCreateDotRemovesPartialFile(t *testing.T) {
+	root := build(t, randomWords(500, 6, "abcdef", 50)...)
+	if err := root.WriteDot(&failingWriter{n: 100}); err != errWriteFailed {
+		t.Errorf("WriteDot to a failing writer: %v, want %v", err, errWriteFailed)
+	}
+	// The file gets some of the drawing before the writes start failing.
+	filename := filepath.Join(t.TempDir(), "graph.dot")
+	err := createDotFile(filename, func(w io.Writer) error {
+		return root.WriteDot(&failingWriter{n: 4096, w: w})
+	})
+	if err != errWriteFailed {
+		t.Errorf("createDotFile with a failing write: %v, want %v", err, errWriteFailed)
+	}
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Errorf("the partial file was left behind: %v", err)
+	}
+	if err := root.CreateDot(filename); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := root.WriteDot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filename); err != nil || len(data) != buf.Len() {
+		t.Errorf("CreateDot wrote %d bytes, %v, want %d", len(data), err, buf.Len())
+	}
+	if err := root.CreateDot(filepath.Join(t.TempDir(), "missing", "graph.dot")); err == nil {
+		t.Errorf("CreateDot in a missing directory succeeded")
+	}
+}
+
+func TestEstimateMinimizedNodes(t *testing.T) {
+	if got := NewDAWG().EstimateMinimizedNodes(); got != 1 {
+		t.Errorf("EstimateMinimizedNodes of an empty graph = %d, want 1", got)
+	}
+	for seed := int64(0); seed < 20; seed++ {
+		words := randomWords(300, 7, "abcde", seed)
+		root := build(t, words...)
+		before := root.Stats()
+		estimate := root.EstimateMinimizedNodes()
+		if got := root.Stats(); got != before {
+			t.Fatalf("seed %d: EstimateMinimizedNodes changed the graph: %+v, want %+v", seed, got, before)
+		}
+		root.Optimise()
+		// Nodes that are equal but head no list are not merged.
+		if got := root.Stats().Nodes; estimate > got || estimate < got*9/10 {
+			t.Errorf("seed %d: EstimateMinimizedNodes = %d, Optimise left %d nodes", seed, estimate, got)
+		}
+		if got := root.EstimateMinimizedNodes(); got != estimate {
+			t.Errorf("seed %d: EstimateMinimizedNodes after Optimise = %d, want %d", seed, got, estimate)
+		}
+	}
+}
+
+func TestNextRuneMatchesDecoding(t *testing.T) {
+	for _, s := range []string{"card", "ёж", "naïve", "a\xffb", "\xe2\x82", "日本語x", "\x7f\x80"} {
+		for rest := s; rest != ""; {
+			char, size := nextRune(rest)
+			wantChar, wantSize := utf8.DecodeRuneInString(rest)
+			if char != wantChar || size != wantSize {
+				t.Errorf("nextRune(%q) = %q, %d, want %q, %d", rest, char, size, wantChar, wantSize)
+			}
+			rest = rest[wantSize:]
+		}
+	}
+	// Mixed words go through both paths, sometimes within one word.
+	words := []string{"car", "cär", "caré", "card", "ёж", "ёжик", "ж", "z"}
+	root := build(t, words...)
+	sort.Strings(words)
+	if got := root.Words(); !reflect.DeepEqual(got, words) {
+		t.Errorf("Words = %q, want %q", got, words)
+	}
+	for _, w := range words {
+		if !root.Contains(w) {
+			t.Errorf("Contains(%q) = false", w)
+		}
+	}
+	for _, w := range []string{"ca", "cä", "ёжи", "caŕ"} {
+		if root.Contains(w) {
+			t.Errorf("Contains(%q) = true", w)
+		}
+	}
+	root.Optimise()
+	if got := root.Words(); !reflect.DeepEqual(got, words) {
+		t.Errorf("Words after Optimise = %q, want %q", got, words)
+	}
+}
+
+func BenchmarkDecodeASCII(b *testing.B) {
+	words := randomWords(10000, 10, "abcdefghijklmnopqrstuvwxyz", 1)
+	b.Run("nextRune", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for s := words[i%len(words)]; s != ""; {
+				_, size := nextRune(s)
+				s = s[size:]
+			}
+		}
+	})
+	b.Run("DecodeRuneInString", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for s := words[i%len(words)]; s != ""; {
+				_, size := utf8.DecodeRuneInString(s)
+				s = s[size:]
+			}
+		}
+	})
+	b.Run("Put", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			root := NewDAWG()
+			id := 0
+			b.StartTimer()
+			for _, w := range words {
+				root.Put(w, &id)
+			}
+		}
+	})
+}
+
+func TestLeafWords(t *testing.T) {
+	root := build(t, "car", "cart")
+	if got, want := root.LeafWords(), []string{"cart"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("LeafWords = %q, want %q", got, want)
+	}
+	if got := NewDAWG().LeafWords(); len(got) != 0 {
+		t.Errorf("LeafWords of an empty graph = %q", got)
+	}
+	// "car" has a child but no word below it any more.
+	root.find("cart").endofword = false
+	if got, want := root.LeafWords(), []string{"car"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("LeafWords with a branch that ends in no word = %q, want %q", got, want)
+	}
+	root = build(t, sampleWords...)
+	want := []string{"cards", "cared", "cares", "carts", "stars", "start", "tars", "tart", "xyz"}
+	if got := root.LeafWords(); !reflect.DeepEqual(got, want) {
+		t.Errorf("LeafWords = %q, want %q", got, want)
+	}
+	root.Optimise()
+	if got := root.LeafWords(); !reflect.DeepEqual(got, want) {
+		t.Errorf("LeafWords after Optimise = %q, want %q", got, want)
+	}
+}
+
+func TestEquivalenceKey(t *testing.T) {
+	root, other := NewDAWG(), NewDAWG()
+	if got, want := root.EquivalenceKey(root), other.EquivalenceKey(other); got != want {
+		t.Errorf("EquivalenceKey of empty roots = %v and %v", got, want)
+	}
+	root = build(t, "xab", "xac", "yab", "yac", "zab")
+	x, y, z := root.find("xa"), root.find("ya"), root.find("za")
+	if x == y {
+		t.Fatalf("the graph is already minimised")
+	}
+	if root.EquivalenceKey(x) != root.EquivalenceKey(y) {
+		t.Errorf("equal subtrees have different keys")
+	}
+	if root.EquivalenceKey(x) == root.EquivalenceKey(z) {
+		t.Errorf("different subtrees have the same key")
+	}
+	if root.EquivalenceKey(root.find("x")) == root.EquivalenceKey(root.find("y")) {
+		t.Errorf("nodes with different values have the same key")
+	}
+	key := root.EquivalenceKey(x)
+	// The new word changes the subtree below "ya" and makes the key stale.
+	id := 100
+	if err := root.Put("yad", &id); err != nil {
+		t.Fatal(err)
+	}
+	if root.EquivalenceKey(x) != key {
+		t.Errorf("the key of an unchanged subtree changed")
+	}
+	if root.EquivalenceKey(y) == key {
+		t.Errorf("the key of a changed subtree did not change")
+	}
+	root.Finalize()
+	if got := root.EquivalenceKey(root.find("xa")); got != key {
+		t.Errorf("EquivalenceKey after Finalize = %v, want %v", got, key)
+	}
+}
+
+func TestFromReaderGzip(t *testing.T) {
+	words := []string{"apple", "fig", "pear", "ёж"}
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	io.WriteString(zw, strings.Join(words, "\n")+"\n")
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data := compressed.Bytes()
+	d, err := FromReader(bytes.NewReader(data), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := d.Words(); !reflect.DeepEqual(got, words) {
+		t.Errorf("Words from gzipped input = %q, want %q", got, words)
+	}
+	// Cut short, the stream still has the magic number but no trailer.
+	if _, err := FromReader(bytes.NewReader(data[:len(data)-4]), nil); err == nil {
+		t.Errorf("FromReader of truncated gzip succeeded")
+	}
+	if _, err := FromReader(bytes.NewReader(data[:5]), nil); err == nil {
+		t.Errorf("FromReader of a gzip header cut short succeeded")
+	}
+	// One byte of the magic number alone is just a word.
+	d, err = FromReader(strings.NewReader("\x1f"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := d.Words(); !reflect.DeepEqual(got, []string{"\x1f"}) {
+		t.Errorf("Words = %q, want %q", got, []string{"\x1f"})
+	}
+}
+
+func TestShardPartitionsWords(t *testing.T) {
+	words := randomWords(2000, 6, "abcdefghij", 61)
+	root := build(t, append(words, "")...)
+	id := len(words) + 1
+	if err := root.PutPayload("abc", []byte{7}, &id); err != nil {
+		t.Fatal(err)
+	}
+	all := root.Words()
+	for _, n := range []int{1, 2, 4, 10, 15} {
+		shards, err := root.Shard(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen := make(map[string]int)
+		largest := 0
+		for i, shard := range shards {
+			got := shard.Words()
+			if len(got) > largest {
+				largest = len(got)
+			}
+			for _, w := range got {
+				if j, found := seen[w]; found {
+					t.Errorf("Shard(%d): %q is in shards %d and %d", n, w, j, i)
+				}
+				seen[w] = i
+				if got, want := shard.Frequency(w), root.Frequency(w); got != want {
+					t.Errorf("Shard(%d): Frequency(%q) = %d, want %d", n, w, got, want)
+				}
+			}
+			// Every shard stands on its own.
+			shard.Optimise()
+			var buf bytes.Buffer
+			if _, err := shard.FlatArray().WriteTo(&buf); err != nil {
+				t.Fatal(err)
+			}
+			flat, err := ReadFlat(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, w := range got {
+				if !flat.ContainsFlat(w) {
+					t.Errorf("Shard(%d): shard %d read back lacks %q", n, i, w)
+				}
+			}
+		}
+		for _, w := range all {
+			if _, found := seen[w]; !found {
+				t.Errorf("Shard(%d): %q is in no shard", n, w)
+			}
+		}
+		if len(seen) != len(all) {
+			t.Errorf("Shard(%d) holds %d words, want %d", n, len(seen), len(all))
+		}
+		if i := seen[""]; i != 0 {
+			t.Errorf("Shard(%d) put the empty word in shard %d", n, i)
+		}
+		if got, ok := shards[seen["abc"]].GetPayload("abc"); !ok || !bytes.Equal(got, []byte{7}) {
+			t.Errorf("Shard(%d): payload of %q = %v, %v", n, "abc", got, ok)
+		}
+		// Ten first runes of about 200 words each.
+		if n <= 10 && largest > len(all)/n+len(all)/5 {
+			t.Errorf("Shard(%d): largest shard has %d of %d words", n, largest, len(all))
+		}
+	}
+}
+
+func TestOptimiseEmptyAndOneWord(t *testing.T) {
+	var out bytes.Buffer
+	Progress = &out
+	defer func() { Progress = nil }()
+	for _, words := range [][]string{nil, {""}, {"a"}, {"word"}} {
+		for _, optimise := range []func(*treenode){(*treenode).Optimise, (*treenode).OptimiseLowMemory, (*treenode).Finalize} {
+			root := build(t, words...)
+			nodes := root.Stats().Nodes
+			optimise(root)
+			if !root.IsMinimized() {
+				t.Errorf("%q: IsMinimized after Optimise = false", words)
+			}
+			if got := root.Stats().Nodes; got != nodes {
+				t.Errorf("%q: %d nodes after Optimise, want %d", words, got, nodes)
+			}
+			if got := root.Words(); !equalWords(got, words) {
+				t.Errorf("%q: Words after Optimise = %q", words, got)
+			}
+			if got := root.WordCount(); got != len(words) {
+				t.Errorf("%q: WordCount after Optimise = %d", words, got)
+			}
+			if root.Contains("wor") || root.Contains("words") {
+				t.Errorf("%q: Contains a word that was never put", words)
+			}
+		}
+	}
+	if out.Len() != 0 {
+		t.Errorf("Optimise reported progress on a graph with nothing to merge: %q", out.String())
+	}
+	// The graph can still grow afterwards.
+	root := NewDAWG()
+	root.Optimise()
+	id := 0
+	for _, w := range []string{"tap", "top"} {
+		if err := root.Put(w, &id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root.Optimise()
+	if got := root.Words(); !reflect.DeepEqual(got, []string{"tap", "top"}) {
+		t.Errorf("Words = %q, want %q", got, []string{"tap", "top"})
+	}
+}
+
+func TestRuneFrequencies(t *testing.T) {
+	root := build(t, "car", "cat", "bat")
+	want := map[rune]int{'c': 1, 'b': 1, 'a': 2, 'r': 1, 't': 2}
+	if got := root.RuneFrequencies(); !reflect.DeepEqual(got, want) {
+		t.Errorf("RuneFrequencies = %v, want %v", got, want)
+	}
+	// The "t" that ends "bat" is the one that ends "cat" once shared.
+	root.Optimise()
+	want['t'] = 1
+	if got := root.RuneFrequencies(); !reflect.DeepEqual(got, want) {
+		t.Errorf("RuneFrequencies after Optimise = %v, want %v", got, want)
+	}
+	if got := NewDAWG().RuneFrequencies(); len(got) != 0 {
+		t.Errorf("RuneFrequencies of an empty graph = %v", got)
+	}
+	// Over a minimised graph the counts add up to the nodes but the root.
+	root = build(t, sampleWords...)
+	root.Optimise()
+	total := 0
+	for _, n := range root.RuneFrequencies() {
+		total += n
+	}
+	if got := root.Stats().Nodes - 1; total != got {
+		t.Errorf("RuneFrequencies add up to %d, want %d", total, got)
+	}
+}
+
+func TestSameSuffixClass(t *testing.T) {
+	root := build(t, "cats", "rats", "bets", "dog", "car", "cat", "bar")
+	if root.SameSuffixClass("cats", "rats") {
+		t.Errorf("SameSuffixClass before Optimise = true")
+	}
+	root.Optimise()
+	for _, tc := range []struct {
+		a, b string
+		want bool
+	}{
+		{"cats", "rats", true},
+		{"rats", "cats", true},
+		{"cats", "bets", true}, // The paths meet at the final "s".
+		{"cats", "dog", false},
+		{"cat", "cats", false},  // One path, which never parts.
+		{"cats", "cats", false}, // Likewise.
+		{"car", "bar", false},   // "ca" also goes on to "t", "ba" does not.
+		{"cats", "rat", false},  // "rat" is not a word.
+		{"cats", "bats", false}, // Nor is "bats".
+	} {
+		if got := root.SameSuffixClass(tc.a, tc.b); got != tc.want {
+			t.Errorf("SameSuffixClass(%q, %q) = %v, want %v", tc.a, tc.b, got, tc.want)
+		}
+	}
+}
+
+func TestLimitedEnumerations(t *testing.T) {
+	words := randomWords(3000, 6, "abc", 65)
+	root := build(t, append(words, "", "abba", "aba")...)
+	root.Optimise()
+	root.RenumberIDs()
+	// The terminal that most words end at.
+	ending := make(map[int]int)
+	terminal := 0
+	root.WordsWithTerminals(func(word string, id int) {
+		if ending[id]++; ending[id] > ending[terminal] {
+			terminal = id
+		}
+	})
+	for name, tc := range map[string]struct {
+		full    func() []string
+		limited func(max int) ([]string, bool)
+		// sorted is set where the kept words are sorted afterwards.
+		sorted bool
+	}{
+		"FuzzySearchParallel": {
+			func() []string { return root.FuzzySearchParallel("abcab", 2, 3) },
+			func(max int) ([]string, bool) { return root.FuzzySearchParallelLimited("abcab", 2, 3, max) },
+			true,
+		},
+		"FuzzyWithFixedPrefix": {
+			func() []string { return root.FuzzyWithFixedPrefix("ab", "cab", 2) },
+			func(max int) ([]string, bool) { return root.FuzzyWithFixedPrefixLimited("ab", "cab", 2, max) },
+			true,
+		},
+		"HammingSearch": {
+			func() []string { return root.HammingSearch("abcab", 2) },
+			func(max int) ([]string, bool) { return root.HammingSearchLimited("abcab", 2, max) },
+			false,
+		},
+		"PatternSearch": {
+			func() []string { words, _ := root.PatternSearch("a?[bc]?"); return words },
+			func(max int) ([]string, bool) {
+				words, truncated, err := root.PatternSearchLimited("a?[bc]?", max)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return words, truncated
+			},
+			false,
+		},
+		"Palindromes":   {root.Palindromes, root.PalindromesLimited, false},
+		"LeafWords":     {root.LeafWords, root.LeafWordsLimited, false},
+		"WordsByLength": {root.WordsByLength, root.WordsByLengthLimited, false},
+		"WordsForTerminal": {
+			func() []string { return root.WordsForTerminal(terminal) },
+			func(max int) ([]string, bool) { return root.WordsForTerminalLimited(terminal, max) },
+			false,
+		},
+		"SuggestGrouped": {
+			func() []string { return flattenGroups(root.SuggestGrouped("abcab", 2)) },
+			func(max int) ([]string, bool) {
+				groups, truncated := root.SuggestGroupedLimited("abcab", 2, max)
+				return flattenGroups(groups), truncated
+			},
+			true,
+		},
+	} {
+		all := tc.full()
+		if len(all) < 10 {
+			t.Fatalf("%s: only %d words, too few to cut", name, len(all))
+		}
+		for _, max := range []int{0, 1, 5, len(all) - 1, len(all), len(all) + 1} {
+			got, truncated := tc.limited(max)
+			want := all
+			if max > 0 && max < len(all) {
+				// The walk keeps the first words it meets; where the
+				// result is sorted again these need not come first.
+				want = all[:max]
+				if tc.sorted {
+					want = nil
+				}
+			}
+			if wantTruncated := max > 0 && max < len(all); truncated != wantTruncated {
+				t.Errorf("%s limited to %d: truncated = %v, want %v", name, max, truncated, wantTruncated)
+			}
+			if max > 0 && len(got) > max {
+				t.Errorf("%s limited to %d returned %d words", name, max, len(got))
+			}
+			if want != nil && !reflect.DeepEqual(got, want) {
+				t.Errorf("%s limited to %d = %q, want %q", name, max, got, want)
+			}
+			for _, w := range got {
+				if !containsString(all, w) {
+					t.Errorf("%s limited to %d returned %q, which it does not find unlimited", name, max, w)
+				}
+			}
+		}
+	}
+	// The parallel search keeps what the serial one keeps.
+	for _, max := range []int{1, 7, 30} {
+		for _, workers := range []int{1, 2, 5} {
+			want, wantTruncated := root.FuzzySearchLimited("abcab", 2, max)
+			if got, truncated := root.FuzzySearchParallelLimited("abcab", 2, workers, max); !reflect.DeepEqual(got, want) || truncated != wantTruncated {
+				t.Errorf("FuzzySearchParallelLimited(%d workers, %d) = %q, %v, want %q, %v", workers, max, got, truncated, want, wantTruncated)
+			}
+		}
+	}
+}
+
+// flattenGroups joins the buckets of SuggestGrouped in sorted order.
+func flattenGroups(groups map[int][]string) []string {
+	var words []string
+	for _, group := range groups {
+		words = append(words, group...)
+	}
+	sort.Strings(words)
+	return words
+}
+
+func TestShortestCompletion(t *testing.T) {
+	root := build(t, "carpet", "carpets", "cars", "cart", "cat", "dog")
+	root.Optimise()
+	for _, tc := range []struct {
+		prefix, first, shortest string
+	}{
+		{"car", "carpet", "cars"},
+		{"ca", "carpet", "cat"},
+		{"carp", "carpet", "carpet"},
+		{"", "carpet", "cat"},
+		{"do", "dog", "dog"},
+	} {
+		if first, _ := root.CompletionsLimited(tc.prefix, 1); len(first) != 1 || first[0] != tc.first {
+			t.Errorf("CompletionsLimited(%q, 1) = %q, want %q", tc.prefix, first, tc.first)
+		}
+		if got, ok := root.ShortestCompletion(tc.prefix); !ok || got != tc.shortest {
+			t.Errorf("ShortestCompletion(%q) = %q, %v, want %q", tc.prefix, got, ok, tc.shortest)
+		}
+	}
+	for _, prefix := range []string{"carx", "x"} {
+		if got, ok := root.ShortestCompletion(prefix); ok {
+			t.Errorf("ShortestCompletion(%q) = %q, true", prefix, got)
+		}
+	}
+	// A prefix that is a node but leads to no word.
+	root = build(t, "ab")
+	root.find("ab").endofword = false
+	if got, ok := root.ShortestCompletion("a"); ok {
+		t.Errorf("ShortestCompletion with no word below = %q, true", got)
+	}
+}
+
+func TestReplaceKeepsSharedSuffixes(t *testing.T) {
+	root := build(t, "baking", "making", "taking", "make")
+	root.Optimise()
+	if !root.SameSuffixClass("making", "taking") {
+		t.Fatalf("making and taking share no suffix after Optimise")
+	}
+	nodes := root.Stats().Nodes
+	id := 100
+	if err := root.Replace("baking", "bake", &id); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"bake", "make", "making", "taking"}
+	if got := root.Words(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Words after Replace = %q, want %q", got, want)
+	}
+	// Only the path of the old and new word was copied.
+	if !root.SameSuffixClass("making", "taking") {
+		t.Errorf("Replace undid the sharing of words it did not touch")
+	}
+	if got := root.Stats().Nodes; got > nodes+len("bake") {
+		t.Errorf("Replace left %d nodes, up from %d", got, nodes)
+	}
+	if root.IsMinimized() {
+		t.Errorf("IsMinimized after Replace")
+	}
+	if err := root.Replace("baking", "x", &id); !errors.Is(err, ErrWordNotFound) {
+		t.Errorf("Replace of a missing word: %v, want %v", err, ErrWordNotFound)
+	}
+	if got := root.Words(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Words after a failed Replace = %q, want %q", got, want)
+	}
+	root.Optimise()
+	fresh := build(t, want...)
+	fresh.Optimise()
+	if got, want := root.Stats(), fresh.Stats(); got != want {
+		t.Errorf("Stats after Replace and Optimise = %+v, want %+v", got, want)
+	}
+}
+
+func TestInternedArray(t *testing.T) {
+	words := append(randomWords(2000, 7, "abcdeжзий日本", 69), sampleWords...)
+	root := build(t, words...)
+	root.Optimise()
+	a, err := root.InternedArray()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(a.table.Runes), len(root.RuneFrequencies()); got != want {
+		t.Errorf("RuneTable numbers %d runes, want %d", got, want)
+	}
+	for _, w := range words {
+		if !a.ContainsInterned(w) {
+			t.Errorf("ContainsInterned(%q) = false", w)
+		}
+	}
+	for _, w := range []string{"", "ca", "cartz", "x", "жжжжжжжжж", "日本日本日本日本"} {
+		if got, want := a.ContainsInterned(w), root.Contains(w); got != want {
+			t.Errorf("ContainsInterned(%q) = %v, want %v", w, got, want)
+		}
+	}
+	// The most frequent rune gets index 0.
+	counts := root.RuneFrequencies()
+	for _, char := range a.table.Runes[1:] {
+		if counts[char] > counts[a.table.Runes[0]] {
+			t.Errorf("%q is more frequent than %q, which has index 0", char, a.table.Runes[0])
+		}
+	}
+	var buf bytes.Buffer
+	if _, err := a.table.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadRuneTable(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(read.Runes, a.table.Runes) {
+		t.Errorf("RuneTable read back = %q, want %q", read.Runes, a.table.Runes)
+	}
+	for i, char := range a.table.Runes {
+		if index, found := read.Index(char); !found || int(index) != i {
+			t.Errorf("Index(%q) read back = %d, %v, want %d", char, index, found, i)
+		}
+	}
+	// A table read back interns the array the same way.
+	b, err := root.FlatArray().Intern(read)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(b.nodes, a.nodes) {
+		t.Errorf("the array interned with the table read back differs")
+	}
+	if _, err := root.FlatArray().Intern(&RuneTable{}); err == nil {
+		t.Errorf("Intern with an empty table succeeded")
+	}
+	buf.Reset()
+	a.table.WriteTo(&buf)
+	for _, n := range []int{0, buf.Len() - 1} {
+		if _, err := ReadRuneTable(bytes.NewReader(buf.Bytes()[:n])); err == nil {
+			t.Errorf("ReadRuneTable of %d of %d bytes succeeded", n, buf.Len())
+		}
+	}
+}
+
+func TestReachableAt(t *testing.T) {
+	root := build(t, "car", "cat", "bat")
+	for _, tc := range []struct {
+		optimise bool
+		want     []int
+	}{
+		{false, []int{1, 2, 2, 3, 0}},
+		{true, []int{1, 2, 2, 2, 0}}, // "bat" and "cat" end at one "t".
+	} {
+		if tc.optimise {
+			root.Optimise()
+		}
+		total := 0
+		for k, want := range tc.want {
+			got := root.ReachableAt(k)
+			if got != want {
+				t.Errorf("optimised %v: ReachableAt(%d) = %d, want %d", tc.optimise, k, got, want)
+			}
+			total += got
+		}
+		if nodes := root.Stats().Nodes; total != nodes {
+			t.Errorf("optimised %v: ReachableAt adds up to %d, want %d", tc.optimise, total, nodes)
+		}
+	}
+	if got := root.ReachableAt(-1); got != 0 {
+		t.Errorf("ReachableAt(-1) = %d", got)
+	}
+	// The levels are recomputed once the graph changes.
+	id := 100
+	if err := root.Put("cards", &id); err != nil {
+		t.Fatal(err)
+	}
+	if got := root.ReachableAt(5); got != 1 {
+		t.Errorf("ReachableAt(5) after Put = %d, want 1", got)
+	}
+}
+
+func TestConcurrentMutations(t *testing.T) {
+	words := randomWords(400, 6, "abcdef", 71)
+	root := NewDAWG()
+	id := 0
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < len(words); i += 4 {
+				if err := root.Put(words[i], &id); err != nil {
+					t.Error(err)
+				}
+			}
+		}(w)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			root.Optimise()
+			if err := root.DeMinimize(&id); err != nil {
+				t.Error(err)
+			}
+			root.SetSizeHint(i)
+			root.SetAlphabet(nil)
+			root.SetNormalizer(nil)
+			root.SetPayloadPolicy(PayloadKeepLast)
+			if err := root.SetCollation(nil); err != nil {
+				t.Error(err)
+			}
+			if i%5 == 0 {
+				root.Canonicalize()
+				if err := root.DeMinimize(&id); err != nil {
+					t.Error(err)
+				}
+			}
+		}
+	}()
+	wg.Wait()
+	root.Optimise()
+	want := build(t, words...)
+	want.Optimise()
+	if got := root.Words(); !reflect.DeepEqual(got, want.Words()) {
+		t.Errorf("concurrent Puts kept %d words, want %d", len(got), len(want.Words()))
+	}
+	if err := root.Validate(); err != nil {
+		t.Error(err)
+	}
+	// Puts that come after Finalize fail; the others are all kept.
+	root = NewDAWG()
+	id = 0
+	var mu sync.Mutex
+	var kept []string
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < len(words); i += 4 {
+				err := root.Put(words[i], &id)
+				if err != nil && !errors.Is(err, ErrFrozen) {
+					t.Error(err)
+				}
+				if err == nil {
+					mu.Lock()
+					kept = append(kept, words[i])
+					mu.Unlock()
+				}
+			}
+		}(w)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		root.Finalize()
+	}()
+	wg.Wait()
+	if got, want := root.Words(), build(t, kept...).Words(); !equalWords(got, want) {
+		t.Errorf("Finalize amid Puts kept %d words, want %d", len(got), len(want))
+	}
+}
+
+func TestMappedDictionary(t *testing.T) {
+	words := append(randomWords(1000, 7, "abcdeж", 72), sampleWords...)
+	root := build(t, words...)
+	root.Optimise()
+	filename := filepath.Join(t.TempDir(), "words.wg")
+	writeFlatFile(t, root.FlatArray(), filename)
+	m, err := Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runtime.GOOS != "windows" && runtime.GOOS != "plan9" && !m.mapped {
+		t.Errorf("Open read the file instead of mapping it")
+	}
+	for _, w := range words {
+		if !m.Contains(w) {
+			t.Errorf("Contains(%q) = false", w)
+		}
+	}
+	for _, w := range []string{"", "ca", "cartz", "жжжжжжжж"} {
+		if got, want := m.Contains(w), root.Contains(w); got != want {
+			t.Errorf("Contains(%q) = %v, want %v", w, got, want)
+		}
+	}
+	for _, prefix := range []string{"", "car", "ж", "xyzz"} {
+		if got, want := m.Completions(prefix), root.Completions(prefix); !equalWords(got, want) {
+			t.Errorf("Completions(%q) = %d words, want %d", prefix, len(got), len(want))
+		}
+	}
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if m.data != nil || m.records != nil {
+		t.Errorf("Close kept the mapping")
+	}
+	if m.Contains("car") || len(m.Completions("")) != 0 {
+		t.Errorf("queries after Close found words")
+	}
+	if err := m.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+	// Nothing holds the file any more.
+	if err := os.Remove(filename); err != nil {
+		t.Error(err)
+	}
+	if _, err := Open(filename); err == nil {
+		t.Errorf("Open of a missing file succeeded")
+	}
+}
+
+func TestWordsByLength(t *testing.T) {
+	root := build(t, "card", "a", "bat", "", "cat", "zz", "ab", "cards", "b")
+	want := []string{"", "a", "b", "ab", "zz", "bat", "cat", "card", "cards"}
+	if got := root.WordsByLength(); !reflect.DeepEqual(got, want) {
+		t.Errorf("WordsByLength = %q, want %q", got, want)
+	}
+	words := randomWords(2000, 8, "abcdжз", 73)
+	root = build(t, words...)
+	root.Optimise()
+	want = root.Words()
+	sort.SliceStable(want, func(i, j int) bool {
+		return utf8.RuneCountInString(want[i]) < utf8.RuneCountInString(want[j])
+	})
+	if got := root.WordsByLength(); !reflect.DeepEqual(got, want) {
+		t.Errorf("WordsByLength differs from Words sorted by length")
+	}
+	if got := NewDAWG().WordsByLength(); len(got) != 0 {
+		t.Errorf("WordsByLength of an empty graph = %q", got)
+	}
+}
+
+func TestOptimiseSkipsGraphsWithoutSharing(t *testing.T) {
+	// No two nodes carry the same rune, so none can be merged.
+	words := []string{"abc", "ade", "fgh", "ijkl", "m"}
+	root := build(t, words...)
+	before := root.Stats()
+	nodes := allNodes(root)
+	var out bytes.Buffer
+	Progress = &out
+	defer func() { Progress = nil }()
+	root.Optimise()
+	if strings.Contains(out.String(), "Processing") {
+		t.Errorf("Optimise walked the heights of a graph without sharing:\n%s", out.String())
+	}
+	if root.info().stats != nil {
+		t.Errorf("Optimise kept the cached Stats")
+	}
+	if got := root.Stats(); got != before {
+		t.Errorf("Stats after Optimise = %+v, want %+v", got, before)
+	}
+	if got := allNodes(root); !reflect.DeepEqual(got, nodes) {
+		t.Errorf("Optimise replaced nodes of a graph without sharing")
+	}
+	if !root.IsMinimized() {
+		t.Errorf("IsMinimized after Optimise = false")
+	}
+	if got := root.Words(); !reflect.DeepEqual(got, words) {
+		t.Errorf("Words after Optimise = %q, want %q", got, words)
+	}
+	if got := root.EstimateMinimizedNodes(); got != before.Nodes {
+		t.Errorf("EstimateMinimizedNodes = %d, want %d", got, before.Nodes)
+	}
+}
+
+// allNodes returns the nodes reachable from root with their ids.
+func allNodes(root *treenode) map[*treenode]int {
+	nodes := make(map[*treenode]int)
+	var walk func(*treenode)
+	walk = func(node *treenode) {
+		nodes[node] = node.id
+		for child := node.children; child != nil; child = child.next {
+			walk(child)
+		}
+	}
+	walk(root)
+	return nodes
+}
+
+func TestFSWalk(t *testing.T) {
+	words := append(randomWords(500, 5, "abcж", 75), "", "a.b", "50%", "a/b", "$", "..", "card", "cards")
+	root := build(t, words...)
+	root.Optimise()
+	fsys := root.FS()
+	var found []string
+	err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		elements := strings.Split(path, "/")
+		if elements[len(elements)-1] == wordMarker {
+			elements = elements[:len(elements)-1]
+		}
+		var word []rune
+		for _, element := range elements {
+			char, ok := unescapeRune(element)
+			if !ok {
+				return fmt.Errorf("%q is not an escaped rune in %q", element, path)
+			}
+			word = append(word, char)
+		}
+		found = append(found, string(word))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(found)
+	want := root.Words()
+	if !reflect.DeepEqual(found, want) {
+		t.Errorf("walking the FS found %d words, want %d", len(found), len(want))
+	}
+	// "card" goes on to "cards", so it is a marker in a directory.
+	if info, err := fs.Stat(fsys, "c/a/r/d/s"); err != nil || info.IsDir() {
+		t.Errorf("Stat(c/a/r/d/s) = %v, %v, want a file", info, err)
+	}
+	if entries, err := fs.ReadDir(fsys, "c/a/r/d"); err != nil || len(entries) != 2 || entries[0].Name() != wordMarker {
+		t.Errorf("ReadDir(c/a/r/d) = %v, %v", entries, err)
+	}
+	for _, name := range []string{"z", "c/a/r/d/s/x", "a/./b", "%2F/..", "c/a/r/d/s/$"} {
+		if _, err := fsys.Open(name); err == nil {
+			t.Errorf("Open(%q) succeeded", name)
+		}
+	}
+	if err := fstest.TestFS(fsys, "%24", "a/%2E/b", "5/0/%25", "a/%2F/b", "%2E/%2E"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestProfileLookups(t *testing.T) {
+	var letters []string
+	for char := 'a'; char < 'a'+childIndexThreshold; char++ {
+		letters = append(letters, string(char))
+	}
+	root := build(t, letters...)
+	last := letters[len(letters)-1]
+	got := root.ProfileLookups([]string{"a", last, "a" + last, "?"})
+	// "a" + last stops after "a"; "?" is compared with every letter.
+	want := LookupStats{Queries: 4, Comparisons: 1 + childIndexThreshold + 1 + childIndexThreshold, MaxComparisons: childIndexThreshold}
+	if got != want {
+		t.Errorf("ProfileLookups = %+v, want %+v", got, want)
+	}
+	if mean := got.MeanComparisons(); mean != float64(want.Comparisons)/4 {
+		t.Errorf("MeanComparisons = %v, want %v", mean, float64(want.Comparisons)/4)
+	}
+	// Over a wide alphabet the linear scan dominates the cost of lookups.
+	words := randomWords(2000, 4, "abcdefghijklmnopqrstuvw", 76)
+	root = build(t, words...)
+	root.Optimise()
+	wide := root.ProfileLookups(words)
+	words = randomWords(2000, 4, "ab", 76)
+	narrow := build(t, words...).ProfileLookups(words)
+	if wide.MeanComparisons() < 3*narrow.MeanComparisons() || wide.MaxComparisons <= childIndexThreshold {
+		t.Errorf("ProfileLookups over 23 letters = %+v, over 2 = %+v", wide, narrow)
+	}
+	// One more letter and the root gets a child map, which costs nothing.
+	root = build(t, append(letters, "~")...)
+	if got := root.ProfileLookups([]string{"~", "a"}); got.Comparisons != 0 || got.IndexLookups != 2 {
+		t.Errorf("ProfileLookups through a child map = %+v", got)
+	}
+	if got := NewDAWG().ProfileLookups(nil).MeanComparisons(); got != 0 {
+		t.Errorf("MeanComparisons of no queries = %v", got)
+	}
+}
+
+// BenchmarkAdaptiveReorder looks up words made of the last letters of
+// the alphabet, which a sorted child list finds last, before and after
+// AdaptiveReorder has seen a sample of them.
+func BenchmarkAdaptiveReorder(b *testing.B) {
+	words := randomWords(20000, 7, "abcdefghijklmnopqrstuvw", 77)
+	queries := randomWords(2000, 7, "tuvw", 78)
+	for _, reorder := range []bool{false, true} {
+		root := build(b, append(words, queries...)...)
+		root.Finalize()
+		if reorder {
+			if err := root.AdaptiveReorder(queries[:200]); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.Run(fmt.Sprintf("reordered=%v", reorder), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if !root.Contains(queries[i%len(queries)]) {
+					b.Fatal("query not found")
+				}
+			}
+		})
+	}
+}
+
+func TestToRegexp(t *testing.T) {
+	words := append(randomWords(300, 5, "abc", 79), "a.b", "a*", "(x|y)", "ж")
+	for _, optimise := range []bool{false, true} {
+		root := build(t, words...)
+		if optimise {
+			root.Optimise()
+		}
+		expr, err := root.ToRegexp(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			t.Fatalf("optimised %v: %v", optimise, err)
+		}
+		candidates := append(randomWords(2000, 6, "abc.*()|xyж", 80), words...)
+		for _, w := range candidates {
+			if got, want := re.MatchString(w), root.Contains(w); got != want {
+				t.Errorf("optimised %v: %q matches %q: %v, want %v", optimise, expr, w, got, want)
+			}
+		}
+	}
+	for _, tc := range []struct {
+		words    []string
+		match    []string
+		mismatch []string
+	}{
+		{nil, nil, []string{"", "a"}},
+		{[]string{""}, []string{""}, []string{"a"}},
+		{[]string{"", "ab"}, []string{"", "ab"}, []string{"a", "abab"}},
+	} {
+		expr, err := build(t, tc.words...).ToRegexp(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		re := regexp.MustCompile(expr)
+		for _, w := range tc.match {
+			if !re.MatchString(w) {
+				t.Errorf("%q for %q does not match %q", expr, tc.words, w)
+			}
+		}
+		for _, w := range tc.mismatch {
+			if re.MatchString(w) {
+				t.Errorf("%q for %q matches %q", expr, tc.words, w)
+			}
+		}
+	}
+	root := build(t, randomWords(2000, 8, "abcdefgh", 81)...)
+	if _, err := root.ToRegexp(1000); err != ErrRegexpTooLarge {
+		t.Errorf("ToRegexp over the limit: %v, want %v", err, ErrRegexpTooLarge)
+	}
+	if expr, err := build(t, "ab", "cd").ToRegexp(len("^(?:ab|cd)$")); err != nil || expr != "^(?:ab|cd)$" {
+		t.Errorf("ToRegexp at the limit = %q, %v", expr, err)
+	}
+}
+
+func TestSizeHintKeepsGraph(t *testing.T) {
+	words := randomWords(3000, 8, "abcdef", 82)
+	want := build(t, words...)
+	want.Optimise()
+	wantShape := shapeOf(want)
+	for _, hint := range []int{1, 100, want.Stats().Nodes, 1 << 20} {
+		for _, optimise := range []func(*treenode){(*treenode).Optimise, (*treenode).OptimiseLowMemory} {
+			root := build(t, words...)
+			root.SetSizeHint(hint)
+			optimise(root)
+			if got := root.Stats(); got != want.Stats() {
+				t.Errorf("hint %d: Stats = %+v, want %+v", hint, got, want.Stats())
+			}
+			if got := root.Fingerprint(); got != want.Fingerprint() {
+				t.Errorf("hint %d: Fingerprint changed", hint)
+			}
+			if got := shapeOf(root); got != wantShape {
+				t.Errorf("hint %d: the graph has another shape", hint)
+			}
+		}
+	}
+	root := build(t, words...)
+	root.SetSizeHint(-5)
+	root.Optimise()
+	if got := root.Stats(); got != want.Stats() {
+		t.Errorf("negative hint: Stats = %+v, want %+v", got, want.Stats())
+	}
+}
+
+// shapeOf lists the edges of root as EdgesBFS numbers them, which
+// depends only on the shape of the graph.
+func shapeOf(root *treenode) string {
+	var buf strings.Builder
+	root.EdgesBFS(func(from, to int, label rune, final bool) {
+		fmt.Fprintln(&buf, from, to, string(label), final)
+	})
+	return buf.String()
+}
+
+// BenchmarkSizeHint builds and minimises a graph with and without
+// a hint of its node count.
+func BenchmarkSizeHint(b *testing.B) {
+	words := randomWords(10000, 9, "abcdefghijklmnopqrstuvwxyz", 83)
+	nodes := build(b, words...).Stats().Nodes
+	for _, hint := range []int{0, nodes} {
+		b.Run(fmt.Sprintf("hint=%d", hint), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				root := NewDAWG()
+				root.SetSizeHint(hint)
+				id := 0
+				for _, word := range words {
+					root.Put(word, &id)
+				}
+				root.Optimise()
+			}
+		})
+	}
+}
+
+func TestDominantScript(t *testing.T) {
+	for _, tc := range []struct {
+		words []string
+		want  string
+	}{
+		{[]string{"кот", "собака", "дом", "ёж", "x"}, "Cyrillic"},
+		{[]string{"cat", "dog", "кот"}, "Latin"},
+		{[]string{"日本", "中国", "cat"}, "Han"},
+		{[]string{"ab", "аб"}, "Cyrillic"}, // A tie goes to the first name.
+		{[]string{"123", "4-5"}, "Common"},
+		{[]string{"1a"}, "Latin"}, // Digits count only without letters.
+		{nil, ""},
+	} {
+		if got := build(t, tc.words...).DominantScript(); got != tc.want {
+			t.Errorf("DominantScript of %q = %q, want %q", tc.words, got, tc.want)
+		}
+	}
+}
+
+func TestClearLeavesNoResidue(t *testing.T) {
+	id := 0
+	root := NewDAWG()
+	root.SetNormalizer(strings.ToLower)
+	root.SetAlphabet(func(r rune) bool { return r != 'q' })
+	root.SetPayloadPolicy(PayloadError)
+	root.SetCollation(func(a, b rune) int { return int(b) - int(a) })
+	for _, w := range append([]string{""}, sampleWords...) {
+		if err := root.Put(w, &id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := root.PutPayload("car", []byte{1}, &id); err != nil {
+		t.Fatal(err)
+	}
+	root.Finalize()
+	root.Stats()
+	root.Clear(&id)
+	if id != 0 {
+		t.Errorf("Clear left the id counter at %d", id)
+	}
+	if root.Frozen() || root.IsMinimized() {
+		t.Errorf("Clear kept the flags: frozen %v, minimised %v", root.Frozen(), root.IsMinimized())
+	}
+	if got := root.Words(); len(got) != 0 {
+		t.Errorf("Words after Clear = %q", got)
+	}
+	if got := root.Stats(); got != (Stats{Nodes: 1}) {
+		t.Errorf("Stats after Clear = %+v", got)
+	}
+	// A fresh build on the cleared root is the same as on a new one.
+	words := []string{"Quay", "car", "Cart", "queen"}
+	want := NewDAWG()
+	wantID := 0
+	for _, w := range words {
+		if err := want.Put(w, &wantID); err != nil {
+			t.Fatal(err)
+		}
+		if err := root.Put(w, &id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := root.PutPayload("car", []byte{2}, &id); err != nil {
+		t.Errorf("PutPayload after Clear: %v", err)
+	}
+	want.PutPayload("car", []byte{2}, &wantID)
+	if id != wantID {
+		t.Errorf("ids after Clear run to %d, want %d", id, wantID)
+	}
+	root.Optimise()
+	want.Optimise()
+	if got := root.Words(); !reflect.DeepEqual(got, want.Words()) {
+		t.Errorf("Words after Clear = %q, want %q", got, want.Words())
+	}
+	if got := root.Stats(); got != want.Stats() {
+		t.Errorf("Stats after Clear = %+v, want %+v", got, want.Stats())
+	}
+	if !reflect.DeepEqual(ids(root), ids(want)) {
+		t.Errorf("node ids after Clear differ from a new build")
+	}
+}
+
+func TestWriteJSONL(t *testing.T) {
+	root := build(t, append(randomWords(300, 5, "abж<&", 84), "", "\"quoted\"")...)
+	id := 1000
+	if err := root.AddWithCount("cat", 3, &id); err != nil {
+		t.Fatal(err)
+	}
+	if err := root.PutPayload("ёж", []byte{0, 1, 255}, &id); err != nil {
+		t.Fatal(err)
+	}
+	root.Optimise()
+	var buf bytes.Buffer
+	if err := root.WriteJSONL(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var words []string
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var record struct {
+			Word    string
+			Freq    int
+			Len     int
+			Payload []byte
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("line %q: %v", scanner.Text(), err)
+		}
+		words = append(words, record.Word)
+		if want := root.Frequency(record.Word); record.Freq != want {
+			t.Errorf("%q: freq %d, want %d", record.Word, record.Freq, want)
+		}
+		if want := utf8.RuneCountInString(record.Word); record.Len != want {
+			t.Errorf("%q: len %d, want %d", record.Word, record.Len, want)
+		}
+		want, _ := root.GetPayload(record.Word)
+		if !bytes.Equal(record.Payload, want) {
+			t.Errorf("%q: payload %v, want %v", record.Word, record.Payload, want)
+		}
+	}
+	if got := root.Words(); !reflect.DeepEqual(words, got) {
+		t.Errorf("WriteJSONL wrote %d words, want %d", len(words), len(got))
+	}
+	if err := root.WriteJSONL(&failingWriter{n: 100}); err != errWriteFailed {
+		t.Errorf("WriteJSONL to a failing writer: %v, want %v", err, errWriteFailed)
+	}
+}
+
+func TestLongestWord(t *testing.T) {
+	for _, tc := range []struct {
+		words []string
+		want  string
+		ok    bool
+	}{
+		{[]string{"a", "abc", "abcdefgh", "b", "zzzz", "abcdefg"}, "abcdefgh", true},
+		{[]string{"zz", "yy", "x", "yz"}, "yy", true}, // The first of the longest.
+		{[]string{"ёжик", "ёж", "abc"}, "ёжик", true},
+		{[]string{""}, "", true},
+		{nil, "", false},
+	} {
+		for _, optimise := range []bool{false, true} {
+			root := build(t, tc.words...)
+			if optimise {
+				root.Optimise()
+			}
+			if got, ok := root.LongestWord(); got != tc.want || ok != tc.ok {
+				t.Errorf("optimised %v: LongestWord of %q = %q, %v, want %q, %v", optimise, tc.words, got, ok, tc.want, tc.ok)
+			}
+		}
+	}
+	words := randomWords(3000, 10, "abcd", 85)
+	root := build(t, append(words, "dddddddddddd")...)
+	root.Optimise()
+	if got, _ := root.LongestWord(); got != "dddddddddddd" {
+		t.Errorf("LongestWord = %q, want the one 12-rune word", got)
+	}
+}
+
+func TestPatternClasses(t *testing.T) {
+	root := build(t, "cat", "cot", "cut", "cit", "c?t", "c]t", "dog", "жук", "жак", "c-t", "c^t")
+	for _, tc := range []struct {
+		pattern string
+		want    []string
+	}{
+		{"c[ao]t", []string{"cat", "cot"}},
+		{"c[^ao]t", []string{"c-t", "c?t", "c]t", "c^t", "cit", "cut"}},
+		{"c[a-i]t", []string{"cat", "cit"}},
+		{"c[^a-z?\\]\\-]t", []string{"c^t"}},
+		{"c[\\]]t", []string{"c]t"}},
+		{"c[a\\-]t", []string{"c-t", "cat"}},
+		{"c\\?t", []string{"c?t"}},
+		{"ж[аyу]к", []string{"жак", "жук"}},
+		{"[^c]??", []string{"dog", "жак", "жук"}},
+		{"[x]??", nil},
+	} {
+		got, err := root.PatternSearch(tc.pattern)
+		if err != nil {
+			t.Errorf("PatternSearch(%q): %v", tc.pattern, err)
+			continue
+		}
+		if !equalWords(got, tc.want) {
+			t.Errorf("PatternSearch(%q) = %q, want %q", tc.pattern, got, tc.want)
+		}
+	}
+	for _, pattern := range []string{"c[ao", "c[]t", "c[z-a]t", "c\\", "\xff"} {
+		if _, err := root.PatternSearch(pattern); !errors.Is(err, ErrBadPattern) {
+			t.Errorf("PatternSearch(%q): %v, want %v", pattern, err, ErrBadPattern)
+		}
+	}
+}
+
+func TestDumpSorted(t *testing.T) {
+	words := append(randomWords(5000, 9, "abcdeжз日", 86), "", "a", "ab")
+	root := build(t, words...)
+	root.Optimise()
+	filename := filepath.Join(t.TempDir(), "words.txt")
+	if err := root.DumpSorted(filename); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[string]bool)
+	var want []string
+	for _, w := range words {
+		if !seen[w] {
+			seen[w] = true
+			want = append(want, w)
+		}
+	}
+	sort.Strings(want)
+	if got := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n"); !reflect.DeepEqual(got, want) {
+		t.Errorf("DumpSorted wrote %d lines, want %d", len(got), len(want))
+	}
+	if err := root.WriteSorted(&failingWriter{n: 5000}); err != errWriteFailed {
+		t.Errorf("WriteSorted to a failing writer: %v, want %v", err, errWriteFailed)
+	}
+	missing := filepath.Join(t.TempDir(), "missing", "words.txt")
+	if err := root.DumpSorted(missing); err == nil {
+		t.Errorf("DumpSorted into a missing directory succeeded")
+	}
+	if err := NewDAWG().DumpSorted(filename); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filename); err != nil || len(data) != 0 {
+		t.Errorf("DumpSorted of an empty graph wrote %q, %v", data, err)
+	}
+}
+
+func TestFlatFrequencies(t *testing.T) {
+	counts := make(map[string]int)
+	for i, w := range randomWords(2000, 6, "abcdж", 87) {
+		counts[w] = i%7 + 1
+	}
+	id := 0
+	root, err := FromCounts(counts, &id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root.Optimise()
+	o := root.FlatArray()
+	for name, write := range map[string]func(io.Writer) (int64, error){"fixed": o.WriteTo, "compact": o.WriteCompactTo} {
+		var buf bytes.Buffer
+		if _, err := write(&buf); err != nil {
+			t.Fatal(err)
+		}
+		filename := filepath.Join(t.TempDir(), name+".wg")
+		if err := os.WriteFile(filename, buf.Bytes(), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := LoadFlat(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for w, n := range counts {
+			if got := loaded.FrequencyFlat(w); got != n {
+				t.Errorf("%s: FrequencyFlat(%q) = %d, want %d", name, w, got, n)
+			}
+		}
+		if got := loaded.FrequencyFlat("zzz"); got != 0 {
+			t.Errorf("%s: FrequencyFlat of a missing word = %d", name, got)
+		}
+	}
+	// Without counts above 1 the fixed format has the records alone.
+	var once []string
+	for w := range counts {
+		once = append(once, w)
+	}
+	plain := build(t, once...)
+	plain.Optimise()
+	o = plain.FlatArray()
+	var buf bytes.Buffer
+	if _, err := o.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.Len(), flatHeaderSize+len(o)*flatRecordSize; got != want {
+		t.Errorf("the file without counts has %d bytes, want %d", got, want)
+	}
+	if buf.Bytes()[len(flatMagic)] != flatFormat {
+		t.Errorf("the file without counts is in format %d, want %d", buf.Bytes()[len(flatMagic)], flatFormat)
+	}
+}
+
+func TestHammingSearch(t *testing.T) {
+	root := build(t, "ACGT", "ACGA", "TCGT", "AGGT", "ACG", "ACGTA", "GGGG", "ЖCGT")
+	for _, tc := range []struct {
+		query string
+		k     int
+		want  []string
+	}{
+		{"ACGT", 0, []string{"ACGT"}},
+		{"ACGT", 1, []string{"ACGA", "ACGT", "AGGT", "TCGT", "ЖCGT"}},
+		{"ACGT", 2, []string{"ACGA", "ACGT", "AGGT", "TCGT", "ЖCGT"}},
+		{"ACGT", 4, []string{"ACGA", "ACGT", "AGGT", "GGGG", "TCGT", "ЖCGT"}},
+		{"ЖCGA", 1, []string{"ACGA", "ЖCGT"}}, // Ж is one rune, not two bytes.
+		{"ACG", 0, []string{"ACG"}},
+		{"ACGTT", 1, []string{"ACGTA"}},
+		{"ACGT", -1, nil},
+		{"", 0, nil},
+	} {
+		if got := root.HammingSearch(tc.query, tc.k); !equalWords(got, tc.want) {
+			t.Errorf("HammingSearch(%q, %d) = %q, want %q", tc.query, tc.k, got, tc.want)
+		}
+	}
+	// Against a brute force over a DNA-like dictionary.
+	words := randomWords(3000, 8, "ACGT", 88)
+	root = build(t, words...)
+	root.Optimise()
+	all := root.Words()
+	for _, query := range randomWords(30, 8, "ACGT", 89) {
+		var want []string
+		for _, w := range all {
+			if len(w) != len(query) {
+				continue
+			}
+			mismatches := 0
+			for i := range w {
+				if w[i] != query[i] {
+					mismatches++
+				}
+			}
+			if mismatches <= 2 {
+				want = append(want, w)
+			}
+		}
+		if got := root.HammingSearch(query, 2); !equalWords(got, want) {
+			t.Errorf("HammingSearch(%q, 2) = %d words, want %d", query, len(got), len(want))
+		}
+	}
+}
+
+func TestPalindromes(t *testing.T) {
+	root := build(t, "level", "levels", "noon", "a", "ab", "", "шалаш", "казак", "кот", "日本日", "日本",
+		"\u00e9t\u00e9", "e\u0301te\u0301", "e\u0301e")
+	root.Optimise()
+	// Runes are compared one by one: an "é" written with a combining
+	// mark is two runes, which read in the wrong order backwards.
+	want := []string{"", "a", "e\u0301e", "level", "noon", "\u00e9t\u00e9", "казак", "шалаш", "日本日"}
+	if got := root.Palindromes(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Palindromes = %q, want %q", got, want)
+	}
+	if got := NewDAWG().Palindromes(); len(got) != 0 {
+		t.Errorf("Palindromes of an empty graph = %q", got)
+	}
+}
+
+func TestStatsCachedUntilChange(t *testing.T) {
+	root := build(t, randomWords(3000, 8, "abcdef", 90)...)
+	root.Optimise()
+	first := root.Stats()
+	// A second walk would allocate its visited map.
+	if allocs := testing.AllocsPerRun(10, func() { root.Stats() }); allocs != 0 {
+		t.Errorf("Stats on an unchanged graph allocates %v times", allocs)
+	}
+	if allocs := testing.AllocsPerRun(10, func() { root.WordCount() }); allocs != 0 {
+		t.Errorf("WordCount on an unchanged graph allocates %v times", allocs)
+	}
+	if got := root.Stats(); got != first {
+		t.Errorf("second Stats = %+v, want %+v", got, first)
+	}
+	id := 100000
+	for _, mutate := range []func() error{
+		func() error { return root.Put("zzzzzz", &id) },
+		func() error { _, err := root.Delete("zzzzzz", &id); return err },
+		func() error { return root.AddWithCount("abc", 2, &id) },
+		func() error { return root.DeMinimize(&id) },
+	} {
+		before := root.Stats()
+		if err := mutate(); err != nil {
+			t.Fatal(err)
+		}
+		var want Stats
+		visited := make(map[*treenode]bool)
+		root.collectStats(&want, &visited)
+		want.Words = len(root.Words())
+		if got := root.Stats(); got != want {
+			t.Errorf("Stats after a change = %+v, want %+v (before: %+v)", got, want, before)
+		}
+	}
+}
+
+func TestFromCounts(t *testing.T) {
+	counts := map[string]int{"cat": 3, "bat": 1, "rat": 3, "car": 7, "": 2}
+	id := 0
+	root, err := FromCounts(counts, &id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root.Optimise()
+	for w, n := range counts {
+		if got := root.Frequency(w); got != n {
+			t.Errorf("Frequency(%q) = %d, want %d", w, got, n)
+		}
+	}
+	if got := root.Frequency("ca"); got != 0 {
+		t.Errorf("Frequency of a prefix = %d", got)
+	}
+	// "cat" and "rat" end at one node; "bat" is put once and does not.
+	if !root.SameSuffixClass("rat", "cat") {
+		t.Errorf("words with equal counts share no suffix")
+	}
+	if root.SameSuffixClass("bat", "rat") {
+		t.Errorf("words with different counts share their suffix")
+	}
+	// The same counts always give the same ids.
+	again := 0
+	other, err := FromCounts(counts, &again)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.Optimise()
+	if !reflect.DeepEqual(ids(other), ids(root)) || again != id {
+		t.Errorf("FromCounts numbered the nodes differently")
+	}
+	if _, err := FromCounts(map[string]int{"a": 0}, &id); err == nil {
+		t.Errorf("FromCounts with a zero count succeeded")
+	}
+}
+
+func TestIsPrefixFree(t *testing.T) {
+	for _, tc := range []struct {
+		words []string
+		want  bool
+	}{
+		{nil, true},
+		{[]string{""}, true},
+		{[]string{"0", "10", "110", "111"}, true},
+		{[]string{"car", "cat", "dog"}, true},
+		{[]string{"car", "cart"}, false},
+		{[]string{"", "a"}, false},
+		{[]string{"0", "10", "11", "110"}, false},
+		{[]string{"abc", "abcdefgh", "x"}, false},
+	} {
+		for _, optimise := range []bool{false, true} {
+			root := build(t, tc.words...)
+			if optimise {
+				root.Optimise()
+			}
+			if got := root.IsPrefixFree(); got != tc.want {
+				t.Errorf("optimised %v: IsPrefixFree of %q = %v, want %v", optimise, tc.words, got, tc.want)
+			}
+			leaves := root.LeafWords()
+			if got := len(leaves) == root.WordCount(); got != tc.want {
+				t.Errorf("optimised %v: %q has %d leaf words of %d", optimise, tc.words, len(leaves), root.WordCount())
+			}
+		}
+	}
+	// A branch that ends in no word does not make its node a prefix.
+	root := build(t, "ab", "abc")
+	root.find("abc").endofword = false
+	if !root.IsPrefixFree() {
+		t.Errorf("IsPrefixFree with a branch that ends in no word = false")
+	}
+}
+
+func TestFuzzyWithFixedPrefixNarrows(t *testing.T) {
+	root := build(t, "cart", "card", "dart", "cast", "carts", "bart", "car")
+	// "card" is one edit from "dard" but does not start with the
+	// "d" the user typed.
+	if got, want := root.FuzzySearch("dard", 1), []string{"card", "dart"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("FuzzySearch = %q, want %q", got, want)
+	}
+	if got, want := root.FuzzyWithFixedPrefix("d", "ard", 1), []string{"dart"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("FuzzyWithFixedPrefix = %q, want %q", got, want)
+	}
+	// Edits are only allowed after the prefix.
+	if got := root.FuzzyWithFixedPrefix("x", "art", 1); len(got) != 0 {
+		t.Errorf("FuzzyWithFixedPrefix with a prefix that is no word's = %q", got)
+	}
+	if got, want := root.FuzzyWithFixedPrefix("car", "", 1), []string{"car", "card", "cart"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("FuzzyWithFixedPrefix(%q, %q, 1) = %q, want %q", "car", "", got, want)
+	}
+	if got, want := root.FuzzyWithFixedPrefix("", "dard", 1), root.FuzzySearch("dard", 1); !reflect.DeepEqual(got, want) {
+		t.Errorf("FuzzyWithFixedPrefix with no prefix = %q, want %q", got, want)
+	}
+}
+
+func TestSharing(t *testing.T) {
+	root := build(t, "walking", "talking", "walked", "talked")
+	// The trie has "walk" and "talk" with "ing" and "ed" below each:
+	// 18 nodes for 26 runes.
+	want := SharingStats{ListRunes: 26, PrefixSaved: 8}
+	if got := root.Sharing(); got != want {
+		t.Errorf("Sharing before Optimise = %+v, want %+v", got, want)
+	}
+	// Minimised, "alk", "ing" and "ed" are stored once.
+	root.Optimise()
+	want.SuffixSaved = 8
+	if got := root.Sharing(); got != want {
+		t.Errorf("Sharing after Optimise = %+v, want %+v", got, want)
+	}
+	stored := want.ListRunes - want.PrefixSaved - want.SuffixSaved
+	if nodes := root.Stats().Nodes - 1; stored != nodes {
+		t.Errorf("Sharing leaves %d runes, the graph has %d nodes but the root", stored, nodes)
+	}
+	if got := NewDAWG().Sharing(); got != (SharingStats{}) {
+		t.Errorf("Sharing of an empty graph = %+v", got)
+	}
+	// Words with no common suffix save nothing from Optimise.
+	root = build(t, "ab", "cd", "ae")
+	root.Optimise()
+	if got := root.Sharing(); got != (SharingStats{ListRunes: 6, PrefixSaved: 1}) {
+		t.Errorf("Sharing without common suffixes = %+v", got)
+	}
+}
+
+func TestLoadFlatVerified(t *testing.T) {
+	root := build(t, randomWords(500, 6, "abcdef", 91)...)
+	root.Optimise()
+	dir := t.TempDir()
+	good := filepath.Join(dir, "good.wg")
+	writeFlatFile(t, root.FlatArray(), good)
+	o, err := LoadFlatVerified(good)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(o, root.FlatArray()) {
+		t.Errorf("LoadFlatVerified read another array")
+	}
+	last := len(o) - 1
+	for name, corrupt := range map[string]func(o outarray){
+		"child index past the end": func(o outarray) { o[1].children = rune(len(o) + 5) },
+		"negative child index":     func(o outarray) { o[1].children = -3 },
+		// The last record ends the last run, so the run goes on past it.
+		"unterminated last run": func(o outarray) { o[last].eol = false },
+		"root in a run":         func(o outarray) { o[0].eol = false },
+	} {
+		broken := root.FlatArray()
+		corrupt(broken)
+		if err := VerifyFlat(broken); err == nil {
+			t.Errorf("%s: VerifyFlat passed", name)
+		}
+		filename := filepath.Join(dir, "broken.wg")
+		writeFlatFile(t, broken, filename)
+		if _, err := LoadFlat(filename); err != nil {
+			t.Errorf("%s: LoadFlat, which does not verify: %v", name, err)
+		}
+		if _, err := LoadFlatVerified(filename); err == nil {
+			t.Errorf("%s: LoadFlatVerified accepted the file", name)
+		}
+	}
+}
+
+func TestFirstLevelIndex(t *testing.T) {
+	words := append(randomWords(400, 5, "abcdef", 92), "жук", "ёж", "x")
+	for _, optimise := range []bool{false, true} {
+		root := build(t, words...)
+		if optimise {
+			root.Optimise()
+		}
+		first := make(map[rune]bool)
+		for _, word := range words {
+			if char, _ := utf8.DecodeRuneInString(word); word != "" {
+				first[char] = true
+			}
+		}
+		index := root.FirstLevelIndex()
+		if len(index) != len(first) {
+			t.Errorf("optimise=%v: %d first runes, want %d", optimise, len(index), len(first))
+		}
+		for char, node := range index {
+			if !first[char] {
+				t.Errorf("optimise=%v: %q is no word's first rune", optimise, char)
+			}
+			for _, word := range words {
+				if strings.HasPrefix(word, string(char)) && !node.Contains(word[utf8.RuneLen(char):]) {
+					t.Errorf("optimise=%v: the node of %q lacks %q", optimise, char, word)
+				}
+			}
+		}
+	}
+	if index := build(t).FirstLevelIndex(); len(index) != 0 {
+		t.Errorf("empty dictionary: %d first runes", len(index))
+	}
+}
+
+func TestNeighborsMatchesFuzzySearch(t *testing.T) {
+	root := build(t, append(randomWords(3000, 6, "abcde", 93), "жук", "жук", "жуки", "жа")...)
+	root.Optimise()
+	for _, query := range append(randomWords(300, 7, "abcdef", 94), "", "жу", "жук", "жкук") {
+		var want []string
+		for _, word := range root.FuzzySearch(query, 1) {
+			if word != query {
+				want = append(want, word)
+			}
+		}
+		sort.Strings(want)
+		if got := root.Neighbors(query); !equalWords(got, want) {
+			t.Errorf("Neighbors(%q) = %q, want %q", query, got, want)
+		}
+	}
+}
+
+func BenchmarkNeighbors(b *testing.B) {
+	root := build(b, randomWords(200000, 9, "abcdefghijklmnopqrstuvwxyz", 95)...)
+	queries := randomWords(50, 9, "abcdefghijklmnopqrstuvwxyz", 96)
+	b.Run("fuzzy", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			root.FuzzySearch(queries[i%len(queries)], 1)
+		}
+	})
+	b.Run("neighbors", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			root.Neighbors(queries[i%len(queries)])
+		}
+	})
+}
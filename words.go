@@ -0,0 +1,809 @@
+package wordgraph6
+
+import (
+	"bufio"
+	"container/heap"
+	"errors"
+	"io"
+	"os"
+	"unicode/utf8"
+)
+
+// WordsWithSharing calls fn for every word together with the number
+// of nodes on its path that minimisation shares with other words and
+// the number of nodes that belong to this word's prefixes only.
+// Once a path has entered a node with more than one parent, every
+// node below it is reachable from other prefixes too and counts
+// as shared. The graph is minimised first if it is not already.
+func (t *treenode) WordsWithSharing(fn func(word string, sharedNodes, uniqueNodes int)) {
+	if !t.IsMinimized() {
+		t.Optimise()
+	}
+	parentCounts := make(map[*treenode]int)
+	visited := make(map[*treenode]bool)
+	t.countParents(&parentCounts, &visited)
+	var word []rune
+	for child := t.children; child != nil; child = child.next {
+		child.wordsWithSharing(&word, 0, parentCounts, fn)
+	}
+}
+
+func (t *treenode) wordsWithSharing(word *[]rune, shared int, pc map[*treenode]int, fn func(string, int, int)) {
+	*word = append(*word, t.val)
+	if shared > 0 || pc[t] > 1 {
+		shared++
+	}
+	if t.endofword {
+		fn(string(*word), shared, len(*word)-shared)
+	}
+	for child := t.children; child != nil; child = child.next {
+		child.wordsWithSharing(word, shared, pc, fn)
+	}
+	*word = (*word)[:len(*word)-1]
+}
+
+// eachWordNode is eachWord with the node where the word ends,
+// stopping at the first error fn returns.
+func (t *treenode) eachWordNode(fn func(word []rune, node *treenode) error) error {
+	var word []rune
+	return t.eachWordNode1(&word, fn)
+}
+
+func (t *treenode) eachWordNode1(word *[]rune, fn func([]rune, *treenode) error) error {
+	if t.endofword {
+		if err := fn(*word, t); err != nil {
+			return err
+		}
+	}
+	for child := t.children; child != nil; child = child.next {
+		*word = append(*word, child.val)
+		err := child.eachWordNode1(word, fn)
+		*word = (*word)[:len(*word)-1]
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// countParents counts for every node the distinct nodes
+// that have it among their children.
+func (t *treenode) countParents(pc *map[*treenode]int, visited *map[*treenode]bool) {
+	(*visited)[t] = true
+	for child := t.children; child != nil; child = child.next {
+		(*pc)[child]++
+		if _, found := (*visited)[child]; !found {
+			child.countParents(pc, visited)
+		}
+	}
+}
+
+// eachWord calls fn for every word in child order. The slice
+// passed to fn is reused, so fn must copy it to keep it.
+func (t *treenode) eachWord(fn func(word []rune)) {
+	var word []rune
+	if t.endofword {
+		fn(word)
+	}
+	for child := t.children; child != nil; child = child.next {
+		child.eachWord1(&word, fn)
+	}
+}
+
+func (t *treenode) eachWord1(word *[]rune, fn func([]rune)) {
+	*word = append(*word, t.val)
+	if t.endofword {
+		fn(*word)
+	}
+	for child := t.children; child != nil; child = child.next {
+		child.eachWord1(word, fn)
+	}
+	*word = (*word)[:len(*word)-1]
+}
+
+// Words returns all the words in the graph. Children are kept
+// sorted, so the words come out in lexicographic order: by rune
+// value unless another collation has been set with SetCollation.
+func (t *treenode) Words() []string {
+	var words []string
+	t.eachWord(func(word []rune) {
+		words = append(words, string(word))
+	})
+	return words
+}
+
+// DumpSorted writes the words to filename one per line, in the order
+// of Words, without holding them in memory: only the path to the
+// current word is kept, on a stack as deep as the longest word. The
+// file is synced before DumpSorted returns; if anything fails it is
+// removed, so that no truncated list is left behind.
+func (t *treenode) DumpSorted(filename string) error {
+	outfile, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	err = t.WriteSorted(outfile)
+	if err == nil {
+		err = outfile.Sync()
+	}
+	if closeErr := outfile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(filename)
+	}
+	return err
+}
+
+// WriteSorted writes what DumpSorted puts in its file to w.
+func (t *treenode) WriteSorted(w io.Writer) error {
+	writer := bufio.NewWriter(w)
+	if t.endofword {
+		if err := writer.WriteByte('\n'); err != nil {
+			return err
+		}
+	}
+	// stack holds the next sibling to visit at every depth, and ends
+	// the length of line at that depth before the sibling's rune.
+	var line []byte
+	stack := []*treenode{t.children}
+	ends := []int{0}
+	for len(stack) > 0 {
+		top := len(stack) - 1
+		node := stack[top]
+		if node == nil {
+			stack, ends = stack[:top], ends[:top]
+			continue
+		}
+		stack[top] = node.next
+		line = utf8.AppendRune(line[:ends[top]], node.val)
+		if node.endofword {
+			writer.Write(line)
+			if err := writer.WriteByte('\n'); err != nil {
+				return err
+			}
+		}
+		if node.children != nil {
+			stack = append(stack, node.children)
+			ends = append(ends, len(line))
+		}
+	}
+	return writer.Flush()
+}
+
+// Page returns up to limit words in sorted order, starting with the
+// word at position offset. Subtrees that lie wholly before offset are
+// skipped by their word counts, so deep pages cost no more than the
+// first one.
+func (t *treenode) Page(offset, limit int) []string {
+	if offset < 0 || limit <= 0 || offset >= t.WordCount() {
+		return nil
+	}
+	var words []string
+	var word []rune
+	t.page(&word, &offset, limit, &words)
+	return words
+}
+
+func (t *treenode) page(word *[]rune, skip *int, limit int, words *[]string) {
+	if t.endofword {
+		if *skip > 0 {
+			*skip--
+		} else {
+			*words = append(*words, string(*word))
+		}
+	}
+	for child := t.children; child != nil && len(*words) < limit; child = child.next {
+		if *skip >= child.count {
+			*skip -= child.count
+			continue
+		}
+		*word = append(*word, child.val)
+		child.page(word, skip, limit, words)
+		*word = (*word)[:len(*word)-1]
+	}
+}
+
+// Completions returns the words that start with prefix,
+// prefix itself included if it is a word, in sorted order.
+func (t *treenode) Completions(prefix string) []string {
+	words, _ := t.CompletionsLimited(prefix, 0)
+	return words
+}
+
+// CompletionsLimited is Completions stopped after the first maxResults
+// words; 0 or less means no limit. It reports whether words were left
+// out, so that a server can cap broad prefixes and say so.
+func (t *treenode) CompletionsLimited(prefix string, maxResults int) ([]string, bool) {
+	prefix = t.key(prefix)
+	node := t.find(prefix)
+	if node == nil {
+		return nil, false
+	}
+	res := &results{max: maxResults}
+	if node.endofword {
+		res.add(prefix)
+	}
+	// Start the path with the prefix, so that every word is built
+	// with a single conversion instead of a concatenation.
+	word := []rune(prefix)
+	for child := node.children; child != nil && !res.truncated; child = child.next {
+		child.collect(&word, res)
+	}
+	return res.words, res.truncated
+}
+
+// ShortestCompletion returns the shortest word that starts with
+// prefix, prefix itself if it is a word, and the first in sorted order
+// of those that are equally short. Completions lists the words in
+// sorted order instead, so its first word need not be the shortest.
+// It returns false if no word starts with prefix.
+func (t *treenode) ShortestCompletion(prefix string) (string, bool) {
+	prefix = t.key(prefix)
+	node := t.find(prefix)
+	if node == nil {
+		return "", false
+	}
+	// Walk breadth-first, remembering how every node was reached
+	// so that the word can be spelled out once one is found.
+	type step struct {
+		node *treenode
+		from int
+	}
+	queue := []step{{node, -1}}
+	seen := map[*treenode]bool{node: true}
+	for i := 0; i < len(queue); i++ {
+		if queue[i].node.endofword {
+			var suffix []rune
+			for j := i; j > 0; j = queue[j].from {
+				suffix = append(suffix, queue[j].node.val)
+			}
+			for l, r := 0, len(suffix)-1; l < r; l, r = l+1, r-1 {
+				suffix[l], suffix[r] = suffix[r], suffix[l]
+			}
+			return prefix + string(suffix), true
+		}
+		for child := queue[i].node.children; child != nil; child = child.next {
+			if !seen[child] {
+				seen[child] = true
+				queue = append(queue, step{child, i})
+			}
+		}
+	}
+	return "", false
+}
+
+// results gathers the words of an enumeration, at most max of them
+// if max is positive.
+type results struct {
+	words     []string
+	max       int
+	truncated bool
+}
+
+// add keeps word unless the results are full and reports whether
+// the enumeration should go on.
+func (r *results) add(word string) bool {
+	if r.max > 0 && len(r.words) == r.max {
+		r.truncated = true
+		return false
+	}
+	r.words = append(r.words, word)
+	return true
+}
+
+// collect adds the words below and including t until res is full.
+func (t *treenode) collect(word *[]rune, res *results) {
+	*word = append(*word, t.val)
+	if !t.endofword || res.add(string(*word)) {
+		for child := t.children; child != nil && !res.truncated; child = child.next {
+			child.collect(word, res)
+		}
+	}
+	*word = (*word)[:len(*word)-1]
+}
+
+// CompletionsRanked returns the words that start with prefix, most
+// frequent first and ties in sorted order. Only the best limit words
+// are kept while the subtree is walked; a limit of 0 or less means all.
+func (t *treenode) CompletionsRanked(prefix string, limit int) []string {
+	prefix = t.key(prefix)
+	node := t.find(prefix)
+	if node == nil {
+		return nil
+	}
+	h := &rankedHeap{}
+	word := []rune(prefix)
+	node.completionsRanked(&word, limit, h)
+	ranked := make([]string, h.Len())
+	for i := len(ranked) - 1; i >= 0; i-- {
+		ranked[i] = heap.Pop(h).(rankedWord).word
+	}
+	return ranked
+}
+
+func (t *treenode) completionsRanked(word *[]rune, limit int, h *rankedHeap) {
+	if t.endofword {
+		if limit <= 0 || h.Len() < limit {
+			heap.Push(h, rankedWord{string(*word), t.freq})
+		} else if top := (*h)[0]; t.freq >= top.freq {
+			if candidate := (rankedWord{string(*word), t.freq}); worse(top, candidate) {
+				(*h)[0] = candidate
+				heap.Fix(h, 0)
+			}
+		}
+	}
+	for child := t.children; child != nil; child = child.next {
+		*word = append(*word, child.val)
+		child.completionsRanked(word, limit, h)
+		*word = (*word)[:len(*word)-1]
+	}
+}
+
+type rankedWord struct {
+	word string
+	freq int
+}
+
+func worse(a, b rankedWord) bool {
+	if a.freq != b.freq {
+		return a.freq < b.freq
+	}
+	return a.word > b.word
+}
+
+// rankedHeap keeps the worst of the best words found so far on top.
+type rankedHeap []rankedWord
+
+func (h rankedHeap) Len() int            { return len(h) }
+func (h rankedHeap) Less(i, j int) bool  { return worse(h[i], h[j]) }
+func (h rankedHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *rankedHeap) Push(x interface{}) { *h = append(*h, x.(rankedWord)) }
+
+func (h *rankedHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// NextRunes returns the runes that can follow prefix, in child order,
+// and whether prefix is itself a word. It returns nil and false if no
+// word starts with prefix.
+func (t *treenode) NextRunes(prefix string) ([]rune, bool) {
+	node := t.find(t.key(prefix))
+	if node == nil {
+		return nil, false
+	}
+	var runes []rune
+	for child := node.children; child != nil; child = child.next {
+		runes = append(runes, child.val)
+	}
+	return runes, node.endofword
+}
+
+// CommonPrefix returns the longest common prefix of a and b that is
+// spelled out in the graph, i.e. the path from the root that both
+// words follow before they part or one of them leaves the graph.
+func (t *treenode) CommonPrefix(a, b string) string {
+	a, b = t.key(a), t.key(b)
+	node := t
+	end := 0
+	for end < len(a) && end < len(b) {
+		ra, size := utf8.DecodeRuneInString(a[end:])
+		rb, _ := utf8.DecodeRuneInString(b[end:])
+		if ra != rb {
+			break
+		}
+		if node = node.child(ra); node == nil {
+			break
+		}
+		end += size
+	}
+	return a[:end]
+}
+
+// SameSuffixClass reports whether a and b are both in the graph and
+// their paths, having parted, run into the same node again. From that
+// node on the two words are spelled from the same set of endings; if
+// they end at the same node, every word that extends one by some
+// ending has a counterpart extending the other by it. Only Optimise
+// makes paths meet, so on a graph that is not minimised the result is
+// false, as it is for a word and itself, whose paths never part.
+func (t *treenode) SameSuffixClass(a, b string) bool {
+	pathA := t.path(t.key(a))
+	pathB := t.path(t.key(b))
+	if pathA == nil || pathB == nil {
+		return false
+	}
+	before := make(map[*treenode]*treenode, len(pathA))
+	for i := 1; i < len(pathA); i++ {
+		before[pathA[i]] = pathA[i-1]
+	}
+	for i := 1; i < len(pathB); i++ {
+		if prev, found := before[pathB[i]]; found && prev != pathB[i-1] {
+			return true
+		}
+	}
+	return false
+}
+
+// path returns the nodes that spell word, the root first,
+// or nil if word is not in the graph.
+func (t *treenode) path(word string) []*treenode {
+	path := []*treenode{t}
+	node := t
+	for _, char := range word {
+		if node = node.child(char); node == nil {
+			return nil
+		}
+		path = append(path, node)
+	}
+	if !node.endofword {
+		return nil
+	}
+	return path
+}
+
+// AllPrefixesOf returns every word in the graph that is a prefix of s,
+// s itself included, shortest first. It is the set of matches a
+// tokeniser can choose from at the start of s.
+func (t *treenode) AllPrefixesOf(s string) []string {
+	s = t.key(s)
+	var prefixes []string
+	node := t
+	if node.endofword {
+		prefixes = append(prefixes, "")
+	}
+	for end := 0; end < len(s); {
+		char, size := utf8.DecodeRuneInString(s[end:])
+		if node = node.child(char); node == nil {
+			break
+		}
+		end += size
+		if node.endofword {
+			prefixes = append(prefixes, s[:end])
+		}
+	}
+	return prefixes
+}
+
+// Depth returns the length of word in runes, which is the level
+// of the node it ends at, and whether word is in the graph.
+func (t *treenode) Depth(word string) (int, bool) {
+	word = t.key(word)
+	if !t.Contains(word) {
+		return 0, false
+	}
+	return utf8.RuneCountInString(word), true
+}
+
+// Height returns the height of the node that word ends at: how many
+// runes the longest word that extends word adds to it. A word that is
+// not the prefix of another word has height 0.
+func (t *treenode) Height(word string) (int, bool) {
+	node := t.find(t.key(word))
+	if node == nil || !node.endofword {
+		return 0, false
+	}
+	state := t.info()
+	state.lazy.Lock()
+	defer state.lazy.Unlock()
+	if !state.annotated {
+		t.ComputeAnnotations()
+	}
+	return node.height, true
+}
+
+// MaxWordLength returns the length in runes of the longest word,
+// which is the height of the root. It is 0 for an empty graph and
+// for one that holds only the empty word.
+func (t *treenode) MaxWordLength() int {
+	state := t.info()
+	state.lazy.Lock()
+	defer state.lazy.Unlock()
+	if !state.annotated {
+		t.ComputeAnnotations()
+	}
+	return t.height
+}
+
+// LongestWord returns a word of MaxWordLength runes, the first in
+// sorted order if there are several, and false if the graph is empty.
+// It follows the heights down from the root: at every node it takes
+// the first child that is one lower, so it visits no other branch.
+func (t *treenode) LongestWord() (string, bool) {
+	height := t.MaxWordLength()
+	var word []rune
+	node := t
+	for ; height > 0; height-- {
+		child := node.children
+		for child.height != height-1 {
+			child = child.next
+		}
+		word = append(word, child.val)
+		node = child
+	}
+	if !node.endofword {
+		return "", false
+	}
+	return string(word), true
+}
+
+// Palindromes returns, in the order of Words, the words that read the
+// same backwards, rune by rune, the empty word and one-rune words
+// included. Runes are compared as they are stored, so a letter written
+// with a combining mark reads as two runes.
+func (t *treenode) Palindromes() []string {
+	words, _ := t.PalindromesLimited(0)
+	return words
+}
+
+// PalindromesLimited is Palindromes stopped after the first maxResults
+// words; 0 or less means no limit. It reports whether words were left
+// out.
+func (t *treenode) PalindromesLimited(maxResults int) ([]string, bool) {
+	res := &results{max: maxResults}
+	t.eachWordNode(func(word []rune, node *treenode) error {
+		if isPalindrome(word) && !res.add(string(word)) {
+			return errResultsFull
+		}
+		return nil
+	})
+	return res.words, res.truncated
+}
+
+// errResultsFull stops an enumeration that reports its words
+// through a callback once the results are full.
+var errResultsFull = errors.New("wordgraph6: results full")
+
+func isPalindrome(word []rune) bool {
+	for i, j := 0, len(word)-1; i < j; i, j = i+1, j-1 {
+		if word[i] != word[j] {
+			return false
+		}
+	}
+	return true
+}
+
+// ConstrainedSearch returns, in sorted order, the words that start with
+// prefix, end with suffix and are at most maxLen runes long. The prefix
+// and the suffix may overlap. A maxLen of 0 or less means no limit.
+func (t *treenode) ConstrainedSearch(prefix, suffix string, maxLen int) []string {
+	words, _ := t.ConstrainedSearchLimited(prefix, suffix, maxLen, 0)
+	return words
+}
+
+// ConstrainedSearchLimited is ConstrainedSearch stopped after the first
+// maxResults words; 0 or less means no limit. It reports whether words
+// were left out.
+func (t *treenode) ConstrainedSearchLimited(prefix, suffix string, maxLen, maxResults int) ([]string, bool) {
+	prefix, suffix = t.key(prefix), t.key(suffix)
+	node := t.find(prefix)
+	if node == nil {
+		return nil, false
+	}
+	word := []rune(prefix)
+	if maxLen > 0 && len(word) > maxLen {
+		return nil, false
+	}
+	res := &results{max: maxResults}
+	node.constrainedSearch(&word, []rune(suffix), maxLen, res)
+	return res.words, res.truncated
+}
+
+func (t *treenode) constrainedSearch(word *[]rune, suffix []rune, maxLen int, res *results) {
+	if t.endofword && hasRuneSuffix(*word, suffix) && !res.add(string(*word)) {
+		return
+	}
+	if maxLen > 0 && len(*word) >= maxLen {
+		return
+	}
+	for child := t.children; child != nil && !res.truncated; child = child.next {
+		*word = append(*word, child.val)
+		child.constrainedSearch(word, suffix, maxLen, res)
+		*word = (*word)[:len(*word)-1]
+	}
+}
+
+func hasRuneSuffix(word, suffix []rune) bool {
+	if len(suffix) > len(word) {
+		return false
+	}
+	offset := len(word) - len(suffix)
+	for i, char := range suffix {
+		if word[offset+i] != char {
+			return false
+		}
+	}
+	return true
+}
+
+// WordsOfLength returns the words of exactly n runes in sorted order.
+// The walk does not go deeper than n.
+func (t *treenode) WordsOfLength(n int) []string {
+	words, _ := t.WordsOfLengthLimited(n, 0)
+	return words
+}
+
+// WordsOfLengthLimited is WordsOfLength stopped after the first
+// maxResults words; 0 or less means no limit. It reports whether
+// words were left out.
+func (t *treenode) WordsOfLengthLimited(n, maxResults int) ([]string, bool) {
+	res := &results{max: maxResults}
+	var word []rune
+	t.wordsOfLength(&word, n, res)
+	return res.words, res.truncated
+}
+
+func (t *treenode) wordsOfLength(word *[]rune, n int, res *results) {
+	if len(*word) == n {
+		if t.endofword {
+			res.add(string(*word))
+		}
+		return
+	}
+	for child := t.children; child != nil && !res.truncated; child = child.next {
+		*word = append(*word, child.val)
+		child.wordsOfLength(word, n, res)
+		*word = (*word)[:len(*word)-1]
+	}
+}
+
+// LeafWords returns, in sorted order, the words that are not a prefix
+// of any other word. What rules a word out is another word below it,
+// not children as such, so a word whose branches end in no word
+// still counts as a leaf.
+func (t *treenode) LeafWords() []string {
+	words, _ := t.LeafWordsLimited(0)
+	return words
+}
+
+// LeafWordsLimited is LeafWords stopped after the first maxResults
+// words; 0 or less means no limit. It reports whether words were left
+// out.
+func (t *treenode) LeafWordsLimited(maxResults int) ([]string, bool) {
+	res := &results{max: maxResults}
+	var word []rune
+	t.leafWords(&word, res)
+	return res.words, res.truncated
+}
+
+// leafWords reports whether t or a node below it ends a word.
+func (t *treenode) leafWords(word *[]rune, res *results) bool {
+	below := false
+	for child := t.children; child != nil && !res.truncated; child = child.next {
+		*word = append(*word, child.val)
+		if child.leafWords(word, res) {
+			below = true
+		}
+		*word = (*word)[:len(*word)-1]
+	}
+	if t.endofword && !below && !res.truncated {
+		res.add(string(*word))
+	}
+	return t.endofword || below
+}
+
+// IsPrefixFree reports whether no word is a prefix of another, that
+// is whether the words form a prefix code: every word is a leaf word.
+// It is true for an empty graph. Shared nodes are visited once.
+func (t *treenode) IsPrefixFree() bool {
+	free := true
+	ends := make(map[*treenode]bool)
+	t.prefixFree(&ends, &free)
+	return free
+}
+
+// prefixFree reports whether t or a node below it ends a word, and
+// clears free at a word with another word below it.
+func (t *treenode) prefixFree(ends *map[*treenode]bool, free *bool) bool {
+	if end, found := (*ends)[t]; found {
+		return end
+	}
+	below := false
+	for child := t.children; child != nil && *free; child = child.next {
+		if child.prefixFree(ends, free) {
+			below = true
+		}
+	}
+	if t.endofword && below {
+		*free = false
+	}
+	(*ends)[t] = t.endofword || below
+	return t.endofword || below
+}
+
+// WordsByLength returns all the words, the shorter first and words of
+// the same length in the order of Words. Each length is enumerated by
+// its own walk that goes no deeper than the length, so nothing but the
+// result is kept, at the price of walking the top of the graph again
+// for every length.
+func (t *treenode) WordsByLength() []string {
+	words, _ := t.WordsByLengthLimited(0)
+	return words
+}
+
+// WordsByLengthLimited is WordsByLength stopped after the first
+// maxResults words, so the shortest ones; 0 or less means no limit. It
+// reports whether words were left out.
+func (t *treenode) WordsByLengthLimited(maxResults int) ([]string, bool) {
+	res := &results{max: maxResults}
+	longest := t.MaxWordLength()
+	for n := 0; n <= longest && !res.truncated; n++ {
+		var word []rune
+		t.wordsOfLength(&word, n, res)
+	}
+	return res.words, res.truncated
+}
+
+// WordsWithTerminals calls fn for every word with the id of the node
+// it ends at. After minimisation several words may end at the same
+// node and so report the same id.
+func (t *treenode) WordsWithTerminals(fn func(word string, terminalID int)) {
+	var word []rune
+	t.wordsWithTerminals(&word, fn)
+}
+
+func (t *treenode) wordsWithTerminals(word *[]rune, fn func(string, int)) {
+	if t.endofword {
+		fn(string(*word), t.id)
+	}
+	for child := t.children; child != nil; child = child.next {
+		*word = append(*word, child.val)
+		child.wordsWithTerminals(word, fn)
+		*word = (*word)[:len(*word)-1]
+	}
+}
+
+// WordsForTerminal is the inverse of WordsWithTerminals: it returns,
+// in sorted order, the words that end at the node with the given id.
+// Only the subtrees that lead to that node are walked.
+func (t *treenode) WordsForTerminal(id int) []string {
+	words, _ := t.WordsForTerminalLimited(id, 0)
+	return words
+}
+
+// WordsForTerminalLimited is WordsForTerminal stopped after the first
+// maxResults words; 0 or less means no limit. It reports whether words
+// were left out.
+func (t *treenode) WordsForTerminalLimited(id, maxResults int) ([]string, bool) {
+	reaches := make(map[*treenode]bool)
+	if !t.reachesID(id, &reaches) {
+		return nil, false
+	}
+	res := &results{max: maxResults}
+	var word []rune
+	t.wordsForTerminal(id, &word, reaches, res)
+	return res.words, res.truncated
+}
+
+func (t *treenode) reachesID(id int, reaches *map[*treenode]bool) bool {
+	if found, done := (*reaches)[t]; done {
+		return found
+	}
+	found := t.id == id
+	for child := t.children; child != nil; child = child.next {
+		if child.reachesID(id, reaches) {
+			found = true
+		}
+	}
+	(*reaches)[t] = found
+	return found
+}
+
+func (t *treenode) wordsForTerminal(id int, word *[]rune, reaches map[*treenode]bool, res *results) {
+	if t.id == id {
+		if t.endofword {
+			res.add(string(*word))
+		}
+		return
+	}
+	for child := t.children; child != nil && !res.truncated; child = child.next {
+		if reaches[child] {
+			*word = append(*word, child.val)
+			child.wordsForTerminal(id, word, reaches, res)
+			*word = (*word)[:len(*word)-1]
+		}
+	}
+}